@@ -126,6 +126,26 @@ type AddCourseRequest struct {
 	Period      int        `json:"period"`
 	DayOfWeek   DayOfWeek  `json:"day_of_week"`
 	Keywords    string     `json:"keywords"`
+	// GradingPolicy は省略した場合デフォルトの方針になる
+	GradingPolicy *GradingPolicy `json:"grading_policy,omitempty"`
+}
+
+type GradingPolicy struct {
+	Type         string                 `json:"type"`
+	ClassWeights []ClassWeight          `json:"class_weights"`
+	LetterGrades []LetterGradeThreshold `json:"letter_grades"`
+	PassScore    int                    `json:"pass_score"`
+}
+
+type ClassWeight struct {
+	Part   uint8 `json:"part"`
+	Weight int   `json:"weight"`
+}
+
+type LetterGradeThreshold struct {
+	Grade      string  `json:"grade"`
+	MinScore   int     `json:"min_score"`
+	GradePoint float64 `json:"grade_point"`
 }
 
 type AddCourseResponse struct {
@@ -267,6 +287,17 @@ func RegisterScores(ctx context.Context, a *agent.Agent, courseID, classID strin
 	return a.Do(ctx, req)
 }
 
+func PublishScores(ctx context.Context, a *agent.Agent, courseID, classID string) (*http.Response, error) {
+	path := fmt.Sprintf("/api/courses/%s/classes/%s/assignments/scores/publish", courseID, classID)
+
+	req, err := a.PUT(path, nil)
+	if err != nil {
+		return nil, fails.ErrorCritical(err)
+	}
+
+	return a.Do(ctx, req)
+}
+
 func DownloadSubmittedAssignments(ctx context.Context, a *agent.Agent, courseID, classID string) (*http.Response, error) {
 	path := fmt.Sprintf("/api/courses/%s/classes/%s/assignments/export", courseID, classID)
 
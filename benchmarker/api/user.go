@@ -88,14 +88,19 @@ type Summary struct {
 }
 
 type CourseResult struct {
-	Name             string       `json:"name"`
-	Code             string       `json:"code"`
-	TotalScore       int          `json:"total_score"`
-	TotalScoreTScore float64      `json:"total_score_t_score"` // 偏差値
-	TotalScoreAvg    float64      `json:"total_score_avg"`     // 平均値
-	TotalScoreMax    int          `json:"total_score_max"`     // 最大値
-	TotalScoreMin    int          `json:"total_score_min"`     // 最小値
-	ClassScores      []ClassScore `json:"class_scores"`
+	Name             string  `json:"name"`
+	Code             string  `json:"code"`
+	TotalScore       int     `json:"total_score"`
+	TotalScoreTScore float64 `json:"total_score_t_score"` // 偏差値
+	TotalScoreAvg    float64 `json:"total_score_avg"`     // 平均値
+	TotalScoreMax    int     `json:"total_score_max"`     // 最大値
+	TotalScoreMin    int     `json:"total_score_min"`     // 最小値
+	// 四分位数と度数分布
+	TotalScoreQ1        float64           `json:"total_score_q1"`
+	TotalScoreMedian    float64           `json:"total_score_median"`
+	TotalScoreQ3        float64           `json:"total_score_q3"`
+	TotalScoreHistogram []HistogramBucket `json:"total_score_histogram"`
+	ClassScores         []ClassScore      `json:"class_scores"`
 }
 
 type ClassScore struct {
@@ -104,6 +109,18 @@ type ClassScore struct {
 	Part       uint8  `json:"part"`
 	Score      *int   `json:"score"`      // 0~100点
 	Submitters int    `json:"submitters"` // 提出した学生数
+	// 採点済みの提出の四分位数と度数分布
+	ScoreQ1        float64           `json:"score_q1"`
+	ScoreMedian    float64           `json:"score_median"`
+	ScoreQ3        float64           `json:"score_q3"`
+	ScoreHistogram []HistogramBucket `json:"score_histogram"`
+}
+
+// HistogramBucket は度数分布の区間 [lower, upper) と度数。最後の区間は upper を含む
+type HistogramBucket struct {
+	Lower int `json:"lower"`
+	Upper int `json:"upper"`
+	Count int `json:"count"`
 }
 
 func GetGrades(ctx context.Context, a *agent.Agent) (*http.Response, error) {
@@ -144,15 +144,16 @@ func majorCourseParam(dayOfWeek, period int, teacher *model.Teacher) *model.Cour
 	name.WriteString(randElt(majorSuffix))
 
 	return &model.CourseParam{
-		Code:        fmt.Sprintf("M%04d", code), // 重複不可, L,M+4桁の数字
-		Type:        "major-subjects",
-		Name:        name.String(),
-		Description: courseDescription(),
-		Credit:      rand.Intn(3) + 1, // 1-3
-		Teacher:     teacher.Name,
-		Period:      period,
-		DayOfWeek:   dayOfWeek,
-		Keywords:    strings.Join(keywords, " "),
+		Code:          fmt.Sprintf("M%04d", code), // 重複不可, L,M+4桁の数字
+		Type:          "major-subjects",
+		Name:          name.String(),
+		Description:   courseDescription(),
+		Credit:        rand.Intn(3) + 1, // 1-3
+		Teacher:       teacher.Name,
+		Period:        period,
+		DayOfWeek:     dayOfWeek,
+		Keywords:      strings.Join(keywords, " "),
+		GradingPolicy: gradingPolicy(),
 	}
 }
 
@@ -175,15 +176,44 @@ func liberalCourseParam(dayOfWeek, period int, teacher *model.Teacher) *model.Co
 	name.WriteString(randElt(liberalSuffix))
 
 	return &model.CourseParam{
-		Code:        fmt.Sprintf("L%04d", code), // 重複不可, L,M+4桁の数字
-		Type:        "liberal-arts",
-		Name:        name.String(),
-		Description: courseDescription(),
-		Credit:      rand.Intn(3) + 1, // 1-3
-		Teacher:     teacher.Name,
-		Period:      period,
-		DayOfWeek:   dayOfWeek,
-		Keywords:    strings.Join(keywords, " "),
+		Code:          fmt.Sprintf("L%04d", code), // 重複不可, L,M+4桁の数字
+		Type:          "liberal-arts",
+		Name:          name.String(),
+		Description:   courseDescription(),
+		Credit:        rand.Intn(3) + 1, // 1-3
+		Teacher:       teacher.Name,
+		Period:        period,
+		DayOfWeek:     dayOfWeek,
+		Keywords:      strings.Join(keywords, " "),
+		GradingPolicy: gradingPolicy(),
+	}
+}
+
+const (
+	letterGradingProb   = 0.2
+	passFailGradingProb = 0.1
+)
+
+// gradingPolicy は科目の成績評価の方針を生成する。nil の場合はデフォルトの方針になる
+// 合計点をそのままグレードポイントにする方式で重みを付けるとGPAの範囲が大きく変わるので、重みは評語の方式にのみ付ける
+func gradingPolicy() *model.GradingPolicy {
+	r := rand.Float64()
+	switch {
+	case r < letterGradingProb:
+		policy := model.NewDefaultGradingPolicy()
+		policy.Type = model.GradingLetter
+		for part := 1; part <= model.ClassCountPerCourse; part++ {
+			if rand.Intn(2) == 0 {
+				policy.ClassWeights[uint8(part)] = rand.Intn(3) + 2 // 2-4
+			}
+		}
+		return policy
+	case r < letterGradingProb+passFailGradingProb:
+		policy := model.NewDefaultGradingPolicy()
+		policy.Type = model.GradingPassFail
+		return policy
+	default:
+		return nil
 	}
 }
 
@@ -2,6 +2,8 @@ package model
 
 import (
 	"sync"
+
+	"github.com/isucon/isucon11-final/benchmarker/util"
 )
 
 type ClassParam struct {
@@ -14,6 +16,7 @@ type Class struct {
 	*ClassParam
 	ID                 string
 	isSubmissionClosed bool
+	isScoresPublished  bool
 	submissions        map[string]*Submission // map[学籍番号]*Submission
 	rmu                sync.RWMutex
 }
@@ -42,6 +45,21 @@ func (c *Class) CloseSubmission() {
 	c.isSubmissionClosed = true
 }
 
+func (c *Class) IsScoresPublished() bool {
+	c.rmu.RLock()
+	defer c.rmu.RUnlock()
+
+	return c.isScoresPublished
+}
+
+// PublishScores は採点結果を公開したことを記録する。公開した講義の点数のみが成績に反映される
+func (c *Class) PublishScores() {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	c.isScoresPublished = true
+}
+
 func (c *Class) AddSubmission(studentCode string, summary *Submission) {
 	c.rmu.Lock()
 	defer c.rmu.Unlock()
@@ -94,11 +112,25 @@ func (c *Class) IntoClassScore(userCode string) *ClassScore {
 		score = v.Score()
 	}
 
+	// 採点結果を公開していない講義の点数は統計値に含めない
+	scores := make([]int, 0, len(c.submissions))
+	if c.isScoresPublished {
+		for _, v := range c.submissions {
+			if v != nil && v.score != nil {
+				scores = append(scores, *v.score)
+			}
+		}
+	}
+
 	return &ClassScore{
 		ClassID:        c.ID,
 		Title:          c.Title,
 		Part:           c.Part,
 		Score:          score,
 		SubmitterCount: len(c.submissions),
+		ScoreQ1:        util.PercentileInt(scores, 25, 0),
+		ScoreMedian:    util.MedianInt(scores, 0),
+		ScoreQ3:        util.PercentileInt(scores, 75, 0),
+		ScoreHistogram: newHistogram(scores, 100),
 	}
 }
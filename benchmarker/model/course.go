@@ -33,6 +33,8 @@ type CourseParam struct {
 	Period      int
 	DayOfWeek   int
 	Keywords    string
+	// GradingPolicy は科目の成績評価の方針。nil の場合は方針を送信せず、webapp のデフォルトの方針になる
+	GradingPolicy *GradingPolicy
 }
 
 type Course struct {
@@ -45,6 +47,7 @@ type Course struct {
 	capacityCounter    *CapacityCounter
 	classes            []*Class
 	status             api.CourseStatus
+	gradingPolicy      *GradingPolicy
 
 	closer              chan struct{}
 	zeroReservationCond *sync.Cond
@@ -63,6 +66,10 @@ type SearchCourseParam struct {
 }
 
 func NewCourse(param *CourseParam, id string, teacher *Teacher, capacity int, capacityCounter *CapacityCounter) *Course {
+	gradingPolicy := param.GradingPolicy
+	if gradingPolicy == nil {
+		gradingPolicy = NewDefaultGradingPolicy()
+	}
 	c := &Course{
 		CourseParam:        param,
 		ID:                 id,
@@ -72,6 +79,7 @@ func NewCourse(param *CourseParam, id string, teacher *Teacher, capacity int, ca
 		capacityCounter:    capacityCounter,
 		classes:            make([]*Class, 0, ClassCountPerCourse),
 		status:             api.StatusRegistration,
+		gradingPolicy:      gradingPolicy,
 
 		closer: make(chan struct{}, 0),
 	}
@@ -107,6 +115,20 @@ func (c *Course) SetStatusToClosed() {
 	c.status = api.StatusClosed
 }
 
+func (c *Course) GradingPolicy() *GradingPolicy {
+	c.rmu.RLock()
+	defer c.rmu.RUnlock()
+
+	return c.gradingPolicy
+}
+
+func (c *Course) SetGradingPolicy(policy *GradingPolicy) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	c.gradingPolicy = policy
+}
+
 func (c *Course) Wait(ctx context.Context, cancel context.CancelFunc, addCourseFunc func()) <-chan struct{} {
 	go func() {
 		select {
@@ -309,14 +331,18 @@ func (c *Course) CalcCourseResultByStudentCode(code string) *CourseResult {
 	classScores := c.CollectClassScores(code)
 
 	return &CourseResult{
-		Name:             c.Name,
-		Code:             c.Code,
-		TotalScore:       totalScore,
-		TotalScoreTScore: totalTScore,
-		TotalScoreAvg:    totalAvg,
-		TotalScoreMax:    totalMax,
-		TotalScoreMin:    totalMin,
-		ClassScores:      classScores,
+		Name:                c.Name,
+		Code:                c.Code,
+		TotalScore:          totalScore,
+		TotalScoreTScore:    totalTScore,
+		TotalScoreAvg:       totalAvg,
+		TotalScoreMax:       totalMax,
+		TotalScoreMin:       totalMin,
+		TotalScoreQ1:        util.PercentileInt(totalScoresArr, 25, 0),
+		TotalScoreMedian:    util.MedianInt(totalScoresArr, 0),
+		TotalScoreQ3:        util.PercentileInt(totalScoresArr, 75, 0),
+		TotalScoreHistogram: newHistogram(totalScoresArr, c.maxScore()),
+		ClassScores:         classScores,
 	}
 }
 
@@ -328,13 +354,47 @@ func (c *Course) GetTotalScoreByStudentCode(code string) int {
 	for _, class := range c.classes {
 		submission := class.GetSubmissionByStudentCode(code)
 		if submission != nil && submission.score != nil {
-			score += *submission.score
+			score += *submission.score * c.gradingPolicy.Weight(class.Part)
 		}
 	}
 
 	return score
 }
 
+// GradePointsByStudentCode は成績評価の方針に従って学生のグレードポイント(1/100単位)を求める
+func (c *Course) GradePointsByStudentCode(code string) (gradePoints int, countsForGPA bool) {
+	totalScore := c.GetTotalScoreByStudentCode(code)
+
+	c.rmu.RLock()
+	defer c.rmu.RUnlock()
+
+	return c.gradingPolicy.GradePoints(totalScore, c.maxScore(), c.unweightedMaxScore())
+}
+
+// maxScore は合計点の満点を求める。webapp と同様に、点数を公開した講義のみを満点に含める
+// 呼び出し元で c.rmu のロックを取っておくこと
+func (c *Course) maxScore() int {
+	maxScore := 0
+	for _, class := range c.classes {
+		if class.IsScoresPublished() {
+			maxScore += 100 * c.gradingPolicy.Weight(class.Part)
+		}
+	}
+	return maxScore
+}
+
+// unweightedMaxScore はすべての講義の重みを1とした場合の満点を求める
+// 呼び出し元で c.rmu のロックを取っておくこと
+func (c *Course) unweightedMaxScore() int {
+	maxScore := 0
+	for _, class := range c.classes {
+		if class.IsScoresPublished() {
+			maxScore += 100
+		}
+	}
+	return maxScore
+}
+
 func (c *Course) calcTotalScores() map[string]int {
 	c.rmu.RLock()
 	defer c.rmu.RUnlock()
@@ -346,7 +406,7 @@ func (c *Course) calcTotalScores() map[string]int {
 	for _, class := range c.classes {
 		for userCode, submission := range class.Submissions() {
 			if submission != nil && submission.score != nil {
-				res[userCode] += *submission.score
+				res[userCode] += *submission.score * c.gradingPolicy.Weight(class.Part)
 			}
 		}
 	}
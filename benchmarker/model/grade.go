@@ -1,5 +1,13 @@
 package model
 
+import (
+	"math"
+	"sort"
+
+	"github.com/isucon/isucon11-final/benchmarker/api"
+	"github.com/isucon/isucon11-final/benchmarker/util"
+)
+
 // CourseResultのうち計算しなくていいやつ
 type SimpleCourseResult struct {
 	Name              string // course name
@@ -54,7 +62,12 @@ type CourseResult struct {
 	TotalScoreAvg    float64 // 平均値
 	TotalScoreMax    int     // 最大値
 	TotalScoreMin    int     // 最小値
-	ClassScores      []*ClassScore
+	// 四分位数と度数分布
+	TotalScoreQ1        float64
+	TotalScoreMedian    float64
+	TotalScoreQ3        float64
+	TotalScoreHistogram []HistogramBucket
+	ClassScores         []*ClassScore
 }
 
 type ClassScore struct {
@@ -65,4 +78,140 @@ type ClassScore struct {
 
 	Score          *int // 0 - 100点
 	SubmitterCount int
+	// 採点結果を公開した講義の採点済みの提出の四分位数と度数分布
+	ScoreQ1        float64
+	ScoreMedian    float64
+	ScoreQ3        float64
+	ScoreHistogram []HistogramBucket
+}
+
+// HistogramBucket は度数分布の区間 [Lower, Upper) と度数。最後の区間は Upper を含む
+type HistogramBucket struct {
+	Lower int
+	Upper int
+	Count int
+}
+
+// newHistogram は webapp と同様に、満点を histogramBucketCount 等分した区間で度数分布を求める
+const histogramBucketCount = 10
+
+func newHistogram(arr []int, maxScore int) []HistogramBucket {
+	width := (maxScore + histogramBucketCount - 1) / histogramBucketCount
+	if width == 0 {
+		width = 1
+	}
+	counts := util.HistogramInt(arr, width, maxScore)
+	buckets := make([]HistogramBucket, 0, len(counts))
+	for i, count := range counts {
+		buckets = append(buckets, HistogramBucket{
+			Lower: i * width,
+			Upper: (i + 1) * width,
+			Count: count,
+		})
+	}
+	return buckets
+}
+
+// GradingType は科目の成績評価の方式
+type GradingType string
+
+const (
+	// GradingScore は 合計点/100 をグレードポイントとする方式(webapp のデフォルト)
+	GradingScore GradingType = "score"
+	// GradingLetter は得点率に応じた評語のグレードポイントを用いる方式
+	GradingLetter GradingType = "letter"
+	// GradingPassFail は合否のみを評価する方式。GPAの計算には含めない
+	GradingPassFail GradingType = "pass_fail"
+)
+
+type LetterGradeThreshold struct {
+	Grade      string
+	MinScore   int     // この評語になる最低の得点率(0~100)
+	GradePoint float64 // 0~4
+}
+
+// GradingPolicy は webapp の成績評価の方針と同じ計算をする
+// 合計点は講義毎の点数に講義の重みを掛けたものの和で、得点率は合計点の満点(100*重みの和)に対する割合
+type GradingPolicy struct {
+	Type         GradingType
+	ClassWeights map[uint8]int // map[講義の回]重み。指定がない講義の重みは1
+	LetterGrades []LetterGradeThreshold
+	PassScore    int
+}
+
+func NewDefaultGradingPolicy() *GradingPolicy {
+	return &GradingPolicy{
+		Type:         GradingScore,
+		ClassWeights: map[uint8]int{},
+		LetterGrades: []LetterGradeThreshold{
+			{Grade: "S", MinScore: 90, GradePoint: 4},
+			{Grade: "A", MinScore: 80, GradePoint: 3},
+			{Grade: "B", MinScore: 70, GradePoint: 2},
+			{Grade: "C", MinScore: 60, GradePoint: 1},
+			{Grade: "F", MinScore: 0, GradePoint: 0},
+		},
+		PassScore: 60,
+	}
+}
+
+// IntoRequest は科目の追加時に送信する成績評価の方針に変換する
+func (p *GradingPolicy) IntoRequest() *api.GradingPolicy {
+	parts := make([]int, 0, len(p.ClassWeights))
+	for part := range p.ClassWeights {
+		parts = append(parts, int(part))
+	}
+	sort.Ints(parts)
+	classWeights := make([]api.ClassWeight, 0, len(parts))
+	for _, part := range parts {
+		classWeights = append(classWeights, api.ClassWeight{Part: uint8(part), Weight: p.ClassWeights[uint8(part)]})
+	}
+
+	letterGrades := make([]api.LetterGradeThreshold, 0, len(p.LetterGrades))
+	for _, g := range p.LetterGrades {
+		letterGrades = append(letterGrades, api.LetterGradeThreshold{Grade: g.Grade, MinScore: g.MinScore, GradePoint: g.GradePoint})
+	}
+
+	return &api.GradingPolicy{
+		Type:         string(p.Type),
+		ClassWeights: classWeights,
+		LetterGrades: letterGrades,
+		PassScore:    p.PassScore,
+	}
+}
+
+func (p *GradingPolicy) Weight(part uint8) int {
+	if w, ok := p.ClassWeights[part]; ok {
+		return w
+	}
+	return 1
+}
+
+// GradePoints は合計点と満点からグレードポイント(1/100単位)を求める
+// unweightedMaxScore はすべての講義の重みを1とした場合の満点で、点数による評価の合計点の換算に使う
+// countsForGPA が false の科目はGPAの計算に含めない
+func (p *GradingPolicy) GradePoints(totalScore, maxScore, unweightedMaxScore int) (gradePoints int, countsForGPA bool) {
+	switch p.Type {
+	case GradingLetter:
+		for _, g := range p.LetterGrades {
+			if reachesRate(totalScore, maxScore, g.MinScore) {
+				return int(math.Round(g.GradePoint * 100)), true
+			}
+		}
+		return 0, true
+	case GradingPassFail:
+		return 0, false
+	default:
+		// webapp と同様に、重みを付けた科目の合計点を重みを1とした場合の点数に換算する
+		if maxScore == 0 {
+			return 0, true
+		}
+		return int(math.Round(float64(totalScore) * float64(unweightedMaxScore) / float64(maxScore))), true
+	}
+}
+
+func reachesRate(totalScore, maxScore, rate int) bool {
+	if maxScore == 0 {
+		return rate == 0
+	}
+	return totalScore*100 >= rate*maxScore
 }
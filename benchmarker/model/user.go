@@ -335,15 +335,20 @@ func (s *Student) GPA() float64 {
 	s.rmu.RLock()
 	defer s.rmu.RUnlock()
 
+	// 合否評価の科目はGPAの計算に含めない
 	tmp := 0
+	credits := 0
 	for _, course := range s.registeredCourses {
 		if course.Status() == api.StatusClosed {
-			tmp += course.GetTotalScoreByStudentCode(s.Code) * course.Credit
+			gradePoints, countsForGPA := course.GradePointsByStudentCode(s.Code)
+			if countsForGPA {
+				tmp += gradePoints * course.Credit
+				credits += course.Credit
+			}
 		}
 	}
 
 	gpt := float64(tmp) / 100.0
-	credits := s.TotalCredit()
 
 	if credits == 0 {
 		return 0
@@ -365,6 +370,23 @@ func (s *Student) TotalCredit() int {
 	return res
 }
 
+// GPACredits はGPAの計算に含める(合否評価以外の)修了した科目の単位数の合計を返す
+func (s *Student) GPACredits() int {
+	s.rmu.RLock()
+	defer s.rmu.RUnlock()
+
+	res := 0
+	for _, course := range s.registeredCourses {
+		if course.Status() == api.StatusClosed {
+			if _, countsForGPA := course.GradePointsByStudentCode(s.Code); countsForGPA {
+				res += course.Credit
+			}
+		}
+	}
+
+	return res
+}
+
 type Teacher struct {
 	*UserAccount
 	Agent      *agent.Agent
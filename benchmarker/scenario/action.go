@@ -411,6 +411,9 @@ func AddCourseAction(ctx context.Context, agent *agent.Agent, param *model.Cours
 		DayOfWeek:   dayOfWeek,
 		Keywords:    param.Keywords,
 	}
+	if param.GradingPolicy != nil {
+		req.GradingPolicy = param.GradingPolicy.IntoRequest()
+	}
 	res := api.AddCourseResponse{}
 	hres, err := api.AddCourse(ctx, agent, req)
 	if err != nil {
@@ -490,6 +493,22 @@ func PostGradeAction(ctx context.Context, agent *agent.Agent, courseID, classID
 		return hres, err
 	}
 
+	// 採点結果は公開するまで学生の成績に反映されない
+	return publishScoresAction(ctx, agent, courseID, classID)
+}
+
+func publishScoresAction(ctx context.Context, agent *agent.Agent, courseID, classID string) (*http.Response, error) {
+	hres, err := api.PublishScores(ctx, agent, courseID, classID)
+	if err != nil {
+		return hres, fails.ErrorHTTP(err)
+	}
+	defer hres.Body.Close()
+
+	err = verifyStatusCode(hres, []int{http.StatusOK})
+	if err != nil {
+		return hres, err
+	}
+
 	return hres, nil
 }
 
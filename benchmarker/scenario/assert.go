@@ -178,6 +178,22 @@ func AssertEqualCourseResult(expected *model.CourseResult, actual *api.CourseRes
 		return errMismatch("成績取得の科目の total_score_t_score が期待する値と一致しません", expected.TotalScoreTScore, actual.TotalScoreTScore)
 	}
 
+	if !AssertWithinTolerance("grade courses total_score_q1", expected.TotalScoreQ1, actual.TotalScoreQ1, validateTotalScoreErrorTolerance) {
+		return errMismatch("成績取得の科目の total_score_q1 が期待する値と一致しません", expected.TotalScoreQ1, actual.TotalScoreQ1)
+	}
+
+	if !AssertWithinTolerance("grade courses total_score_median", expected.TotalScoreMedian, actual.TotalScoreMedian, validateTotalScoreErrorTolerance) {
+		return errMismatch("成績取得の科目の total_score_median が期待する値と一致しません", expected.TotalScoreMedian, actual.TotalScoreMedian)
+	}
+
+	if !AssertWithinTolerance("grade courses total_score_q3", expected.TotalScoreQ3, actual.TotalScoreQ3, validateTotalScoreErrorTolerance) {
+		return errMismatch("成績取得の科目の total_score_q3 が期待する値と一致しません", expected.TotalScoreQ3, actual.TotalScoreQ3)
+	}
+
+	if err := assertEqualHistogram("grade courses total_score_histogram", "成績取得の科目の total_score_histogram", expected.TotalScoreHistogram, actual.TotalScoreHistogram); err != nil {
+		return err
+	}
+
 	if !AssertEqual("grade courses class_scores length", len(expected.ClassScores), len(actual.ClassScores)) {
 		return errMismatch("成績取得の科目の class_scores の数が期待する値と一致しません", len(expected.ClassScores), len(actual.ClassScores))
 	}
@@ -221,6 +237,40 @@ func AssertEqualClassScore(expected *model.ClassScore, actual *api.ClassScore) e
 		return errMismatch("成績取得の講義の submitters が期待する値と一致しません", expected.SubmitterCount, actual.Submitters)
 	}
 
+	if !AssertWithinTolerance("grade courses class_scores score_q1", expected.ScoreQ1, actual.ScoreQ1, validateTotalScoreErrorTolerance) {
+		return errMismatch("成績取得の講義の score_q1 が期待する値と一致しません", expected.ScoreQ1, actual.ScoreQ1)
+	}
+
+	if !AssertWithinTolerance("grade courses class_scores score_median", expected.ScoreMedian, actual.ScoreMedian, validateTotalScoreErrorTolerance) {
+		return errMismatch("成績取得の講義の score_median が期待する値と一致しません", expected.ScoreMedian, actual.ScoreMedian)
+	}
+
+	if !AssertWithinTolerance("grade courses class_scores score_q3", expected.ScoreQ3, actual.ScoreQ3, validateTotalScoreErrorTolerance) {
+		return errMismatch("成績取得の講義の score_q3 が期待する値と一致しません", expected.ScoreQ3, actual.ScoreQ3)
+	}
+
+	if err := assertEqualHistogram("grade courses class_scores score_histogram", "成績取得の講義の score_histogram", expected.ScoreHistogram, actual.ScoreHistogram); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// assertEqualHistogram は度数分布の区間と度数を検証する。msg はログ用、field はエラーメッセージ用の項目名
+func assertEqualHistogram(msg string, field string, expected []model.HistogramBucket, actual []api.HistogramBucket) error {
+	if !AssertEqual(msg+" length", len(expected), len(actual)) {
+		return errMismatch(field+" の区間の数が期待する値と一致しません", len(expected), len(actual))
+	}
+	for i := range expected {
+		e := expected[i]
+		a := actual[i]
+		if !AssertEqual(msg+" range", [2]int{e.Lower, e.Upper}, [2]int{a.Lower, a.Upper}) {
+			return errMismatch(field+" の区間が期待する値と一致しません", fmt.Sprintf("[%d, %d)", e.Lower, e.Upper), fmt.Sprintf("[%d, %d)", a.Lower, a.Upper))
+		}
+		if !AssertEqual(msg+" count", e.Count, a.Count) {
+			return errMismatch(field+" の度数が期待する値と一致しません", e.Count, a.Count)
+		}
+	}
 	return nil
 }
 
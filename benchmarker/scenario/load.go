@@ -1128,6 +1128,7 @@ L:
 	}
 
 	// POST成功した採点結果をベンチ内に保存する
+	class.PublishScores()
 	for _, scoreData := range scores {
 		sub := class.GetSubmissionByStudentCode(scoreData.code)
 		if sub == nil {
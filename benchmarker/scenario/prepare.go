@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -28,6 +29,14 @@ const (
 	SearchCourseCountPerPage = 20
 	AnnouncementCountPerPage = 20
 	prepareCourseCapacity    = 50
+	// loginLockoutFailureCount はアカウントがロックされるまでの連続ログイン失敗回数
+	loginLockoutFailureCount = 5
+	// loginLockoutMaxRetryAfter は最初のロック時に許容する Retry-After の最大秒数
+	loginLockoutMaxRetryAfter = 5
+	// loginSharedIPStudentCount, loginSharedIPTypoCount は同じIPアドレスからログインを間違える学生の数と、学生毎の間違える回数
+	// 合計の失敗回数が以前のIPアドレス毎の上限(100回)を超えるようにしている
+	loginSharedIPStudentCount = 30
+	loginSharedIPTypoCount    = loginLockoutFailureCount - 1
 )
 
 func (s *Scenario) Prepare(ctx context.Context, step *isucandar.BenchmarkStep) error {
@@ -383,6 +392,7 @@ func (s *Scenario) prepareNormal(ctx context.Context, step *isucandar.BenchmarkS
 				step.AddError(err)
 				return
 			}
+			class.PublishScores()
 		}, worker.WithLoopCount(prepareCourseCount))
 		if err != nil {
 			AdminLogger.Println("info: cannot start worker: %w", err)
@@ -1427,6 +1437,38 @@ func (s *Scenario) prepareCheckAdminAuthorizationAbnormal(ctx context.Context) e
 
 		return nil
 	}
+	errCourseOwnership := func(hres *http.Response) error {
+		return fails.ErrorInvalidResponse(errors.New("担当していない教員による科目への操作が成功しました"), hres)
+	}
+	checkCourseOwnership := func(hres *http.Response, err error) error {
+		// リクエストが成功したらwebappの不具合
+		if err == nil {
+			return errCourseOwnership(hres)
+		}
+
+		// ステータスコードのチェック
+		if err := verifyStatusCode(hres, []int{http.StatusForbidden}); err != nil {
+			return err
+		}
+
+		return nil
+	}
+	errUnknownCourse := func(hres *http.Response) error {
+		return fails.ErrorInvalidResponse(errors.New("存在しない科目IDを指定した他の科目の講義への操作が成功しました"), hres)
+	}
+	checkUnknownCourse := func(hres *http.Response, err error) error {
+		// リクエストが成功したらwebappの不具合
+		if err == nil {
+			return errUnknownCourse(hres)
+		}
+
+		// ステータスコードのチェック
+		if err := verifyStatusCode(hres, []int{http.StatusNotFound}); err != nil {
+			return err
+		}
+
+		return nil
+	}
 
 	// ======== 検証用データの準備 ========
 
@@ -1517,6 +1559,56 @@ func (s *Scenario) prepareCheckAdminAuthorizationAbnormal(ctx context.Context) e
 		return err
 	}
 
+	// 他の教員の科目に対する操作
+	otherTeacher, err := s.getLoggedInOtherTeacher(ctx, teacher)
+	if err != nil {
+		return err
+	}
+
+	hres, err = SetCourseStatusClosedAction(ctx, otherTeacher.Agent, course.ID)
+	if err := checkCourseOwnership(hres, err); err != nil {
+		return err
+	}
+
+	classParam = generate.ClassParam(course, 3)
+	hres, _, err = AddClassAction(ctx, otherTeacher.Agent, course, classParam)
+	if err := checkCourseOwnership(hres, err); err != nil {
+		return err
+	}
+
+	hres, err = PostGradeAction(ctx, otherTeacher.Agent, course.ID, submissionClosedClass.ID, scores)
+	if err := checkCourseOwnership(hres, err); err != nil {
+		return err
+	}
+
+	hres, _, err = DownloadSubmissionsAction(ctx, otherTeacher.Agent, course.ID, submissionNotClosedClass.ID)
+	if err := checkCourseOwnership(hres, err); err != nil {
+		return err
+	}
+
+	announcement = generate.Announcement(course, submissionNotClosedClass)
+	hres, err = SendAnnouncementAction(ctx, otherTeacher.Agent, announcement)
+	if err := checkCourseOwnership(hres, err); err != nil {
+		return err
+	}
+
+	// 存在しない科目IDと他の教員の講義IDを組み合わせた操作
+	unknownCourseID := generate.GenULID()
+	hres, err = PostGradeAction(ctx, otherTeacher.Agent, unknownCourseID, submissionClosedClass.ID, scores)
+	if err := checkUnknownCourse(hres, err); err != nil {
+		return err
+	}
+
+	hres, err = publishScoresAction(ctx, otherTeacher.Agent, unknownCourseID, submissionClosedClass.ID)
+	if err := checkUnknownCourse(hres, err); err != nil {
+		return err
+	}
+
+	hres, _, err = DownloadSubmissionsAction(ctx, otherTeacher.Agent, unknownCourseID, submissionNotClosedClass.ID)
+	if err := checkUnknownCourse(hres, err); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -1579,9 +1671,151 @@ func (s *Scenario) prepareCheckLoginAbnormal(ctx context.Context) error {
 		return err
 	}
 
+	// ロックアウトの検証
+	if err := s.prepareCheckLoginLockout(ctx); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Scenario) prepareCheckLoginLockout(ctx context.Context) error {
+	errNotLocked := func(hres *http.Response) error {
+		return fails.ErrorInvalidResponse(errors.New("連続でログインに失敗したアカウントがロックされていません"), hres)
+	}
+	errInvalidRetryAfter := func(hres *http.Response) error {
+		return fails.ErrorInvalidResponse(errors.New("ロックされたアカウントへのログインの Retry-After が不正です"), hres)
+	}
+
+	// ======== 検証用データの準備 ========
+
+	// 検証で使用する学生ユーザ（未ログイン状態）
+	student, err := s.userPool.newStudent()
+	if err != nil {
+		panic("unreachable! studentPool is empty")
+	}
+
+	// 同じIPアドレスからログインする学生ユーザ（未ログイン状態）
+	sharedIPStudents := make([]*model.Student, 0, loginSharedIPStudentCount)
+	for i := 0; i < loginSharedIPStudentCount; i++ {
+		sharedIPStudent, err := s.userPool.newStudent()
+		if err != nil {
+			panic("unreachable! studentPool is empty")
+		}
+		sharedIPStudents = append(sharedIPStudents, sharedIPStudent)
+	}
+
+	// ======== 検証 ========
+
+	// ベンチマーカーの学生は全員同じIPアドレスからログインするので、
+	// 多くの学生がパスワードを打ち間違えてもログインに成功していればIPアドレスはロックされない
+	if err := prepareCheckLoginSharedIP(ctx, sharedIPStudents); err != nil {
+		return err
+	}
+
+	// 上限回数まで間違ったパスワードでログインする
+	for i := 0; i < loginLockoutFailureCount; i++ {
+		hres, err := LoginAction(ctx, student.Agent, &model.UserAccount{
+			Code:        student.Code,
+			RawPassword: student.RawPassword + "abc",
+			IsAdmin:     false,
+		})
+		if err == nil {
+			return fails.ErrorInvalidResponse(errors.New("間違った認証情報でのログインが成功しました"), hres)
+		}
+		if err := verifyStatusCode(hres, []int{http.StatusUnauthorized}); err != nil {
+			return err
+		}
+	}
+
+	// ロック中は正しいパスワードでもログインできない
+	hres, err := LoginAction(ctx, student.Agent, student.UserAccount)
+	if err == nil {
+		return errNotLocked(hres)
+	}
+	if err := verifyStatusCode(hres, []int{http.StatusTooManyRequests}); err != nil {
+		return err
+	}
+	retryAfter, err := strconv.Atoi(hres.Header.Get("Retry-After"))
+	if err != nil || retryAfter <= 0 || retryAfter > loginLockoutMaxRetryAfter {
+		return errInvalidRetryAfter(hres)
+	}
+
+	// Retry-After だけ待てばロックが解除される
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(retryAfter) * time.Second):
+	}
+	_, err = LoginAction(ctx, student.Agent, student.UserAccount)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// prepareCheckLoginSharedIP は学生毎にアカウントがロックされない回数だけパスワードを間違えた後にログインできることを検証する
+func prepareCheckLoginSharedIP(ctx context.Context, students []*model.Student) error {
+	errLocked := func(hres *http.Response) error {
+		return fails.ErrorInvalidResponse(errors.New("同じIPアドレスから複数の学生がログインに失敗した後、正しい認証情報でログインできません"), hres)
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+	)
+	setErr := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	p := parallel.NewParallel(ctx, int32(len(students)))
+	for _, student := range students {
+		student := student
+		err := p.Do(func(ctx context.Context) {
+			for i := 0; i < loginSharedIPTypoCount; i++ {
+				hres, err := LoginAction(ctx, student.Agent, &model.UserAccount{
+					Code:        student.Code,
+					RawPassword: student.RawPassword + "abc",
+					IsAdmin:     false,
+				})
+				if err == nil {
+					setErr(fails.ErrorInvalidResponse(errors.New("間違った認証情報でのログインが成功しました"), hres))
+					return
+				}
+				if hres != nil && hres.StatusCode == http.StatusTooManyRequests {
+					setErr(errLocked(hres))
+					return
+				}
+				if err := verifyStatusCode(hres, []int{http.StatusUnauthorized}); err != nil {
+					setErr(err)
+					return
+				}
+			}
+
+			hres, err := LoginAction(ctx, student.Agent, student.UserAccount)
+			if err != nil {
+				if hres != nil && hres.StatusCode == http.StatusTooManyRequests {
+					setErr(errLocked(hres))
+					return
+				}
+				setErr(err)
+				return
+			}
+		})
+		if err != nil {
+			AdminLogger.Println("info: cannot start parallel: %w", err)
+		}
+	}
+	p.Wait()
+
+	return firstErr
+}
+
 func (s *Scenario) prepareCheckRegisterCoursesAbnormal(ctx context.Context) error {
 	errInvalidRegistration := func(hres *http.Response) error {
 		return fails.ErrorInvalidResponse(errors.New("履修登録できないはずの科目の履修が成功しました"), hres)
@@ -2384,3 +2618,19 @@ func (s *Scenario) getLoggedInTeacher(ctx context.Context) (*model.Teacher, erro
 
 	return teacher, nil
 }
+
+// getLoggedInOtherTeacher は teacher とは別の教員を返す
+// 教員が1人しかいない場合は権限の検証ができないのでエラーにする
+func (s *Scenario) getLoggedInOtherTeacher(ctx context.Context, teacher *model.Teacher) (*model.Teacher, error) {
+	const maxTrial = 10
+	for i := 0; i < maxTrial; i++ {
+		other, err := s.getLoggedInTeacher(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if other.Code != teacher.Code {
+			return other, nil
+		}
+	}
+	return nil, fmt.Errorf("%s 以外の教員が見つかりませんでした", teacher.Code)
+}
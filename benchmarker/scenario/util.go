@@ -37,6 +37,16 @@ func parseLinkHeader(hres *http.Response) (prev string, next string, err error)
 			if u.Scheme != "" || u.Host != "" {
 				return "", "", failure.NewError(fails.ErrApplication, fmt.Errorf("link header に scheme, host, もしくは port は設定できません"))
 			}
+			// cursor が設定されている場合は cursor を辿り、非推奨の page は使わない
+			if q := u.Query(); q.Has("cursor") {
+				if q.Get("cursor") == "" {
+					return "", "", failure.NewError(fails.ErrApplication, fmt.Errorf("link header の cursor が空です"))
+				}
+				if q.Has("page") {
+					q.Del("page")
+					u.RawQuery = q.Encode()
+				}
+			}
 			var s string
 			if u.RawQuery != "" {
 				s = u.Path + "?" + u.RawQuery
@@ -429,13 +429,16 @@ func calculateSummary(students map[string]*model.Student, userCode string) model
 		panic("unreachable! userCode: " + userCode)
 	}
 
+	// GPAの統計値の対象は、GPAの計算に含める科目を一つでも修了した学生
+	// 合否評価の科目しか修了していない学生はGPAが0になるが、統計値には含めない
 	gpas := make([]float64, 0, n)
 	for _, student := range students {
-		if student.HasFinishedCourse() {
+		if student.GPACredits() > 0 {
 			gpas = append(gpas, student.GPA())
 		}
 	}
 
+	// 取得単位数には合否評価の科目も含める
 	targetUserGpa := students[userCode].GPA()
 	credits := students[userCode].TotalCredit()
 
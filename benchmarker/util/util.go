@@ -1,6 +1,9 @@
 package util
 
-import "math"
+import (
+	"math"
+	"sort"
+)
 
 func AverageInt(arr []int, or float64) float64 {
 	if len(arr) == 0 {
@@ -60,6 +63,52 @@ func TScoreInt(v int, arr []int) float64 {
 	}
 }
 
+// PercentileInt は p パーセンタイル(0~100)を線形補間で求める (Excel の PERCENTILE.INC と同じ)
+func PercentileInt(arr []int, p float64, or float64) float64 {
+	if len(arr) == 0 {
+		return or
+	}
+	sorted := make([]int, len(arr))
+	copy(sorted, arr)
+	sort.Ints(sorted)
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return float64(sorted[lower]) + (rank-float64(lower))*float64(sorted[upper]-sorted[lower])
+}
+
+func MedianInt(arr []int, or float64) float64 {
+	return PercentileInt(arr, 50, or)
+}
+
+// HistogramInt は [0, upper] を幅 width の区間に分けて、区間毎の値の数を返す
+// i 番目の区間は [i*width, (i+1)*width) で、upper は最後の区間に含める。範囲外の値は端の区間に数える
+func HistogramInt(arr []int, width int, upper int) []int {
+	if width <= 0 {
+		width = 1
+	}
+	if upper < 0 {
+		upper = 0
+	}
+	buckets := upper/width + 1
+	if upper > 0 && upper%width == 0 {
+		buckets--
+	}
+	counts := make([]int, buckets)
+	for _, v := range arr {
+		i := v / width
+		if v < 0 {
+			i = 0
+		}
+		if i >= buckets {
+			i = buckets - 1
+		}
+		counts[i]++
+	}
+	return counts
+}
+
 // ----- float64 -----
 
 var epsilon = math.Nextafter(1, 2) - 1
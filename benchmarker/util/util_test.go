@@ -0,0 +1,75 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+// webapp/go/util_test.go と同じ入力で webapp の実装と結果が一致することを確認する
+var percentileTests = []struct {
+	name string
+	arr  []int
+	p    float64
+	want float64
+}{
+	{name: "empty returns default", arr: []int{}, p: 50, want: -1},
+	{name: "single value", arr: []int{42}, p: 25, want: 42},
+	{name: "q1 interpolated", arr: []int{1, 2, 3, 4}, p: 25, want: 1.75},
+	{name: "median of even length", arr: []int{1, 2, 3, 4}, p: 50, want: 2.5},
+	{name: "q3 interpolated", arr: []int{1, 2, 3, 4}, p: 75, want: 3.25},
+	{name: "unsorted q1", arr: []int{40, 15, 50, 20, 35}, p: 25, want: 20},
+	{name: "unsorted median", arr: []int{40, 15, 50, 20, 35}, p: 50, want: 35},
+	{name: "unsorted q3", arr: []int{40, 15, 50, 20, 35}, p: 75, want: 40},
+	{name: "two values", arr: []int{0, 100}, p: 25, want: 25},
+	{name: "same values", arr: []int{7, 7, 7}, p: 75, want: 7},
+	{name: "minimum", arr: []int{3, 1, 2}, p: 0, want: 1},
+	{name: "maximum", arr: []int{3, 1, 2}, p: 100, want: 3},
+}
+
+func TestPercentileInt(t *testing.T) {
+	for _, tt := range percentileTests {
+		t.Run(tt.name, func(t *testing.T) {
+			arr := make([]int, len(tt.arr))
+			copy(arr, tt.arr)
+			if got := PercentileInt(arr, tt.p, -1); got != tt.want {
+				t.Errorf("PercentileInt(%v, %v) = %v, want %v", tt.arr, tt.p, got, tt.want)
+			}
+			if !reflect.DeepEqual(arr, tt.arr) {
+				t.Errorf("PercentileInt modified the input: %v", arr)
+			}
+		})
+	}
+}
+
+func TestMedianInt(t *testing.T) {
+	if got := MedianInt([]int{5, 1, 4, 2, 3}, 0); got != 3 {
+		t.Errorf("MedianInt = %v, want 3", got)
+	}
+	if got := MedianInt(nil, -1); got != -1 {
+		t.Errorf("MedianInt(nil) = %v, want -1", got)
+	}
+}
+
+var histogramTests = []struct {
+	name  string
+	arr   []int
+	width int
+	upper int
+	want  []int
+}{
+	{name: "upper is in the last bucket", arr: []int{0, 5, 10, 99, 100}, width: 10, upper: 100, want: []int{2, 1, 0, 0, 0, 0, 0, 0, 0, 2}},
+	{name: "out of range values", arr: []int{-1, 150}, width: 10, upper: 100, want: []int{1, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+	{name: "upper not divisible by width", arr: []int{9, 10, 25}, width: 10, upper: 25, want: []int{1, 1, 1}},
+	{name: "no values", arr: nil, width: 50, upper: 100, want: []int{0, 0}},
+	{name: "invalid width", arr: []int{0, 0}, width: 0, upper: 0, want: []int{2}},
+}
+
+func TestHistogramInt(t *testing.T) {
+	for _, tt := range histogramTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HistogramInt(tt.arr, tt.width, tt.upper); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("HistogramInt(%v, %d, %d) = %v, want %v", tt.arr, tt.width, tt.upper, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type UserResponse struct {
+	ID          string   `json:"id"`
+	Code        string   `json:"code"`
+	Name        string   `json:"name"`
+	Type        UserType `json:"type"`
+	Deactivated bool     `json:"deactivated"`
+	UserProfile
+}
+
+func newUserResponse(user User) UserResponse {
+	return UserResponse{
+		ID:          user.ID,
+		Code:        user.Code,
+		Name:        user.Name,
+		Type:        user.Type,
+		Deactivated: user.Deactivated,
+		UserProfile: newUserProfile(user),
+	}
+}
+
+func isValidUserType(userType UserType) bool {
+	switch userType {
+	case Student, Teacher, TeachingAssistant, Registrar:
+		return true
+	}
+	return false
+}
+
+type AddUserRequest struct {
+	Code     string   `json:"code"`
+	Name     string   `json:"name"`
+	Password string   `json:"password"`
+	Type     UserType `json:"type"`
+}
+
+// newUser はリクエストを検証し、パスワードをハッシュ化したユーザを作る
+func newUser(req AddUserRequest) (User, error) {
+	if len(req.Code) != 6 {
+		return User{}, errors.New("code must be 6 characters")
+	}
+	if req.Name == "" || len(req.Name) > 255 {
+		return User{}, errors.New("invalid name")
+	}
+	if !isValidUserType(req.Type) {
+		return User{}, errors.New("invalid type")
+	}
+	if err := validatePasswordStrength(req.Password, req.Code); err != nil {
+		return User{}, err
+	}
+	hashedPassword, err := hashPassword(req.Password)
+	if err != nil {
+		return User{}, err
+	}
+	return User{
+		ID:             newULID(),
+		Code:           req.Code,
+		Name:           req.Name,
+		HashedPassword: hashedPassword,
+		Type:           req.Type,
+	}, nil
+}
+
+func insertUser(db sqlx.Execer, user User) error {
+	_, err := db.Exec("INSERT INTO `users` (`id`, `code`, `name`, `hashed_password`, `type`) VALUES (?, ?, ?, ?, ?)",
+		user.ID, user.Code, user.Name, user.HashedPassword, user.Type)
+	return err
+}
+
+// AddUser POST /api/admin/users ユーザ追加
+func (h *handlers) AddUser(c echo.Context) error {
+	var req AddUserRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+
+	user, err := newUser(req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if err := insertUser(h.DB, user); err != nil {
+		if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
+			return c.String(http.StatusConflict, "A user with the same code already exists.")
+		}
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, newUserResponse(user))
+}
+
+type ImportUsersResponse struct {
+	Imported int `json:"imported"`
+}
+
+// ImportUsers POST /api/admin/users/import CSVファイルからユーザを一括追加
+// 1行目は code,name,password,type を含むヘッダ行とし、1行でも不正な行があれば1件も追加しない
+func (h *handlers) ImportUsers(c echo.Context) error {
+	file, _, err := c.Request().FormFile("file")
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid file.")
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	header, err := r.Read()
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid CSV header.")
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"code", "name", "password", "type"} {
+		if _, ok := columns[name]; !ok {
+			return c.String(http.StatusBadRequest, "Missing column in CSV header: "+name)
+		}
+	}
+
+	var users []User
+	var lineErrors []string
+	codes := make(map[string]int)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := r.FieldPos(0)
+		if err != nil {
+			lineErrors = append(lineErrors, fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+		req := AddUserRequest{
+			Code:     record[columns["code"]],
+			Name:     record[columns["name"]],
+			Password: record[columns["password"]],
+			Type:     UserType(record[columns["type"]]),
+		}
+		if prev, ok := codes[req.Code]; ok {
+			lineErrors = append(lineErrors, fmt.Sprintf("line %d: code %s is duplicated with line %d", line, req.Code, prev))
+			continue
+		}
+		codes[req.Code] = line
+		user, err := newUser(req)
+		if err != nil {
+			lineErrors = append(lineErrors, fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+		users = append(users, user)
+	}
+	if len(lineErrors) > 0 {
+		return c.String(http.StatusBadRequest, strings.Join(lineErrors, "\n"))
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	for _, user := range users {
+		if err := insertUser(tx, user); err != nil {
+			if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
+				return c.String(http.StatusConflict, fmt.Sprintf("line %d: a user with code %s already exists", codes[user.Code], user.Code))
+			}
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, ImportUsersResponse{Imported: len(users)})
+}
+
+type UpdateUserRequest struct {
+	Name           *string   `json:"name"`
+	Type           *UserType `json:"type"`
+	Password       *string   `json:"password"`
+	Deactivated    *bool     `json:"deactivated"`
+	Department     *string   `json:"department"`
+	EnrollmentYear *int      `json:"enrollment_year"`
+}
+
+// UpdateUser PUT /api/admin/users/:userCode ユーザ情報の更新
+// 指定されたフィールドのみ更新する
+func (h *handlers) UpdateUser(c echo.Context) error {
+	userCode := c.Param("userCode")
+
+	var req UpdateUserRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var user User
+	if err := tx.Get(&user, "SELECT * FROM `users` WHERE `code` = ? FOR UPDATE", userCode); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such user.")
+	}
+
+	// パスワードの変更や無効化の際は、既存のセッションとAPIトークンを失効させる
+	revokeCredentials := false
+	if req.Name != nil {
+		if *req.Name == "" || len(*req.Name) > 255 {
+			return c.String(http.StatusBadRequest, "invalid name")
+		}
+		user.Name = *req.Name
+	}
+	if req.Type != nil {
+		if !isValidUserType(*req.Type) {
+			return c.String(http.StatusBadRequest, "invalid type")
+		}
+		user.Type = *req.Type
+	}
+	if req.Password != nil {
+		if err := validatePasswordStrength(*req.Password, user.Code); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		hashedPassword, err := hashPassword(*req.Password)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		user.HashedPassword = hashedPassword
+		revokeCredentials = true
+	}
+	if req.Department != nil {
+		if len(*req.Department) > 255 {
+			return c.String(http.StatusBadRequest, "invalid department")
+		}
+		user.Department = *req.Department
+	}
+	if req.EnrollmentYear != nil {
+		if *req.EnrollmentYear < 1900 || *req.EnrollmentYear > 9999 {
+			return c.String(http.StatusBadRequest, "invalid enrollment_year")
+		}
+		user.EnrollmentYear = sql.NullInt32{Int32: int32(*req.EnrollmentYear), Valid: true}
+	}
+	if req.Deactivated != nil {
+		if *req.Deactivated && !user.Deactivated {
+			revokeCredentials = true
+		}
+		user.Deactivated = *req.Deactivated
+	}
+
+	if _, err := tx.Exec("UPDATE `users` SET `name` = ?, `type` = ?, `hashed_password` = ?, `deactivated` = ?, `department` = ?, `enrollment_year` = ? WHERE `id` = ?",
+		user.Name, user.Type, user.HashedPassword, user.Deactivated, user.Department, user.EnrollmentYear, user.ID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if revokeCredentials {
+		if _, err := tx.Exec("DELETE FROM `api_tokens` WHERE `user_id` = ?", user.ID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if req.Name != nil {
+		h.CourseIndex.SetTeacherName(user.ID, user.Name)
+	}
+	if revokeCredentials {
+		if err := h.SessionStore.Backend.DeleteByUser(user.ID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	return c.JSON(http.StatusOK, newUserResponse(user))
+}
+
+// DeactivateUser DELETE /api/admin/users/:userCode ユーザの無効化
+// 履修や成績の履歴を残すためユーザは削除せず、ログインできない状態にする
+func (h *handlers) DeactivateUser(c echo.Context) error {
+	userCode := c.Param("userCode")
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var userID string
+	if err := tx.Get(&userID, "SELECT `id` FROM `users` WHERE `code` = ? FOR UPDATE", userCode); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such user.")
+	}
+
+	if _, err := tx.Exec("UPDATE `users` SET `deactivated` = true WHERE `id` = ?", userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if _, err := tx.Exec("DELETE FROM `api_tokens` WHERE `user_id` = ?", userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := h.SessionStore.Backend.DeleteByUser(userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type AnnouncementAttachment struct {
+	ID             string `db:"id"`
+	AnnouncementID string `db:"announcement_id"`
+	FileName       string `db:"file_name"`
+}
+
+func announcementAttachmentPath(announcementID, attachmentID string) string {
+	return AssignmentsDirectory + announcementID + "-" + attachmentID
+}
+
+type AnnouncementAttachmentResponse struct {
+	ID       string `json:"id"`
+	FileName string `json:"file_name"`
+	URL      string `json:"url"`
+}
+
+// DownloadAnnouncementAttachment GET /api/announcements/:announcementID/attachments/:attachmentID お知らせの添付ファイルのダウンロード
+func (h *handlers) DownloadAnnouncementAttachment(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	announcementID := c.Param("announcementID")
+	attachmentID := c.Param("attachmentID")
+
+	var attachment AnnouncementAttachment
+	if err := h.DB.Get(&attachment, "SELECT * FROM `announcement_attachments` WHERE `id` = ? AND `announcement_id` = ?", attachmentID, announcementID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such attachment.")
+	}
+
+	// お知らせ詳細と同様に、科目を履修している学生のみ取得できる
+	var registrationCount int
+	query := "SELECT COUNT(*)" +
+		" FROM `registrations`" +
+		" JOIN `announcements` ON `announcements`.`course_id` = `registrations`.`course_id`" +
+		" WHERE `announcements`.`id` = ? AND `registrations`.`user_id` = ?"
+	if err := h.DB.Get(&registrationCount, query, announcementID, userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if registrationCount == 0 {
+		return c.String(http.StatusNotFound, "No such attachment.")
+	}
+
+	return c.Attachment(announcementAttachmentPath(announcementID, attachment.ID), attachment.FileName)
+}
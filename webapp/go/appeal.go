@@ -0,0 +1,384 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// AppealStatus は成績の再評価の申請の状態
+type AppealStatus string
+
+const (
+	AppealPending  AppealStatus = "pending"
+	AppealAccepted AppealStatus = "accepted"
+	AppealRejected AppealStatus = "rejected"
+)
+
+// AppealAction は申請の履歴に記録する操作
+type AppealAction string
+
+const (
+	AppealActionSubmit AppealAction = "submit"
+	AppealActionAccept AppealAction = "accept"
+	AppealActionReject AppealAction = "reject"
+)
+
+type Appeal struct {
+	ID        string       `db:"id"`
+	CourseID  string       `db:"course_id"`
+	ClassID   string       `db:"class_id"`
+	UserID    string       `db:"user_id"`
+	Reason    string       `db:"reason"`
+	Status    AppealStatus `db:"status"`
+	CreatedAt time.Time    `db:"created_at"`
+}
+
+// AppealEvent は申請の履歴の1件。点数は操作の前後の点数で、申請時は new_score が null になる
+type AppealEvent struct {
+	AppealID  string       `json:"-" db:"appeal_id"`
+	Action    AppealAction `json:"action" db:"action"`
+	ActorCode string       `json:"actor_code" db:"actor_code"`
+	OldScore  *int         `json:"old_score" db:"old_score"`
+	NewScore  *int         `json:"new_score" db:"new_score"`
+	Comment   string       `json:"comment" db:"comment"`
+	CreatedAt time.Time    `json:"created_at" db:"created_at"`
+}
+
+// addAppealEvent は申請の履歴を追加する
+func addAppealEvent(tx sqlx.Execer, appealID string, actorID string, action AppealAction, oldScore *int, newScore *int, comment string) error {
+	_, err := tx.Exec("INSERT INTO `appeal_events` (`id`, `appeal_id`, `actor_id`, `action`, `old_score`, `new_score`, `comment`, `created_at`) VALUES (?, ?, ?, ?, ?, ?, ?, NOW(6))",
+		newULID(), appealID, actorID, action, oldScore, newScore, comment)
+	return err
+}
+
+// loadAppealEvents は申請毎の履歴を古い順に取得する
+func loadAppealEvents(q sqlx.Queryer, appealIDs []string) (map[string][]AppealEvent, error) {
+	events := make(map[string][]AppealEvent, len(appealIDs))
+	if len(appealIDs) == 0 {
+		return events, nil
+	}
+	args := make([]interface{}, 0, len(appealIDs))
+	for _, id := range appealIDs {
+		args = append(args, id)
+	}
+
+	var rows []AppealEvent
+	query := "SELECT `appeal_events`.`appeal_id`, `appeal_events`.`action`, `users`.`code` AS `actor_code`," +
+		" `appeal_events`.`old_score`, `appeal_events`.`new_score`, `appeal_events`.`comment`, `appeal_events`.`created_at`" +
+		" FROM `appeal_events`" +
+		" JOIN `users` ON `users`.`id` = `appeal_events`.`actor_id`" +
+		" WHERE `appeal_events`.`appeal_id` IN (" + placeholders(len(args)) + ")" +
+		" ORDER BY `appeal_events`.`id`"
+	if err := sqlx.Select(q, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		events[row.AppealID] = append(events[row.AppealID], row)
+	}
+	return events, nil
+}
+
+// notifyAppealResult は申請の結果を、申請した学生だけが受け取るお知らせとして送る
+func notifyAppealResult(tx sqlx.Execer, appeal *Appeal, class *Class, oldScore int, newScore int, comment string) error {
+	title := fmt.Sprintf("成績の再評価の結果: %s", class.Title)
+	var message string
+	if appeal.Status == AppealAccepted {
+		message = fmt.Sprintf("第%d回「%s」の成績の再評価の申請は受理されました。\n点数: %d点 → %d点", class.Part, class.Title, oldScore, newScore)
+	} else {
+		message = fmt.Sprintf("第%d回「%s」の成績の再評価の申請は却下されました。\n点数: %d点 (変更なし)", class.Part, class.Title, oldScore)
+	}
+	if comment != "" {
+		message += "\n\n担当教員からのコメント:\n" + comment
+	}
+
+	announcementID := newULID()
+	if _, err := tx.Exec("INSERT INTO `announcements` (`id`, `course_id`, `title`, `message`) VALUES (?, ?, ?, ?)",
+		announcementID, appeal.CourseID, title, message); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO `unread_announcements` (`announcement_id`, `user_id`) VALUES (?, ?)", announcementID, appeal.UserID)
+	return err
+}
+
+type SubmitAppealRequest struct {
+	Reason string `json:"reason"`
+}
+
+type SubmitAppealResponse struct {
+	ID string `json:"id"`
+}
+
+// SubmitAppeal POST /api/courses/:courseID/classes/:classID/appeals 成績の再評価の申請
+func (h *handlers) SubmitAppeal(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+
+	var req SubmitAppealRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		return c.String(http.StatusBadRequest, "Reason is required.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var class Class
+	if err := tx.Get(&class, "SELECT * FROM `classes` WHERE `id` = ? AND `course_id` = ? FOR SHARE", classID, courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such class.")
+	}
+	if !class.ScoresPublished {
+		return c.String(http.StatusBadRequest, "Scores of this class are not published yet.")
+	}
+
+	// 同じ課題への申請が同時に行われないように、提出をロックしてから申請中のものがないか確認する
+	var score sql.NullInt64
+	if err := tx.Get(&score, "SELECT `score` FROM `submissions` WHERE `user_id` = ? AND `class_id` = ? FOR UPDATE", userID, classID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusBadRequest, "You have not submitted this assignment.")
+	}
+	if !score.Valid {
+		return c.String(http.StatusBadRequest, "This assignment is not scored yet.")
+	}
+
+	var pendingCount int
+	if err := tx.Get(&pendingCount, "SELECT COUNT(*) FROM `appeals` WHERE `class_id` = ? AND `user_id` = ? AND `status` = ?", classID, userID, AppealPending); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if pendingCount > 0 {
+		return c.String(http.StatusConflict, "An appeal for this assignment is already pending.")
+	}
+
+	appealID := newULID()
+	if _, err := tx.Exec("INSERT INTO `appeals` (`id`, `course_id`, `class_id`, `user_id`, `reason`, `status`, `created_at`) VALUES (?, ?, ?, ?, ?, ?, NOW(6))",
+		appealID, courseID, classID, userID, req.Reason, AppealPending); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	currentScore := int(score.Int64)
+	if err := addAppealEvent(tx, appealID, userID, AppealActionSubmit, &currentScore, nil, req.Reason); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, SubmitAppealResponse{ID: appealID})
+}
+
+type AppealResponse struct {
+	ID         string        `json:"id" db:"id"`
+	ClassID    string        `json:"class_id" db:"class_id"`
+	Part       uint8         `json:"part" db:"part"`
+	ClassTitle string        `json:"class_title" db:"class_title"`
+	UserCode   string        `json:"user_code" db:"user_code"`
+	UserName   string        `json:"user_name" db:"user_name"`
+	Reason     string        `json:"reason" db:"reason"`
+	Status     AppealStatus  `json:"status" db:"status"`
+	Score      *int          `json:"score" db:"score"` // 現在の点数
+	CreatedAt  time.Time     `json:"created_at" db:"created_at"`
+	History    []AppealEvent `json:"history" db:"-"`
+}
+
+// GetAppeals GET /api/courses/:courseID/appeals 成績の再評価の申請一覧の取得
+// status を指定しない場合は未処理の申請のみを古い順に返す。status=all で処理済みのものも含める
+func (h *handlers) GetAppeals(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	status := AppealStatus(c.QueryParam("status"))
+	switch status {
+	case "":
+		status = AppealPending
+	case "all", AppealPending, AppealAccepted, AppealRejected:
+	default:
+		return c.String(http.StatusBadRequest, "Invalid status.")
+	}
+
+	var count int
+	if err := h.DB.Get(&count, "SELECT COUNT(*) FROM `courses` WHERE `id` = ?", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+
+	appeals := make([]AppealResponse, 0)
+	args := []interface{}{courseID}
+	query := "SELECT `appeals`.`id`, `appeals`.`class_id`, `classes`.`part`, `classes`.`title` AS `class_title`," +
+		" `users`.`code` AS `user_code`, `users`.`name` AS `user_name`, `appeals`.`reason`, `appeals`.`status`," +
+		" `submissions`.`score`, `appeals`.`created_at`" +
+		" FROM `appeals`" +
+		" JOIN `classes` ON `classes`.`id` = `appeals`.`class_id`" +
+		" JOIN `users` ON `users`.`id` = `appeals`.`user_id`" +
+		" LEFT JOIN `submissions` ON `submissions`.`class_id` = `appeals`.`class_id` AND `submissions`.`user_id` = `appeals`.`user_id`" +
+		" WHERE `appeals`.`course_id` = ?"
+	if status != "all" {
+		query += " AND `appeals`.`status` = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY `appeals`.`id`"
+	if err := h.DB.Select(&appeals, query, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	appealIDs := make([]string, 0, len(appeals))
+	for _, appeal := range appeals {
+		appealIDs = append(appealIDs, appeal.ID)
+	}
+	events, err := loadAppealEvents(h.DB, appealIDs)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for i := range appeals {
+		appeals[i].History = events[appeals[i].ID]
+	}
+
+	return c.JSON(http.StatusOK, appeals)
+}
+
+type ResolveAppealRequest struct {
+	Action AppealAction `json:"action"` // accept または reject
+	// Score は受理する場合の新しい点数
+	Score   *int   `json:"score"`
+	Comment string `json:"comment"`
+}
+
+// ResolveAppeal PUT /api/courses/:courseID/appeals/:appealID 成績の再評価の申請の受理・却下
+func (h *handlers) ResolveAppeal(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	courseID := c.Param("courseID")
+	appealID := c.Param("appealID")
+
+	var req ResolveAppealRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	switch req.Action {
+	case AppealActionAccept:
+		if req.Score == nil || *req.Score < 0 || *req.Score > 100 {
+			return c.String(http.StatusBadRequest, "Invalid score.")
+		}
+	case AppealActionReject:
+	default:
+		return c.String(http.StatusBadRequest, "Invalid action.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var appeal Appeal
+	if err := tx.Get(&appeal, "SELECT * FROM `appeals` WHERE `id` = ? AND `course_id` = ? FOR UPDATE", appealID, courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such appeal.")
+	}
+	if appeal.Status != AppealPending {
+		return c.String(http.StatusConflict, "This appeal is already resolved.")
+	}
+
+	// 採点結果登録と同じく、講義・科目・提出・集計値の順にロックする
+	var class Class
+	if err := tx.Get(&class, "SELECT * FROM `classes` WHERE `id` = ? FOR SHARE", appeal.ClassID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	var course Course
+	if err := tx.Get(&course, "SELECT * FROM `courses` WHERE `id` = ? FOR SHARE", appeal.CourseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	var score sql.NullInt64
+	if err := tx.Get(&score, "SELECT `score` FROM `submissions` WHERE `user_id` = ? AND `class_id` = ? FOR UPDATE", appeal.UserID, appeal.ClassID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	oldScore := int(score.Int64)
+	newScore := oldScore
+
+	if req.Action == AppealActionAccept {
+		appeal.Status = AppealAccepted
+		newScore = *req.Score
+		if _, err := tx.Exec("UPDATE `submissions` SET `score` = ? WHERE `user_id` = ? AND `class_id` = ?", newScore, appeal.UserID, appeal.ClassID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if class.ScoresPublished {
+			policy, err := loadGradingPolicy(tx, course.ID)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			maxScore, err := loadMaxScore(tx, course.ID, policy)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			delta := (newScore - oldScore) * policy.Weight(class.Part)
+			if err := addCourseScore(tx, &course, policy, maxScore, appeal.UserID, delta); err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+		}
+	} else {
+		appeal.Status = AppealRejected
+	}
+
+	if _, err := tx.Exec("UPDATE `appeals` SET `status` = ? WHERE `id` = ?", appeal.Status, appeal.ID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := addAppealEvent(tx, appeal.ID, userID, req.Action, &oldScore, &newScore, req.Comment); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := notifyAppealResult(tx, &appeal, &class, oldScore, newScore, req.Comment); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// checkInCodeAlphabet は読み間違えやすい文字(0, O, 1, I)を除いた英数字
+	checkInCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	checkInCodeLength   = 6
+	// attendanceSessionDefaultTTL は有効期間を指定しなかった場合のチェックインコードの有効期間
+	attendanceSessionDefaultTTL = 5 * time.Minute
+	attendanceSessionMaxTTL     = 60 * time.Minute
+)
+
+type AttendanceSession struct {
+	ClassID   string    `db:"class_id"`
+	Code      string    `db:"code"`
+	OpenedBy  string    `db:"opened_by"`
+	OpenedAt  time.Time `db:"opened_at"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// Accepts は code が時刻 now に有効なチェックインコードかどうかを返す。大文字・小文字は区別しない
+func (s *AttendanceSession) Accepts(code string, now time.Time) bool {
+	if now.After(s.ExpiresAt) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.ToUpper(code)), []byte(s.Code)) == 1
+}
+
+// newCheckInCode は講義の出席確認に使うチェックインコードを生成する
+func newCheckInCode() (string, error) {
+	max := big.NewInt(int64(len(checkInCodeAlphabet)))
+	code := make([]byte, checkInCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = checkInCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// loadAttendanceClassCounts は科目毎の、出席を取った(チェックインコードを発行した)講義の数を取得する
+func loadAttendanceClassCounts(q sqlx.Queryer, courseIDs []string) (map[string]int, error) {
+	counts := make(map[string]int, len(courseIDs))
+	if len(courseIDs) == 0 {
+		return counts, nil
+	}
+	args := make([]interface{}, 0, len(courseIDs))
+	for _, id := range courseIDs {
+		args = append(args, id)
+	}
+	var rows []struct {
+		CourseID string `db:"course_id"`
+		Count    int    `db:"count"`
+	}
+	query := "SELECT `classes`.`course_id`, COUNT(*) AS `count`" +
+		" FROM `attendance_sessions`" +
+		" JOIN `classes` ON `classes`.`id` = `attendance_sessions`.`class_id`" +
+		" WHERE `classes`.`course_id` IN (" + placeholders(len(args)) + ")" +
+		" GROUP BY `classes`.`course_id`"
+	if err := sqlx.Select(q, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		counts[row.CourseID] = row.Count
+	}
+	return counts, nil
+}
+
+type OpenAttendanceSessionRequest struct {
+	// ExpiresInMinutes はチェックインコードの有効期間(分)。省略した場合は5分
+	ExpiresInMinutes int `json:"expires_in_minutes"`
+}
+
+type OpenAttendanceSessionResponse struct {
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// OpenAttendanceSession POST /api/courses/:courseID/classes/:classID/attendance/session 出席確認のチェックインコードの発行
+// 同じ講義で再度発行した場合は、以前のコードは使えなくなる
+func (h *handlers) OpenAttendanceSession(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+
+	var req OpenAttendanceSessionRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	ttl := attendanceSessionDefaultTTL
+	if req.ExpiresInMinutes != 0 {
+		ttl = time.Duration(req.ExpiresInMinutes) * time.Minute
+		if ttl < 0 || ttl > attendanceSessionMaxTTL {
+			return c.String(http.StatusBadRequest, "Invalid expires_in_minutes.")
+		}
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var status CourseStatus
+	if err := tx.Get(&status, "SELECT `status` FROM `courses` WHERE `id` = ? FOR SHARE", courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+	if status != StatusInProgress {
+		return c.String(http.StatusBadRequest, "This course is not in progress.")
+	}
+
+	var classCount int
+	if err := tx.Get(&classCount, "SELECT COUNT(*) FROM `classes` WHERE `id` = ? AND `course_id` = ? FOR SHARE", classID, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if classCount == 0 {
+		return c.String(http.StatusNotFound, "No such class.")
+	}
+
+	code, err := newCheckInCode()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	if _, err := tx.Exec("INSERT INTO `attendance_sessions` (`class_id`, `code`, `opened_by`, `opened_at`, `expires_at`) VALUES (?, ?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE `code` = VALUES(`code`), `opened_by` = VALUES(`opened_by`), `opened_at` = VALUES(`opened_at`), `expires_at` = VALUES(`expires_at`)",
+		classID, code, userID, now, expiresAt); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, OpenAttendanceSessionResponse{Code: code, ExpiresAt: expiresAt})
+}
+
+type CheckInRequest struct {
+	Code string `json:"code"`
+}
+
+// CheckIn POST /api/courses/:courseID/classes/:classID/attendance 講義への出席
+func (h *handlers) CheckIn(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+
+	var req CheckInRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var course Course
+	if err := tx.Get(&course, "SELECT * FROM `courses` WHERE `id` = ? FOR SHARE", courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+	if course.Status != StatusInProgress {
+		return c.String(http.StatusBadRequest, "This course is not in progress.")
+	}
+
+	var registrationCount int
+	if err := tx.Get(&registrationCount, "SELECT COUNT(*) FROM `registrations` WHERE `user_id` = ? AND `course_id` = ?", userID, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if registrationCount == 0 {
+		return c.String(http.StatusBadRequest, "You have not taken this course.")
+	}
+
+	var session AttendanceSession
+	query := "SELECT `attendance_sessions`.* FROM `attendance_sessions`" +
+		" JOIN `classes` ON `classes`.`id` = `attendance_sessions`.`class_id`" +
+		" WHERE `attendance_sessions`.`class_id` = ? AND `classes`.`course_id` = ?"
+	if err := tx.Get(&session, query, classID, courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows || !session.Accepts(req.Code, time.Now()) {
+		return c.String(http.StatusBadRequest, "Invalid or expired check-in code.")
+	}
+
+	result, err := tx.Exec("INSERT IGNORE INTO `attendances` (`class_id`, `user_id`, `checked_in_at`) VALUES (?, ?, NOW(6))", classID, userID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 出席点は初回のチェックインでのみ加える
+	if n, err := result.RowsAffected(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if n == 1 {
+		policy, err := loadGradingPolicy(tx, courseID)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		maxScore, err := loadMaxScore(tx, courseID, policy)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if err := addCourseScore(tx, &course, policy, maxScore, userID, int(policy.AttendanceWeight)); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type AttendanceRosterClass struct {
+	ClassID   string `json:"class_id" db:"class_id"`
+	Part      uint8  `json:"part" db:"part"`
+	Title     string `json:"title" db:"title"`
+	Attendees int    `json:"attendees" db:"attendees"`
+}
+
+type AttendanceRosterStudent struct {
+	UserCode      string  `json:"user_code"`
+	UserName      string  `json:"user_name"`
+	AttendedParts []uint8 `json:"attended_parts"`
+	Rate          float64 `json:"rate"` // 出席を取った講義のうち出席した割合
+}
+
+type GetAttendanceRosterResponse struct {
+	Classes  []AttendanceRosterClass   `json:"classes"` // 出席を取った講義
+	Students []AttendanceRosterStudent `json:"students"`
+}
+
+// GetAttendanceRoster GET /api/courses/:courseID/attendance 履修者毎の出席状況の取得
+func (h *handlers) GetAttendanceRoster(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	var count int
+	if err := h.DB.Get(&count, "SELECT COUNT(*) FROM `courses` WHERE `id` = ?", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+
+	res := GetAttendanceRosterResponse{
+		Classes:  make([]AttendanceRosterClass, 0),
+		Students: make([]AttendanceRosterStudent, 0),
+	}
+	query := "SELECT `classes`.`id` AS `class_id`, `classes`.`part`, `classes`.`title`, COUNT(`attendances`.`user_id`) AS `attendees`" +
+		" FROM `attendance_sessions`" +
+		" JOIN `classes` ON `classes`.`id` = `attendance_sessions`.`class_id`" +
+		" LEFT JOIN `attendances` ON `attendances`.`class_id` = `classes`.`id`" +
+		" WHERE `classes`.`course_id` = ?" +
+		" GROUP BY `classes`.`id`" +
+		" ORDER BY `classes`.`part`"
+	if err := h.DB.Select(&res.Classes, query, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var students []User
+	query = "SELECT `users`.* FROM `users`" +
+		" JOIN `registrations` ON `registrations`.`user_id` = `users`.`id`" +
+		" WHERE `registrations`.`course_id` = ?" +
+		" ORDER BY `users`.`code`"
+	if err := h.DB.Select(&students, query, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var attendances []struct {
+		UserID string `db:"user_id"`
+		Part   uint8  `db:"part"`
+	}
+	query = "SELECT `attendances`.`user_id`, `classes`.`part`" +
+		" FROM `attendances`" +
+		" JOIN `classes` ON `classes`.`id` = `attendances`.`class_id`" +
+		" WHERE `classes`.`course_id` = ?" +
+		" ORDER BY `classes`.`part`"
+	if err := h.DB.Select(&attendances, query, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	attendedParts := make(map[string][]uint8, len(students))
+	for _, a := range attendances {
+		attendedParts[a.UserID] = append(attendedParts[a.UserID], a.Part)
+	}
+
+	for _, student := range students {
+		parts := attendedParts[student.ID]
+		if parts == nil {
+			parts = []uint8{}
+		}
+		rate := 0.0
+		if len(res.Classes) > 0 {
+			rate = float64(len(parts)) / float64(len(res.Classes))
+		}
+		res.Students = append(res.Students, AttendanceRosterStudent{
+			UserCode:      student.Code,
+			UserName:      student.Name,
+			AttendedParts: parts,
+			Rate:          rate,
+		})
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
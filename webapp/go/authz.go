@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Permission は科目に対する操作の権限
+type Permission string
+
+const (
+	PermManageCourse      Permission = "course:manage"
+	PermPostAnnouncement  Permission = "announcement:post"
+	PermGradeSubmissions  Permission = "submissions:grade"
+	PermPublishScores     Permission = "scores:publish"
+	PermExportSubmissions Permission = "submissions:export"
+	PermTakeAttendance    Permission = "attendance:take"
+	PermManageStaff       Permission = "staff:manage"
+)
+
+// CourseRole は科目に対するユーザの役割
+type CourseRole string
+
+const (
+	CourseRoleNone  CourseRole = ""
+	CourseRoleOwner CourseRole = "owner"
+	CourseRoleAdmin CourseRole = "admin"
+	// CourseRoleTA は course_staff で科目毎に割り当てられる
+	CourseRoleTA CourseRole = "ta"
+)
+
+var courseRolePermissions = map[CourseRole][]Permission{
+	CourseRoleOwner: {PermManageCourse, PermPostAnnouncement, PermGradeSubmissions, PermPublishScores, PermExportSubmissions, PermTakeAttendance, PermManageStaff},
+	CourseRoleAdmin: {PermManageCourse, PermPostAnnouncement, PermGradeSubmissions, PermPublishScores, PermExportSubmissions, PermTakeAttendance, PermManageStaff},
+	CourseRoleTA:    {PermGradeSubmissions, PermExportSubmissions, PermTakeAttendance},
+}
+
+// staffRoles は course_staff で割り当て可能な役割
+var staffRoles = []CourseRole{CourseRoleTA}
+
+func isStaffRole(role CourseRole) bool {
+	for _, r := range staffRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (r CourseRole) Can(perm Permission) bool {
+	for _, p := range courseRolePermissions[r] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// isStaff は教員用画面、教員用APIを利用できるユーザ種別かどうか
+func isStaff(userType UserType) bool {
+	return userType == Teacher || userType == TeachingAssistant || userType == Registrar
+}
+
+func (h *handlers) getUserType(userID string) (UserType, error) {
+	var userType UserType
+	if err := h.DB.Get(&userType, "SELECT `type` FROM `users` WHERE `id` = ?", userID); err != nil {
+		return "", err
+	}
+	return userType, nil
+}
+
+// getCourseRole はユーザの科目に対する役割を返す
+// 教務(registrar)はすべての科目の管理者として扱い、それ以外は科目の担当教員と course_staff に登録されたユーザのみが役割を持つ
+func (h *handlers) getCourseRole(userID string, courseID string) (role CourseRole, courseExists bool, err error) {
+	userType, err := h.getUserType(userID)
+	if err != nil {
+		return CourseRoleNone, false, err
+	}
+
+	var teacherID string
+	if err := h.DB.Get(&teacherID, "SELECT `teacher_id` FROM `courses` WHERE `id` = ?", courseID); err != nil && err != sql.ErrNoRows {
+		return CourseRoleNone, false, err
+	} else if err == sql.ErrNoRows {
+		return CourseRoleNone, false, nil
+	}
+
+	switch {
+	case userType == Registrar:
+		return CourseRoleAdmin, true, nil
+	case userType == Teacher && teacherID == userID:
+		return CourseRoleOwner, true, nil
+	}
+
+	var staffRole CourseRole
+	if err := h.DB.Get(&staffRole, "SELECT `role` FROM `course_staff` WHERE `course_id` = ? AND `user_id` = ?", courseID, userID); err != nil && err != sql.ErrNoRows {
+		return CourseRoleNone, false, err
+	} else if err == sql.ErrNoRows {
+		return CourseRoleNone, true, nil
+	}
+	return staffRole, true, nil
+}
+
+// RequireRole 指定したユーザ種別のみ許可するmiddleware
+func (h *handlers) RequireRole(userTypes ...UserType) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			userID, _, _, err := getUserInfo(c)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			userType, err := h.getUserType(userID)
+			if err != nil && err != sql.ErrNoRows {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			for _, t := range userTypes {
+				if userType == t {
+					return next(c)
+				}
+			}
+			return c.String(http.StatusForbidden, "You are not allowed to access this API.")
+		}
+	}
+}
+
+// Authorize パスの科目(と講義)に対して perm の権限を持つか確認するmiddleware
+// 科目や講義が存在しない場合は、権限を確認できないので404を返す
+func (h *handlers) Authorize(perm Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			userID, _, _, err := getUserInfo(c)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+
+			courseID := c.Param("courseID")
+			role, courseExists, err := h.getCourseRole(userID, courseID)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			if !courseExists {
+				return c.String(http.StatusNotFound, "No such course.")
+			}
+
+			// 他の科目の講義を指定して権限チェックをすり抜けられないようにする
+			if classID := c.Param("classID"); classID != "" {
+				var classCourseID string
+				if err := h.DB.Get(&classCourseID, "SELECT `course_id` FROM `classes` WHERE `id` = ?", classID); err != nil && err != sql.ErrNoRows {
+					c.Logger().Error(err)
+					return c.NoContent(http.StatusInternalServerError)
+				} else if err == sql.ErrNoRows || classCourseID != courseID {
+					return c.String(http.StatusNotFound, "No such class.")
+				}
+			}
+
+			if !role.Can(perm) {
+				return c.String(http.StatusForbidden, "You are not allowed to manage this course.")
+			}
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo/v4"
+)
+
+type CopyCourseRequest struct {
+	Code string `json:"code"`
+}
+
+// CopyCourseResponse は科目のコピーの内容。dry_run の場合は作成されるものを表し、IDは空になる
+type CopyCourseResponse struct {
+	DryRun        bool                    `json:"dry_run"`
+	Course        GetCourseDetailResponse `json:"course"`
+	GradingPolicy *GradingPolicy          `json:"grading_policy"`
+	Classes       []CopiedClass           `json:"classes"`
+	// Syllabus はコピーするシラバスのファイル名。シラバスがない場合は null
+	Syllabus *string `json:"syllabus"`
+}
+
+type CopiedClass struct {
+	ID          string           `json:"id,omitempty"`
+	Part        uint8            `json:"part"`
+	Title       string           `json:"title"`
+	Description string           `json:"description"`
+	Materials   []CopiedMaterial `json:"materials"`
+}
+
+type CopiedMaterial struct {
+	ID       string       `json:"id,omitempty"`
+	Kind     MaterialKind `json:"kind"`
+	Title    string       `json:"title"`
+	FileName string       `json:"file_name,omitempty"`
+	URL      string       `json:"url,omitempty"`
+	// sourceID はコピー元の講義資料のID
+	sourceID string
+}
+
+// CopyCourse POST /api/courses/:courseID/copy 科目のコピー(次の学期への引き継ぎ)
+// 科目情報・成績評価の方針・講義・講義資料・シラバスを、新しい科目コードの履修登録期間中の科目にコピーする
+// 担当教員は元の科目と同じで、履修登録・課題の提出・出席はコピーしない。?dry_run=true の場合はコピーせずに内容だけを返す
+func (h *handlers) CopyCourse(c echo.Context) error {
+	courseID := c.Param("courseID")
+	dryRun := c.QueryParam("dry_run") == "true"
+
+	var req CopyCourseRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	// 科目の追加と同じ検証をする
+	if err := validateCourseCode(req.Code); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid course code.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	res := CopyCourseResponse{DryRun: dryRun}
+	query := "SELECT `courses`.*, `users`.`name` AS `teacher`" +
+		" FROM `courses` JOIN `users` ON `courses`.`teacher_id` = `users`.`id`" +
+		" WHERE `courses`.`id` = ? FOR SHARE"
+	if err := tx.Get(&res.Course, query, courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+	res.Course.ID = ""
+	res.Course.Code = req.Code
+	res.Course.Status = StatusRegistration
+
+	var codeCount int
+	if err := tx.Get(&codeCount, "SELECT COUNT(*) FROM `courses` WHERE `code` = ?", req.Code); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if codeCount > 0 {
+		return c.String(http.StatusConflict, "A course with the same code already exists.")
+	}
+
+	if res.GradingPolicy, err = loadGradingPolicy(tx, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var classes []Class
+	if err := tx.Select(&classes, "SELECT * FROM `classes` WHERE `course_id` = ? ORDER BY `part`", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	classIDs := make([]string, 0, len(classes))
+	for _, class := range classes {
+		classIDs = append(classIDs, class.ID)
+	}
+	materials, err := loadClassMaterials(tx, classIDs)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	res.Classes = make([]CopiedClass, 0, len(classes))
+	for _, class := range classes {
+		copied := CopiedClass{
+			Part:        class.Part,
+			Title:       class.Title,
+			Description: class.Description,
+			Materials:   make([]CopiedMaterial, 0, len(materials[class.ID])),
+		}
+		for _, material := range materials[class.ID] {
+			copied.Materials = append(copied.Materials, CopiedMaterial{
+				Kind:     material.Kind,
+				Title:    material.Title,
+				FileName: material.FileName,
+				URL:      material.URL,
+				sourceID: material.ID,
+			})
+		}
+		res.Classes = append(res.Classes, copied)
+	}
+
+	var syllabus string
+	if err := tx.Get(&syllabus, "SELECT `file_name` FROM `course_syllabi` WHERE `course_id` = ?", courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == nil {
+		res.Syllabus = &syllabus
+	}
+
+	if dryRun {
+		return c.JSON(http.StatusOK, res)
+	}
+
+	// 講義資料とシラバスのファイルは一時ファイルにコピーし、コミットに成功してから本来のパスに移動する
+	var staged stagedFiles
+	defer staged.discard()
+
+	newCourseID := newULID()
+	course := res.Course
+	if _, err := tx.Exec("INSERT INTO `courses` (`id`, `code`, `type`, `name`, `description`, `credit`, `period`, `day_of_week`, `teacher_id`, `keywords`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		newCourseID, course.Code, course.Type, course.Name, course.Description, course.Credit, course.Period, course.DayOfWeek, course.TeacherID, course.Keywords); err != nil {
+		if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
+			return c.String(http.StatusConflict, "A course with the same code already exists.")
+		}
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	res.Course.ID = newCourseID
+	if err := saveGradingPolicy(tx, newCourseID, res.GradingPolicy); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	for i := range res.Classes {
+		class := &res.Classes[i]
+		class.ID = newULID()
+		if _, err := tx.Exec("INSERT INTO `classes` (`id`, `course_id`, `part`, `title`, `description`) VALUES (?, ?, ?, ?, ?)",
+			class.ID, newCourseID, class.Part, class.Title, class.Description); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		for j := range class.Materials {
+			material := &class.Materials[j]
+			material.ID = newULID()
+			if _, err := tx.Exec("INSERT INTO `class_materials` (`id`, `class_id`, `kind`, `title`, `file_name`, `url`, `created_at`) VALUES (?, ?, ?, ?, ?, ?, NOW(6))",
+				material.ID, class.ID, material.Kind, material.Title, material.FileName, material.URL); err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			if material.Kind == MaterialFile {
+				if err := staged.stageCopy(classMaterialPath(material.ID), classMaterialPath(material.sourceID)); err != nil {
+					c.Logger().Error(err)
+					return c.NoContent(http.StatusInternalServerError)
+				}
+			}
+		}
+	}
+
+	if res.Syllabus != nil {
+		if _, err := tx.Exec("INSERT INTO `course_syllabi` (`course_id`, `file_name`, `updated_at`) VALUES (?, ?, NOW(6))", newCourseID, *res.Syllabus); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if err := staged.stageCopy(courseSyllabusPath(newCourseID), courseSyllabusPath(courseID)); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := staged.commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	h.CourseIndex.Add(res.Course)
+
+	return c.JSON(http.StatusCreated, res)
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// CourseSearchParams は科目検索の条件
+// 値がゼロ値(スライスは空)の条件は絞り込みに使わない
+type CourseSearchParams struct {
+	Type       string
+	Credit     int
+	Teacher    string
+	Periods    []int
+	DaysOfWeek []string
+	// Keywords は空白区切りのキーワードで、すべてを科目名に含むか、すべてをキーワードに含む科目が対象になる
+	// nil の場合は絞り込まない
+	Keywords []string
+	Status   string
+}
+
+// parseCourseSearchParams はクエリパラメータから検索条件を取り出す
+// 無効な検索条件はエラーを返さず無視して良い
+func parseCourseSearchParams(c echo.Context) CourseSearchParams {
+	var params CourseSearchParams
+	params.Type = c.QueryParam("type")
+	if credit, err := strconv.Atoi(c.QueryParam("credit")); err == nil && credit > 0 {
+		params.Credit = credit
+	}
+	params.Teacher = c.QueryParam("teacher")
+	for _, v := range multiValueQueryParam(c, "period") {
+		if period, err := strconv.Atoi(v); err == nil && period > 0 {
+			params.Periods = append(params.Periods, period)
+		}
+	}
+	params.DaysOfWeek = multiValueQueryParam(c, "day_of_week")
+	if keywords := c.QueryParam("keywords"); keywords != "" {
+		params.Keywords = strings.Split(keywords, " ")
+	}
+	params.Status = c.QueryParam("status")
+	return params
+}
+
+// CourseIndex は科目検索用のプロセス内の転置インデックス
+// 属性毎の値と、科目名・キーワードの文字n-gramから科目を引けるようにし、候補を絞り込んでから条件を照合する
+// DBの照合順序が utf8mb4_bin でSQLの検索は大文字と小文字を区別するため、索引も文字列をそのまま比較する
+type CourseIndex struct {
+	mu sync.RWMutex
+	// courses は code の昇順に並べた全科目
+	courses []*GetCourseDetailResponse
+	byID    map[string]*GetCourseDetailResponse
+
+	// 属性の値(数値は10進表記)から科目IDを引く
+	byType    postings
+	byCredit  postings
+	byTeacher postings
+	byPeriod  postings
+	byDay     postings
+	byStatus  postings
+	// nameGrams, keywordGrams は1文字と2文字のn-gramから科目IDを引く
+	nameGrams    postings
+	keywordGrams postings
+}
+
+// postings はキーから科目IDの集合を引く
+type postings map[string]map[string]struct{}
+
+func NewCourseIndex() *CourseIndex {
+	idx := &CourseIndex{}
+	idx.reset()
+	return idx
+}
+
+func (idx *CourseIndex) reset() {
+	idx.courses = nil
+	idx.byID = make(map[string]*GetCourseDetailResponse)
+	idx.byType = make(postings)
+	idx.byCredit = make(postings)
+	idx.byTeacher = make(postings)
+	idx.byPeriod = make(postings)
+	idx.byDay = make(postings)
+	idx.byStatus = make(postings)
+	idx.nameGrams = make(postings)
+	idx.keywordGrams = make(postings)
+}
+
+// Rebuild はDBの科目から索引を作り直す
+func (idx *CourseIndex) Rebuild(db sqlx.Queryer) error {
+	var courses []GetCourseDetailResponse
+	query := "SELECT `courses`.*, `users`.`name` AS `teacher`" +
+		" FROM `courses` JOIN `users` ON `courses`.`teacher_id` = `users`.`id`"
+	if err := sqlx.Select(db, &courses, query); err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.reset()
+	for i := range courses {
+		idx.add(&courses[i])
+	}
+	return nil
+}
+
+// Add は科目を索引に追加する。同じIDの科目が既にある場合は置き換える
+func (idx *CourseIndex) Add(course GetCourseDetailResponse) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if old, ok := idx.byID[course.ID]; ok {
+		idx.remove(old)
+	}
+	idx.add(&course)
+}
+
+// SetStatus は科目のステータスを更新する
+func (idx *CourseIndex) SetStatus(courseID string, status CourseStatus) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	course, ok := idx.byID[courseID]
+	if !ok {
+		return
+	}
+	idx.byStatus.remove(string(course.Status), course.ID)
+	course.Status = status
+	idx.byStatus.add(string(course.Status), course.ID)
+}
+
+// SetTeacherName は担当教員の名前の変更を反映する
+func (idx *CourseIndex) SetTeacherName(teacherID string, name string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, course := range idx.courses {
+		if course.TeacherID != teacherID {
+			continue
+		}
+		idx.byTeacher.remove(course.Teacher, course.ID)
+		course.Teacher = name
+		idx.byTeacher.add(course.Teacher, course.ID)
+	}
+}
+
+func (idx *CourseIndex) add(course *GetCourseDetailResponse) {
+	i := sort.Search(len(idx.courses), func(i int) bool { return idx.courses[i].Code >= course.Code })
+	idx.courses = append(idx.courses, nil)
+	copy(idx.courses[i+1:], idx.courses[i:])
+	idx.courses[i] = course
+	idx.byID[course.ID] = course
+
+	idx.byType.add(course.Type, course.ID)
+	idx.byCredit.add(strconv.Itoa(int(course.Credit)), course.ID)
+	idx.byTeacher.add(course.Teacher, course.ID)
+	idx.byPeriod.add(strconv.Itoa(int(course.Period)), course.ID)
+	idx.byDay.add(course.DayOfWeek, course.ID)
+	idx.byStatus.add(string(course.Status), course.ID)
+	for _, gram := range ngrams(course.Name) {
+		idx.nameGrams.add(gram, course.ID)
+	}
+	for _, gram := range ngrams(course.Keywords) {
+		idx.keywordGrams.add(gram, course.ID)
+	}
+}
+
+func (idx *CourseIndex) remove(course *GetCourseDetailResponse) {
+	i := sort.Search(len(idx.courses), func(i int) bool { return idx.courses[i].Code >= course.Code })
+	if i < len(idx.courses) && idx.courses[i] == course {
+		idx.courses = append(idx.courses[:i], idx.courses[i+1:]...)
+	}
+	delete(idx.byID, course.ID)
+
+	idx.byType.remove(course.Type, course.ID)
+	idx.byCredit.remove(strconv.Itoa(int(course.Credit)), course.ID)
+	idx.byTeacher.remove(course.Teacher, course.ID)
+	idx.byPeriod.remove(strconv.Itoa(int(course.Period)), course.ID)
+	idx.byDay.remove(course.DayOfWeek, course.ID)
+	idx.byStatus.remove(string(course.Status), course.ID)
+	for _, gram := range ngrams(course.Name) {
+		idx.nameGrams.remove(gram, course.ID)
+	}
+	for _, gram := range ngrams(course.Keywords) {
+		idx.keywordGrams.remove(gram, course.ID)
+	}
+}
+
+// Search は条件に一致する科目を code の昇順で最大 limit 件返す
+// ページングの意味は SearchCourses のSQLによる実装と同じで、hasMore は取得方向にまだ続きがあるかどうか
+func (idx *CourseIndex) Search(params CourseSearchParams, p Pagination, limit int) (res []GetCourseDetailResponse, hasMore bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var matched []*GetCourseDetailResponse
+	if candidates, ok := idx.candidates(params); ok {
+		for id := range candidates {
+			if course := idx.byID[id]; matchCourse(course, params) {
+				matched = append(matched, course)
+			}
+		}
+		sort.Slice(matched, func(i, j int) bool { return matched[i].Code < matched[j].Code })
+	} else {
+		for _, course := range idx.courses {
+			if matchCourse(course, params) {
+				matched = append(matched, course)
+			}
+		}
+	}
+
+	var page []*GetCourseDetailResponse
+	switch {
+	case p.Page > 0:
+		// page= による指定は非推奨だが互換性のために残している
+		start := limit * (p.Page - 1)
+		if start < len(matched) {
+			page = matched[start:]
+		}
+	case p.Direction == CursorPrev:
+		end := sort.Search(len(matched), func(i int) bool { return matched[i].Code >= p.Key })
+		start := end - limit
+		if start < 0 {
+			start = 0
+		}
+		return copyCourses(matched[start:end]), start > 0
+	case p.Direction == CursorNext:
+		start := sort.Search(len(matched), func(i int) bool { return matched[i].Code > p.Key })
+		page = matched[start:]
+	default:
+		page = matched
+	}
+	if len(page) > limit {
+		return copyCourses(page[:limit]), true
+	}
+	return copyCourses(page), false
+}
+
+// candidates は索引から候補の科目IDを集める
+// 索引で絞り込める条件がない場合は ok が false になる
+func (idx *CourseIndex) candidates(params CourseSearchParams) (candidates map[string]struct{}, ok bool) {
+	var sets []map[string]struct{}
+	if params.Type != "" {
+		sets = append(sets, idx.byType[params.Type])
+	}
+	if params.Credit > 0 {
+		sets = append(sets, idx.byCredit[strconv.Itoa(params.Credit)])
+	}
+	if params.Teacher != "" {
+		sets = append(sets, idx.byTeacher[params.Teacher])
+	}
+	if len(params.Periods) > 0 {
+		union := make(map[string]struct{})
+		for _, period := range params.Periods {
+			unionInto(union, idx.byPeriod[strconv.Itoa(period)])
+		}
+		sets = append(sets, union)
+	}
+	if len(params.DaysOfWeek) > 0 {
+		union := make(map[string]struct{})
+		for _, day := range params.DaysOfWeek {
+			unionInto(union, idx.byDay[day])
+		}
+		sets = append(sets, union)
+	}
+	if params.Status != "" {
+		sets = append(sets, idx.byStatus[params.Status])
+	}
+	if keywordSet, ok := idx.keywordCandidates(params.Keywords); ok {
+		sets = append(sets, keywordSet)
+	}
+	if len(sets) == 0 {
+		return nil, false
+	}
+
+	// 小さい集合から順に積集合を取る
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+	candidates = make(map[string]struct{}, len(sets[0]))
+	for id := range sets[0] {
+		candidates[id] = struct{}{}
+	}
+	for _, set := range sets[1:] {
+		for id := range candidates {
+			if _, ok := set[id]; !ok {
+				delete(candidates, id)
+			}
+		}
+	}
+	return candidates, true
+}
+
+// keywordCandidates はすべてのキーワードのn-gramを科目名に含む科目と、キーワードに含む科目の和集合を返す
+func (idx *CourseIndex) keywordCandidates(keywords []string) (map[string]struct{}, bool) {
+	var grams []string
+	for _, keyword := range keywords {
+		grams = append(grams, ngrams(keyword)...)
+	}
+	// 空文字列のキーワードはすべての科目に一致するため索引では絞り込めない
+	if len(grams) == 0 {
+		return nil, false
+	}
+	union := make(map[string]struct{})
+	unionInto(union, idx.nameGrams.intersect(grams))
+	unionInto(union, idx.keywordGrams.intersect(grams))
+	return union, true
+}
+
+// matchCourse は科目が検索条件に一致するか照合する
+func matchCourse(course *GetCourseDetailResponse, params CourseSearchParams) bool {
+	if params.Type != "" && course.Type != params.Type {
+		return false
+	}
+	if params.Credit > 0 && int(course.Credit) != params.Credit {
+		return false
+	}
+	if params.Teacher != "" && course.Teacher != params.Teacher {
+		return false
+	}
+	if len(params.Periods) > 0 && !containsInt(params.Periods, int(course.Period)) {
+		return false
+	}
+	if len(params.DaysOfWeek) > 0 && !containsString(params.DaysOfWeek, course.DayOfWeek) {
+		return false
+	}
+	if params.Keywords != nil && !containsAllStrings(course.Name, params.Keywords) && !containsAllStrings(course.Keywords, params.Keywords) {
+		return false
+	}
+	if params.Status != "" && string(course.Status) != params.Status {
+		return false
+	}
+	return true
+}
+
+// ngrams は文字列中の1文字と連続する2文字をすべて返す
+// キーワードの n-gram がすべて含まれることは部分文字列であることの必要条件になる
+func ngrams(s string) []string {
+	runes := []rune(s)
+	grams := make([]string, 0, len(runes)*2)
+	for i := range runes {
+		grams = append(grams, string(runes[i]))
+		if i+1 < len(runes) {
+			grams = append(grams, string(runes[i:i+2]))
+		}
+	}
+	return grams
+}
+
+// intersect はすべてのキーに含まれる科目IDの集合を返す
+func (p postings) intersect(keys []string) map[string]struct{} {
+	result := make(map[string]struct{})
+	for i, key := range keys {
+		set := p[key]
+		if i == 0 {
+			unionInto(result, set)
+			continue
+		}
+		for id := range result {
+			if _, ok := set[id]; !ok {
+				delete(result, id)
+			}
+		}
+		if len(result) == 0 {
+			break
+		}
+	}
+	return result
+}
+
+func (p postings) add(key string, id string) {
+	set, ok := p[key]
+	if !ok {
+		set = make(map[string]struct{})
+		p[key] = set
+	}
+	set[id] = struct{}{}
+}
+
+func (p postings) remove(key string, id string) {
+	if set, ok := p[key]; ok {
+		delete(set, id)
+		if len(set) == 0 {
+			delete(p, key)
+		}
+	}
+}
+
+func unionInto(dst map[string]struct{}, src map[string]struct{}) {
+	for id := range src {
+		dst[id] = struct{}{}
+	}
+}
+
+func copyCourses(courses []*GetCourseDetailResponse) []GetCourseDetailResponse {
+	res := make([]GetCourseDetailResponse, 0, len(courses))
+	for _, course := range courses {
+		res = append(res, *course)
+	}
+	return res
+}
+
+func containsInt(arr []int, v int) bool {
+	for _, a := range arr {
+		if a == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(arr []string, v string) bool {
+	for _, a := range arr {
+		if a == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAllStrings(s string, keys []string) bool {
+	for _, key := range keys {
+		if !strings.Contains(s, key) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// searchCourseParam は benchmarker/model.SearchCourseParam に対応する検索条件
+// ベンチマーカーでは時限・曜日は1つのみ指定でき、-1 が未指定を表すが、ここでは複数指定に合わせて空スライスを未指定とする
+type searchCourseParam struct {
+	Type       string
+	Credit     int
+	Teacher    string
+	Periods    []int
+	DaysOfWeek []string
+	Keywords   []string
+	Status     string
+}
+
+func (p searchCourseParam) toParams() CourseSearchParams {
+	return CourseSearchParams{
+		Type:       p.Type,
+		Credit:     p.Credit,
+		Teacher:    p.Teacher,
+		Periods:    p.Periods,
+		DaysOfWeek: p.DaysOfWeek,
+		Keywords:   p.Keywords,
+		Status:     p.Status,
+	}
+}
+
+// searchCourseLocal は benchmarker/scenario/prepare.go の searchCourseLocal を移植したもの
+// ベンチマーカーが検索結果の検証に使う実装を正解とする
+func searchCourseLocal(courses []*GetCourseDetailResponse, param searchCourseParam) []*GetCourseDetailResponse {
+	matchCourses := make([]*GetCourseDetailResponse, 0)
+
+	for _, course := range courses {
+		if (param.Type == "" || course.Type == param.Type) &&
+			(param.Credit == 0 || int(course.Credit) == param.Credit) &&
+			(param.Teacher == "" || course.Teacher == param.Teacher) &&
+			(len(param.Periods) == 0 || containsInt(param.Periods, int(course.Period))) &&
+			(len(param.DaysOfWeek) == 0 || containsString(param.DaysOfWeek, course.DayOfWeek)) &&
+			(containsAllStrings(course.Name, param.Keywords) || containsAllStrings(course.Keywords, param.Keywords)) &&
+			(param.Status == "" || string(course.Status) == param.Status) {
+			matchCourses = append(matchCourses, course)
+		}
+	}
+
+	return matchCourses
+}
+
+var (
+	testCourseWords    = []string{"微分積分", "線形代数", "情報理論", "アルゴリズム", "データベース", "ネットワーク", "SpeedUP", "speedup", "ISUCON", "統計", "確率", "プログラミング", "基礎", "応用", "演習"}
+	testCourseTeachers = []string{"椅子 昭夫", "空椅子 花子", "椅子田 太郎", "Isu Taro", "isu taro"}
+	testCourseTypes    = []string{string(LiberalArts), string(MajorSubjects)}
+	testCourseStatuses = []CourseStatus{StatusRegistration, StatusInProgress, StatusClosed}
+)
+
+func randomWords(r *rand.Rand, min, max int) []string {
+	n := min + r.Intn(max-min+1)
+	words := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		words = append(words, testCourseWords[r.Intn(len(testCourseWords))])
+	}
+	return words
+}
+
+func randomTestCourse(r *rand.Rand, i int) GetCourseDetailResponse {
+	teacher := r.Intn(len(testCourseTeachers))
+	return GetCourseDetailResponse{
+		ID:          fmt.Sprintf("course-%04d", i),
+		Code:        fmt.Sprintf("%c%05d", 'A'+r.Intn(3), r.Intn(100000)),
+		Type:        testCourseTypes[r.Intn(len(testCourseTypes))],
+		Name:        strings.Join(randomWords(r, 1, 3), ""),
+		Description: "description",
+		Credit:      uint8(1 + r.Intn(3)),
+		Period:      uint8(1 + r.Intn(6)),
+		DayOfWeek:   string(daysOfWeek[r.Intn(len(daysOfWeek))]),
+		TeacherID:   fmt.Sprintf("teacher-%d", teacher),
+		Keywords:    strings.Join(randomWords(r, 1, 4), " "),
+		Status:      testCourseStatuses[r.Intn(len(testCourseStatuses))],
+		Teacher:     testCourseTeachers[teacher],
+	}
+}
+
+// swapCase は英字の大文字と小文字を入れ替える
+// DBの照合順序(utf8mb4_bin)では大文字と小文字を区別するため、索引もこれらを別の文字列として扱う必要がある
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return r
+	}, s)
+}
+
+// randomKeyword は単語そのもの、大文字と小文字を入れ替えた単語、単語の一部(1文字を含む)、空文字列のいずれかを返す
+func randomKeyword(r *rand.Rand) string {
+	word := []rune(testCourseWords[r.Intn(len(testCourseWords))])
+	switch r.Intn(5) {
+	case 0:
+		return string(word)
+	case 3:
+		return swapCase(string(word))
+	case 1:
+		return string(word[r.Intn(len(word))])
+	case 2:
+		start := r.Intn(len(word))
+		return string(word[start : start+1+r.Intn(len(word)-start)])
+	default:
+		if r.Intn(4) == 0 {
+			return ""
+		}
+		return "存在しない"
+	}
+}
+
+func randomSearchParam(r *rand.Rand, courses []*GetCourseDetailResponse) searchCourseParam {
+	var param searchCourseParam
+	target := courses[r.Intn(len(courses))]
+	if r.Intn(3) == 0 {
+		param.Type = target.Type
+	}
+	if r.Intn(3) == 0 {
+		param.Credit = int(target.Credit)
+	}
+	if r.Intn(4) == 0 {
+		param.Teacher = target.Teacher
+		if r.Intn(3) == 0 {
+			param.Teacher = swapCase(param.Teacher)
+		}
+	}
+	if r.Intn(3) == 0 {
+		param.Periods = []int{int(target.Period)}
+		if r.Intn(2) == 0 {
+			param.Periods = append(param.Periods, 1+r.Intn(6))
+		}
+	}
+	if r.Intn(3) == 0 {
+		param.DaysOfWeek = []string{target.DayOfWeek}
+		if r.Intn(2) == 0 {
+			param.DaysOfWeek = append(param.DaysOfWeek, string(daysOfWeek[r.Intn(len(daysOfWeek))]))
+		}
+	}
+	if r.Intn(2) == 0 {
+		// SearchCourses と同様に空白区切りの文字列を分割する
+		keywords := make([]string, 1+r.Intn(2))
+		for i := range keywords {
+			keywords[i] = randomKeyword(r)
+		}
+		param.Keywords = strings.Split(strings.Join(keywords, " "), " ")
+	}
+	if r.Intn(3) == 0 {
+		param.Status = string(target.Status)
+	}
+	return param
+}
+
+// searchAll は索引を next のcursorで最後までたどった結果と、最後のページから prev のcursorで先頭まで戻った結果を返す
+func searchAll(t *testing.T, idx *CourseIndex, params CourseSearchParams, limit int) (forward []string, backward []string) {
+	var lastPage []GetCourseDetailResponse
+	p := Pagination{}
+	for {
+		res, hasMore := idx.Search(params, p, limit)
+		if hasMore && len(res) != limit {
+			t.Fatalf("page has %d courses, want %d", len(res), limit)
+		}
+		for _, course := range res {
+			forward = append(forward, course.Code)
+		}
+		if !hasMore || len(res) == 0 {
+			lastPage = res
+			break
+		}
+		p = Pagination{Direction: CursorNext, Key: res[len(res)-1].Code}
+	}
+
+	// 1ページしかない場合は戻る先がない
+	if len(lastPage) == len(forward) {
+		return forward, forward
+	}
+	pages := [][]GetCourseDetailResponse{lastPage}
+	p = Pagination{Direction: CursorPrev, Key: lastPage[0].Code}
+	for {
+		res, hasMore := idx.Search(params, p, limit)
+		if len(res) != limit {
+			t.Fatalf("prev page has %d courses, want %d", len(res), limit)
+		}
+		pages = append([][]GetCourseDetailResponse{res}, pages...)
+		if !hasMore {
+			break
+		}
+		p = Pagination{Direction: CursorPrev, Key: res[0].Code}
+	}
+	for _, page := range pages {
+		for _, course := range page {
+			backward = append(backward, course.Code)
+		}
+	}
+	return forward, backward
+}
+
+func searchAllByPage(idx *CourseIndex, params CourseSearchParams, limit int) []string {
+	var codes []string
+	for page := 1; ; page++ {
+		res, hasMore := idx.Search(params, Pagination{Page: page}, limit)
+		for _, course := range res {
+			codes = append(codes, course.Code)
+		}
+		if !hasMore {
+			return codes
+		}
+	}
+}
+
+func codesOf(courses []*GetCourseDetailResponse) []string {
+	codes := make([]string, 0, len(courses))
+	for _, course := range courses {
+		codes = append(codes, course.Code)
+	}
+	return codes
+}
+
+func equalCodes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCourseIndexMatchesOracle(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	idx := NewCourseIndex()
+
+	// oracle は code の昇順に並べた科目で、索引と同じ更新を適用する
+	var oracle []*GetCourseDetailResponse
+	codes := make(map[string]bool)
+	addCourse := func(i int) {
+		course := randomTestCourse(r, i)
+		for codes[course.Code] {
+			course = randomTestCourse(r, i)
+		}
+		codes[course.Code] = true
+		idx.Add(course)
+		oracle = append(oracle, &course)
+		sort.Slice(oracle, func(i, j int) bool { return oracle[i].Code < oracle[j].Code })
+	}
+	for i := 0; i < 300; i++ {
+		addCourse(i)
+	}
+
+	const limit = 7
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 50; i++ {
+			param := randomSearchParam(r, oracle)
+			expected := codesOf(searchCourseLocal(oracle, param))
+
+			forward, backward := searchAll(t, idx, param.toParams(), limit)
+			if !equalCodes(forward, expected) {
+				t.Fatalf("round %d: cursor(next) search %+v\n got: %v\nwant: %v", round, param, forward, expected)
+			}
+			if !equalCodes(backward, expected) {
+				t.Fatalf("round %d: cursor(prev) search %+v\n got: %v\nwant: %v", round, param, backward, expected)
+			}
+			if byPage := searchAllByPage(idx, param.toParams(), limit); !equalCodes(byPage, expected) {
+				t.Fatalf("round %d: page search %+v\n got: %v\nwant: %v", round, param, byPage, expected)
+			}
+		}
+
+		// AddCourse, SetCourseStatus, 教員名の変更に相当する更新
+		for i := 0; i < 10; i++ {
+			addCourse(300 + round*10 + i)
+		}
+		for i := 0; i < 20; i++ {
+			course := oracle[r.Intn(len(oracle))]
+			status := testCourseStatuses[r.Intn(len(testCourseStatuses))]
+			idx.SetStatus(course.ID, status)
+			course.Status = status
+		}
+		teacherID := fmt.Sprintf("teacher-%d", r.Intn(len(testCourseTeachers)))
+		name := testCourseTeachers[r.Intn(len(testCourseTeachers))]
+		idx.SetTeacherName(teacherID, name)
+		for _, course := range oracle {
+			if course.TeacherID == teacherID {
+				course.Teacher = name
+			}
+		}
+	}
+}
+
+// TestCourseIndexCaseSensitive は utf8mb4_bin のSQLと同じく、キーワードと教員名の大文字と小文字を区別することを確かめる
+func TestCourseIndexCaseSensitive(t *testing.T) {
+	idx := NewCourseIndex()
+	idx.Add(GetCourseDetailResponse{ID: "course-1", Code: "A00001", Name: "SpeedUP", Keywords: "ISUCON", Teacher: "Isu Taro", Status: StatusRegistration})
+	idx.Add(GetCourseDetailResponse{ID: "course-2", Code: "A00002", Name: "speedup", Keywords: "isucon", Teacher: "isu taro", Status: StatusRegistration})
+
+	tests := []struct {
+		name   string
+		params CourseSearchParams
+		want   []string
+	}{
+		{name: "name keyword", params: CourseSearchParams{Keywords: []string{"speed"}}, want: []string{"A00002"}},
+		{name: "upper case name keyword", params: CourseSearchParams{Keywords: []string{"UP"}}, want: []string{"A00001"}},
+		{name: "keywords", params: CourseSearchParams{Keywords: []string{"ISU"}}, want: []string{"A00001"}},
+		{name: "no case-folded match", params: CourseSearchParams{Keywords: []string{"Speedup"}}, want: []string{}},
+		{name: "teacher", params: CourseSearchParams{Teacher: "isu taro"}, want: []string{"A00002"}},
+		{name: "teacher with different case", params: CourseSearchParams{Teacher: "ISU TARO"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, _ := idx.Search(tt.params, Pagination{}, 10)
+			if got := codesOf(pointers(res)); !equalCodes(got, tt.want) {
+				t.Errorf("Search(%+v) = %v, want %v", tt.params, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCourseIndexMatchesSQL は初期化済みのDBに対して、索引とSQLによる検索結果が一致することを確かめる
+// DBに接続できない場合はスキップする
+func TestCourseIndexMatchesSQL(t *testing.T) {
+	db, err := GetDB(false)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Skipf("database is not available: %v", err)
+	}
+
+	idx := NewCourseIndex()
+	if err := idx.Rebuild(db); err != nil {
+		t.Fatal(err)
+	}
+	var courses []*GetCourseDetailResponse
+	for _, course := range idx.courses {
+		courses = append(courses, course)
+	}
+	if len(courses) == 0 {
+		t.Skip("no courses in database")
+	}
+
+	r := rand.New(rand.NewSource(1))
+	const limit = 20
+	for i := 0; i < 200; i++ {
+		param := randomSearchParam(r, courses)
+		params := param.toParams()
+		// LIKE のワイルドカードを含むキーワードはSQLと索引で意味が異なるため対象外とする
+		if param.Keywords != nil && strings.ContainsAny(strings.Join(param.Keywords, ""), `%_\`) {
+			continue
+		}
+
+		p := Pagination{}
+		for {
+			expected, expectedHasMore, err := searchCoursesSQL(db, params, p, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, hasMore := idx.Search(params, p, limit)
+			if !equalCodes(codesOf(pointers(actual)), codesOf(pointers(expected))) || hasMore != expectedHasMore {
+				t.Fatalf("search %+v (%+v)\n got: %v (hasMore=%v)\nwant: %v (hasMore=%v)", param, p, codesOf(pointers(actual)), hasMore, codesOf(pointers(expected)), expectedHasMore)
+			}
+			if !hasMore || len(actual) == 0 {
+				break
+			}
+			p = Pagination{Direction: CursorNext, Key: actual[len(actual)-1].Code}
+		}
+	}
+}
+
+func pointers(courses []GetCourseDetailResponse) []*GetCourseDetailResponse {
+	res := make([]*GetCourseDetailResponse, 0, len(courses))
+	for i := range courses {
+		res = append(res, &courses[i])
+	}
+	return res
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// courseSearchFilter は科目検索の絞り込み条件
+// facet はこの条件が絞り込むファセットの名前で、ファセットに対応しない条件は空文字列
+type courseSearchFilter struct {
+	facet     string
+	condition string
+	args      []interface{}
+}
+
+// courseSearchWhere は except のファセット以外の絞り込み条件を連結する
+func courseSearchWhere(filters []courseSearchFilter, except string) (string, []interface{}) {
+	var condition string
+	var args []interface{}
+	for _, f := range filters {
+		if except != "" && f.facet == except {
+			continue
+		}
+		condition += f.condition
+		args = append(args, f.args...)
+	}
+	return condition, args
+}
+
+// multiValueQueryParam は name=a&name=b と name=a,b の両方の形式で指定された値を返す
+func multiValueQueryParam(c echo.Context, name string) []string {
+	var values []string
+	for _, param := range c.QueryParams()[name] {
+		for _, v := range strings.Split(param, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// courseSearchFilters はキーワード以外の検索条件をSQLの条件に変換する
+// partialTeacher が true の場合は担当教員名を部分一致で検索する
+func courseSearchFilters(params CourseSearchParams, partialTeacher bool) []courseSearchFilter {
+	var filters []courseSearchFilter
+
+	if params.Type != "" {
+		filters = append(filters, courseSearchFilter{"type", " AND `courses`.`type` = ?", []interface{}{params.Type}})
+	}
+
+	if params.Credit > 0 {
+		filters = append(filters, courseSearchFilter{"credit", " AND `courses`.`credit` = ?", []interface{}{params.Credit}})
+	}
+
+	if params.Teacher != "" {
+		if partialTeacher {
+			filters = append(filters, courseSearchFilter{"", " AND `users`.`name` LIKE ?", []interface{}{"%" + escapeLike(params.Teacher) + "%"}})
+		} else {
+			filters = append(filters, courseSearchFilter{"", " AND `users`.`name` = ?", []interface{}{params.Teacher}})
+		}
+	}
+
+	if len(params.Periods) > 0 {
+		var periods []interface{}
+		for _, period := range params.Periods {
+			periods = append(periods, period)
+		}
+		filters = append(filters, courseSearchFilter{"period", " AND `courses`.`period` IN (" + placeholders(len(periods)) + ")", periods})
+	}
+
+	if len(params.DaysOfWeek) > 0 {
+		var days []interface{}
+		for _, day := range params.DaysOfWeek {
+			days = append(days, day)
+		}
+		filters = append(filters, courseSearchFilter{"day_of_week", " AND `courses`.`day_of_week` IN (" + placeholders(len(days)) + ")", days})
+	}
+
+	if params.Status != "" {
+		filters = append(filters, courseSearchFilter{"", " AND `courses`.`status` = ?", []interface{}{params.Status}})
+	}
+
+	return filters
+}
+
+// searchCoursesSQL は CourseIndex.Search と同じ検索をSQLで行う
+// 索引の結果が正しいことを確かめるための基準の実装として残している
+func searchCoursesSQL(db sqlx.Queryer, params CourseSearchParams, p Pagination, limit int) ([]GetCourseDetailResponse, bool, error) {
+	query := "SELECT `courses`.*, `users`.`name` AS `teacher`" +
+		" FROM `courses` JOIN `users` ON `courses`.`teacher_id` = `users`.`id`" +
+		" WHERE 1=1"
+	condition, args := courseSearchWhere(courseSearchFilters(params, false), "")
+
+	if params.Keywords != nil {
+		var nameCondition string
+		for _, keyword := range params.Keywords {
+			nameCondition += " AND `courses`.`name` LIKE ?"
+			args = append(args, "%"+keyword+"%")
+		}
+		var keywordsCondition string
+		for _, keyword := range params.Keywords {
+			keywordsCondition += " AND `courses`.`keywords` LIKE ?"
+			args = append(args, "%"+keyword+"%")
+		}
+		condition += fmt.Sprintf(" AND ((1=1%s) OR (1=1%s))", nameCondition, keywordsCondition)
+	}
+
+	// limitより多く上限を設定し、実際にlimitより多くレコードが取得できた場合は次のページが存在する
+	switch {
+	case p.Page > 0:
+		// page= による指定は非推奨だが互換性のために残している
+		condition += " ORDER BY `courses`.`code` LIMIT ? OFFSET ?"
+		args = append(args, limit+1, limit*(p.Page-1))
+	case p.Direction == CursorPrev:
+		condition += " AND `courses`.`code` < ? ORDER BY `courses`.`code` DESC LIMIT ?"
+		args = append(args, p.Key, limit+1)
+	case p.Direction == CursorNext:
+		condition += " AND `courses`.`code` > ? ORDER BY `courses`.`code` LIMIT ?"
+		args = append(args, p.Key, limit+1)
+	default:
+		condition += " ORDER BY `courses`.`code` LIMIT ?"
+		args = append(args, limit+1)
+	}
+
+	// 結果が0件の時は空配列を返却
+	res := make([]GetCourseDetailResponse, 0)
+	if err := sqlx.Select(db, &res, query+condition, args...); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(res) > limit
+	if hasMore {
+		res = res[:limit]
+	}
+	if p.Direction == CursorPrev {
+		for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+			res[i], res[j] = res[j], res[i]
+		}
+	}
+	return res, hasMore, nil
+}
+
+type CourseSearchFacets struct {
+	Type      map[CourseType]int `json:"type"`
+	Credit    map[uint8]int      `json:"credit"`
+	DayOfWeek map[DayOfWeek]int  `json:"day_of_week"`
+}
+
+type SearchCoursesRankedResponse struct {
+	Courses []GetCourseDetailResponse `json:"courses"`
+	Total   int                       `json:"total"`
+	// Facets は各ファセット自身の絞り込み条件を除いた件数で、選択中の値以外の候補も表示できる
+	Facets CourseSearchFacets `json:"facets"`
+}
+
+// courseSearchSorts は sort= で指定できる並び順
+var courseSearchSorts = map[string]string{
+	"relevance": "`score` DESC, `courses`.`code`",
+	"code":      "`courses`.`code`",
+	"name":      "`courses`.`name`, `courses`.`code`",
+	"credit":    "`courses`.`credit` DESC, `courses`.`code`",
+}
+
+// searchCoursesRanked はキーワードをn-gramの全文検索で照合し、関連度順に科目を検索する
+// 担当教員名は部分一致で、曜日と時限は複数指定できる
+// 並び順を変えられるため、cursor のキーは科目コードではなく結果の先頭からの位置とする
+func (h *handlers) searchCoursesRanked(c echo.Context) error {
+	from := " FROM `courses` JOIN `users` ON `courses`.`teacher_id` = `users`.`id` WHERE 1=1"
+	filters := courseSearchFilters(parseCourseSearchParams(c), true)
+
+	score := "0"
+	var scoreArgs []interface{}
+	sortKey := c.QueryParam("sort")
+	if keywords := strings.TrimSpace(c.QueryParam("keywords")); keywords != "" {
+		score = "MATCH(`courses`.`name`, `courses`.`keywords`) AGAINST(? IN NATURAL LANGUAGE MODE)"
+		scoreArgs = []interface{}{keywords}
+		filters = append(filters, courseSearchFilter{"", " AND MATCH(`courses`.`name`, `courses`.`keywords`) AGAINST(? IN NATURAL LANGUAGE MODE)", []interface{}{keywords}})
+		if sortKey == "" {
+			sortKey = "relevance"
+		}
+	}
+	orderBy, ok := courseSearchSorts[sortKey]
+	if !ok {
+		orderBy = courseSearchSorts["code"]
+	}
+
+	p, err := parsePagination(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid page.")
+	}
+	limit := 20
+	offset := 0
+	switch {
+	case p.Page > 0:
+		offset = limit * (p.Page - 1)
+	case p.Direction != "":
+		key, err := strconv.Atoi(p.Key)
+		if err != nil || key < 0 {
+			return c.String(http.StatusBadRequest, "Invalid page.")
+		}
+		offset = key
+		if p.Direction == CursorPrev {
+			offset = key - limit
+			if offset < 0 {
+				offset = 0
+			}
+		}
+	}
+
+	condition, args := courseSearchWhere(filters, "")
+	query := "SELECT `courses`.*, `users`.`name` AS `teacher`, " + score + " AS `score`" + from + condition +
+		" ORDER BY " + orderBy + " LIMIT ? OFFSET ?"
+	var rows []struct {
+		GetCourseDetailResponse
+		Score float64 `db:"score"`
+	}
+	if err := h.DB.Select(&rows, query, append(append(scoreArgs, args...), limit, offset)...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := SearchCoursesRankedResponse{
+		Courses: make([]GetCourseDetailResponse, 0, len(rows)),
+		Facets: CourseSearchFacets{
+			Type:      make(map[CourseType]int),
+			Credit:    make(map[uint8]int),
+			DayOfWeek: make(map[DayOfWeek]int),
+		},
+	}
+	for _, row := range rows {
+		res.Courses = append(res.Courses, row.GetCourseDetailResponse)
+	}
+	if err := h.DB.Get(&res.Total, "SELECT COUNT(*)"+from+condition, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	facetQueries := []struct {
+		facet  string
+		column string
+		add    func(value string, count int)
+	}{
+		{"type", "`courses`.`type`", func(v string, n int) { res.Facets.Type[CourseType(v)] = n }},
+		{"credit", "`courses`.`credit`", func(v string, n int) {
+			if credit, err := strconv.Atoi(v); err == nil {
+				res.Facets.Credit[uint8(credit)] = n
+			}
+		}},
+		{"day_of_week", "`courses`.`day_of_week`", func(v string, n int) { res.Facets.DayOfWeek[DayOfWeek(v)] = n }},
+	}
+	for _, fq := range facetQueries {
+		facetCondition, facetArgs := courseSearchWhere(filters, fq.facet)
+		var counts []struct {
+			Value string `db:"value"`
+			Count int    `db:"count"`
+		}
+		if err := h.DB.Select(&counts, "SELECT "+fq.column+" AS `value`, COUNT(*) AS `count`"+from+facetCondition+" GROUP BY "+fq.column, facetArgs...); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		for _, count := range counts {
+			fq.add(count.Value, count.Count)
+		}
+	}
+
+	// 取得方向にまだ続きがあるかどうか
+	hasMore := offset+len(res.Courses) < res.Total
+	if p.Direction == CursorPrev {
+		hasMore = offset > 0
+	}
+	var firstKey, lastKey string
+	if len(res.Courses) > 0 {
+		firstKey, lastKey = strconv.Itoa(offset), strconv.Itoa(offset+len(res.Courses))
+	}
+	link, err := pagingLinkHeader(c, p, hasMore, firstKey, lastKey)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if link != "" {
+		c.Response().Header().Set("Link", link)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type CourseStaffResponse struct {
+	Code string     `json:"code" db:"code"`
+	Name string     `json:"name" db:"name"`
+	Role CourseRole `json:"role" db:"role"`
+}
+
+// GetCourseStaff GET /api/courses/:courseID/staff 科目の担当者(TA等)一覧の取得
+func (h *handlers) GetCourseStaff(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	var count int
+	if err := h.DB.Get(&count, "SELECT COUNT(*) FROM `courses` WHERE `id` = ?", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+
+	// 担当者が0人の時は空配列を返却
+	res := make([]CourseStaffResponse, 0)
+	query := "SELECT `users`.`code`, `users`.`name`, `course_staff`.`role`" +
+		" FROM `course_staff`" +
+		" JOIN `users` ON `users`.`id` = `course_staff`.`user_id`" +
+		" WHERE `course_staff`.`course_id` = ?" +
+		" ORDER BY `users`.`code`"
+	if err := h.DB.Select(&res, query, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+type AddCourseStaffRequest struct {
+	Role CourseRole `json:"role"`
+}
+
+// AddCourseStaff PUT /api/courses/:courseID/staff/:userCode 科目の担当者(TA等)の追加
+func (h *handlers) AddCourseStaff(c echo.Context) error {
+	courseID := c.Param("courseID")
+	userCode := c.Param("userCode")
+
+	var req AddCourseStaffRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if !isStaffRole(req.Role) {
+		return c.String(http.StatusBadRequest, "Invalid role.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var course Course
+	if err := tx.Get(&course, "SELECT * FROM `courses` WHERE `id` = ? FOR SHARE", courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+
+	var user User
+	if err := tx.Get(&user, "SELECT * FROM `users` WHERE `code` = ?", userCode); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such user.")
+	}
+	// 学生は他の学生の提出物を見られないよう担当者にはできない
+	if user.Type != TeachingAssistant && user.Type != Teacher {
+		return c.String(http.StatusBadRequest, "This user cannot be a course staff.")
+	}
+	if user.ID == course.TeacherID {
+		return c.String(http.StatusBadRequest, "This user is the teacher of this course.")
+	}
+
+	if _, err := tx.Exec("INSERT INTO `course_staff` (`course_id`, `user_id`, `role`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `role` = VALUES(`role`)", courseID, user.ID, req.Role); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// RemoveCourseStaff DELETE /api/courses/:courseID/staff/:userCode 科目の担当者(TA等)の削除
+func (h *handlers) RemoveCourseStaff(c echo.Context) error {
+	courseID := c.Param("courseID")
+	userCode := c.Param("userCode")
+
+	query := "DELETE `course_staff` FROM `course_staff`" +
+		" JOIN `users` ON `users`.`id` = `course_staff`.`user_id`" +
+		" WHERE `course_staff`.`course_id` = ? AND `users`.`code` = ?"
+	result, err := h.DB.Exec(query, courseID, userCode)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if n == 0 {
+		return c.String(http.StatusNotFound, "No such course staff.")
+	}
+
+	return c.NoContent(http.StatusOK)
+}
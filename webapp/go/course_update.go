@@ -0,0 +1,393 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+var dayOfWeekLabels = map[DayOfWeek]string{
+	Monday:    "月曜",
+	Tuesday:   "火曜",
+	Wednesday: "水曜",
+	Thursday:  "木曜",
+	Friday:    "金曜",
+}
+
+// scheduleLabel は「月曜1限」の形式で曜日・時限を表す
+func scheduleLabel(dayOfWeek DayOfWeek, period uint8) string {
+	return fmt.Sprintf("%s%d限", dayOfWeekLabels[dayOfWeek], period)
+}
+
+// validateCourseCode は科目コードが空でなく、courses.code (VARCHAR(255)) に収まることを検証する
+func validateCourseCode(code string) error {
+	if code == "" {
+		return errors.New("code is empty")
+	}
+	if utf8.RuneCountInString(code) > 255 {
+		return errors.New("code is too long")
+	}
+	return nil
+}
+
+// validateCredit は単位数が1以上で courses.credit (TINYINT UNSIGNED) に収まることを検証する
+func validateCredit(credit int) error {
+	if credit < 1 || credit > math.MaxUint8 {
+		return fmt.Errorf("credit must be between 1 and %d", math.MaxUint8)
+	}
+	return nil
+}
+
+// findScheduleConflicts は科目を履修している学生毎に、同じ曜日・時限の(修了していない)他の履修科目を取得する
+func findScheduleConflicts(q sqlx.Queryer, course *Course) (map[string][]Course, error) {
+	var rows []struct {
+		UserID string `db:"user_id"`
+		Course
+	}
+	query := "SELECT `r1`.`user_id`, `courses`.*" +
+		" FROM `registrations` AS `r1`" +
+		" JOIN `registrations` AS `r2` ON `r2`.`user_id` = `r1`.`user_id` AND `r2`.`course_id` != `r1`.`course_id`" +
+		" JOIN `courses` ON `courses`.`id` = `r2`.`course_id`" +
+		" WHERE `r1`.`course_id` = ? AND `courses`.`status` != ? AND `courses`.`period` = ? AND `courses`.`day_of_week` = ?" +
+		" ORDER BY `r1`.`user_id`, `courses`.`code`"
+	if err := sqlx.Select(q, &rows, query, course.ID, StatusClosed, course.Period, course.DayOfWeek); err != nil {
+		return nil, err
+	}
+	conflicts := make(map[string][]Course)
+	for _, row := range rows {
+		conflicts[row.UserID] = append(conflicts[row.UserID], row.Course)
+	}
+	return conflicts, nil
+}
+
+// notifyScheduleConflicts は曜日・時限の変更で時間割が重複した学生に、重複した科目を知らせるお知らせを学生毎に送る
+func notifyScheduleConflicts(tx sqlx.Execer, course *Course, old *Course, conflicts map[string][]Course) error {
+	title := fmt.Sprintf("時間割の変更: %s", course.Name)
+	for userID, courses := range conflicts {
+		names := make([]string, 0, len(courses))
+		for _, c := range courses {
+			names = append(names, fmt.Sprintf("%s (%s)", c.Name, c.Code))
+		}
+		message := fmt.Sprintf("%s (%s) の時間割が %s から %s に変更され、履修中の次の科目と重複しています。履修登録を見直してください。\n%s",
+			course.Name, course.Code, scheduleLabel(old.DayOfWeek, old.Period), scheduleLabel(course.DayOfWeek, course.Period), strings.Join(names, "\n"))
+
+		announcementID := newULID()
+		if _, err := tx.Exec("INSERT INTO `announcements` (`id`, `course_id`, `title`, `message`) VALUES (?, ?, ?, ?)",
+			announcementID, course.ID, title, message); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO `unread_announcements` (`announcement_id`, `user_id`) VALUES (?, ?)", announcementID, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteClassRecords は講義と、講義に紐づく出席確認・講義資料・集計値の行を削除し、削除した講義資料のファイルのパスを返す
+// 課題の提出がある講義は削除しないので、submissions と appeals は対象にしない
+func deleteClassRecords(tx sqlx.Ext, classID string) ([]string, error) {
+	var materialIDs []string
+	if err := sqlx.Select(tx, &materialIDs, "SELECT `id` FROM `class_materials` WHERE `class_id` = ? AND `kind` = ?", classID, MaterialFile); err != nil {
+		return nil, err
+	}
+	queries := []string{
+		"DELETE FROM `attendances` WHERE `class_id` = ?",
+		"DELETE FROM `attendance_sessions` WHERE `class_id` = ?",
+		"DELETE FROM `class_materials` WHERE `class_id` = ?",
+		"DELETE FROM `class_aggregates` WHERE `class_id` = ?",
+		"DELETE FROM `classes` WHERE `id` = ?",
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, classID); err != nil {
+			return nil, err
+		}
+	}
+	paths := make([]string, 0, len(materialIDs))
+	for _, id := range materialIDs {
+		paths = append(paths, classMaterialPath(id))
+	}
+	return paths, nil
+}
+
+// removeFiles はファイルを削除する。既に存在しないファイルは無視する
+func removeFiles(paths []string) error {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+type UpdateCourseRequest struct {
+	// 省略した項目は変更しない
+	Type        *CourseType `json:"type"`
+	Name        *string     `json:"name"`
+	Description *string     `json:"description"`
+	Credit      *int        `json:"credit"`
+	Period      *int        `json:"period"`
+	DayOfWeek   *DayOfWeek  `json:"day_of_week"`
+	Keywords    *string     `json:"keywords"`
+}
+
+// UpdateCourse PUT /api/courses/:courseID 科目情報の変更
+// 科目の種類・単位数・曜日・時限は履修登録期間中のみ変更でき、曜日・時限の変更で時間割が重複した学生にはお知らせで知らせる
+func (h *handlers) UpdateCourse(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	var req UpdateCourseRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if req.Type != nil && *req.Type != LiberalArts && *req.Type != MajorSubjects {
+		return c.String(http.StatusBadRequest, "Invalid course type.")
+	}
+	if req.DayOfWeek != nil && !contains(daysOfWeek, *req.DayOfWeek) {
+		return c.String(http.StatusBadRequest, "Invalid day of week.")
+	}
+	// uint8 に変換する前に、科目の追加と同じ範囲であることを検証する
+	if req.Credit != nil {
+		if err := validateCredit(*req.Credit); err != nil {
+			return c.String(http.StatusBadRequest, "Invalid credit.")
+		}
+	}
+	if req.Period != nil && !h.Timetable.HasPeriod(*req.Period) {
+		return c.String(http.StatusBadRequest, "Invalid period.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var course Course
+	if err := tx.Get(&course, "SELECT * FROM `courses` WHERE `id` = ? FOR UPDATE", courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+
+	updated := course
+	if req.Type != nil {
+		updated.Type = *req.Type
+	}
+	if req.Name != nil {
+		updated.Name = *req.Name
+	}
+	if req.Description != nil {
+		updated.Description = *req.Description
+	}
+	if req.Credit != nil {
+		updated.Credit = uint8(*req.Credit)
+	}
+	if req.Period != nil {
+		updated.Period = uint8(*req.Period)
+	}
+	if req.DayOfWeek != nil {
+		updated.DayOfWeek = *req.DayOfWeek
+	}
+	if req.Keywords != nil {
+		updated.Keywords = *req.Keywords
+	}
+
+	scheduleChanged := updated.Period != course.Period || updated.DayOfWeek != course.DayOfWeek
+	if course.Status != StatusRegistration && (scheduleChanged || updated.Type != course.Type || updated.Credit != course.Credit) {
+		return c.String(http.StatusBadRequest, "The type, credit and schedule of a course can only be changed during registration.")
+	}
+
+	if _, err := tx.Exec("UPDATE `courses` SET `type` = ?, `name` = ?, `description` = ?, `credit` = ?, `period` = ?, `day_of_week` = ?, `keywords` = ? WHERE `id` = ?",
+		updated.Type, updated.Name, updated.Description, updated.Credit, updated.Period, updated.DayOfWeek, updated.Keywords, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if scheduleChanged {
+		conflicts, err := findScheduleConflicts(tx, &updated)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if err := notifyScheduleConflicts(tx, &updated, &course, conflicts); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	var res GetCourseDetailResponse
+	query := "SELECT `courses`.*, `users`.`name` AS `teacher`" +
+		" FROM `courses` JOIN `users` ON `courses`.`teacher_id` = `users`.`id`" +
+		" WHERE `courses`.`id` = ?"
+	if err := tx.Get(&res, query, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	h.CourseIndex.Add(res)
+
+	return c.JSON(http.StatusOK, res)
+}
+
+type UpdateClassRequest struct {
+	// 省略した項目は変更しない
+	Part        *uint8  `json:"part"`
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+}
+
+// UpdateClass PUT /api/courses/:courseID/classes/:classID 講義情報の変更
+// 講義の回は講義の重みが変わるので、課題の提出がなく、修了していない科目の講義のみ変更できる
+func (h *handlers) UpdateClass(c echo.Context) error {
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+
+	var req UpdateClassRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var class Class
+	if err := tx.Get(&class, "SELECT * FROM `classes` WHERE `id` = ? AND `course_id` = ? FOR UPDATE", classID, courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such class.")
+	}
+
+	updated := class
+	if req.Part != nil {
+		updated.Part = *req.Part
+	}
+	if req.Title != nil {
+		updated.Title = *req.Title
+	}
+	if req.Description != nil {
+		updated.Description = *req.Description
+	}
+
+	if updated.Part != class.Part {
+		var status CourseStatus
+		if err := tx.Get(&status, "SELECT `status` FROM `courses` WHERE `id` = ? FOR SHARE", courseID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if status == StatusClosed {
+			return c.String(http.StatusBadRequest, "The part of a class in a closed course cannot be changed.")
+		}
+		var submissionsCount int
+		if err := tx.Get(&submissionsCount, "SELECT COUNT(*) FROM `submissions` WHERE `class_id` = ?", classID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if submissionsCount > 0 {
+			return c.String(http.StatusBadRequest, "The part of a class with submissions cannot be changed.")
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE `classes` SET `part` = ?, `title` = ?, `description` = ? WHERE `id` = ?",
+		updated.Part, updated.Title, updated.Description, classID); err != nil {
+		if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
+			return c.String(http.StatusConflict, "A class with the same part already exists.")
+		}
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// DeleteClass DELETE /api/courses/:courseID/classes/:classID 講義の削除
+// 課題の提出がある講義と、修了済みの科目の講義は削除できない。講義の出席確認と講義資料も削除する
+func (h *handlers) DeleteClass(c echo.Context) error {
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var class Class
+	if err := tx.Get(&class, "SELECT * FROM `classes` WHERE `id` = ? AND `course_id` = ? FOR UPDATE", classID, courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such class.")
+	}
+
+	var status CourseStatus
+	if err := tx.Get(&status, "SELECT `status` FROM `courses` WHERE `id` = ? FOR SHARE", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if status == StatusClosed {
+		return c.String(http.StatusBadRequest, "Classes of a closed course cannot be deleted.")
+	}
+
+	var submissionsCount int
+	if err := tx.Get(&submissionsCount, "SELECT COUNT(*) FROM `submissions` WHERE `class_id` = ?", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if submissionsCount > 0 {
+		return c.String(http.StatusBadRequest, "A class with submissions cannot be deleted.")
+	}
+
+	var attendancesCount int
+	if err := tx.Get(&attendancesCount, "SELECT COUNT(*) FROM `attendances` WHERE `class_id` = ?", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	materialPaths, err := deleteClassRecords(tx, classID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 出席点が合計点から外れるので合計点を作り直す
+	if attendancesCount > 0 {
+		if err := rebuildCourseScoreTotals(tx, courseID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 講義資料のファイルが残っても参照されないので、削除に失敗しても講義の削除は成功とする
+	if err := removeFiles(materialPaths); err != nil {
+		c.Logger().Error(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
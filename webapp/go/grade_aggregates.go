@@ -0,0 +1,376 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 成績の集計値
+//   class_aggregates:     講義毎の課題提出者数
+//   course_score_totals:  学生毎・科目毎の合計点(点数を公開した講義の、重みを掛けた点数と出席点の和)。行がない場合は0点
+//   user_gpa_aggregates:  学生毎の修了済み科目の単位数、GPAに含める単位数、グレードポイント(1/100単位)*単位数 の総和
+// いずれも submissions, attendances, registrations, courses と成績評価の方針から導出できる値で、更新するトランザクションの中で差分を反映する
+
+// addSubmitter は講義の課題提出者数を1増やす
+func addSubmitter(tx sqlx.Execer, classID string) error {
+	_, err := tx.Exec("INSERT INTO `class_aggregates` (`class_id`, `submitters`) VALUES (?, 1) ON DUPLICATE KEY UPDATE `submitters` = `submitters` + 1", classID)
+	return err
+}
+
+// addCourseScore は学生の科目の合計点に delta を加える
+// 科目が修了済みの場合は、グレードポイントの変化をGPAの集計値にも反映する
+func addCourseScore(tx *sqlx.Tx, course *Course, policy *GradingPolicy, maxScore CourseMaxScore, userID string, delta int) error {
+	if delta == 0 {
+		return nil
+	}
+
+	var oldTotal int
+	if course.Status == StatusClosed {
+		if err := tx.Get(&oldTotal, "SELECT `total_score` FROM `course_score_totals` WHERE `course_id` = ? AND `user_id` = ? FOR UPDATE", course.ID, userID); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO `course_score_totals` (`course_id`, `user_id`, `total_score`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `total_score` = `total_score` + VALUES(`total_score`)",
+		course.ID, userID, delta); err != nil {
+		return err
+	}
+	if course.Status != StatusClosed {
+		return nil
+	}
+
+	_, oldPoints, countsForGPA := policy.Grade(oldTotal, maxScore)
+	_, newPoints, _ := policy.Grade(oldTotal+delta, maxScore)
+	if !countsForGPA || oldPoints == newPoints {
+		return nil
+	}
+	_, err := tx.Exec("UPDATE `user_gpa_aggregates` SET `weighted_score` = `weighted_score` + ? WHERE `user_id` = ?", (newPoints-oldPoints)*int(course.Credit), userID)
+	return err
+}
+
+// userGPAAggregate は user_gpa_aggregates の1行
+type userGPAAggregate struct {
+	UserID        string `db:"user_id"`
+	Credits       int    `db:"credits"`
+	GPACredits    int    `db:"gpa_credits"`
+	WeightedScore int64  `db:"weighted_score"`
+}
+
+// add は科目の成績を sign の符号で集計値に加える
+func (a *userGPAAggregate) add(course *Course, policy *GradingPolicy, maxScore CourseMaxScore, totalScore int, sign int) {
+	_, points, countsForGPA := policy.Grade(totalScore, maxScore)
+	a.Credits += sign * int(course.Credit)
+	if countsForGPA {
+		a.GPACredits += sign * int(course.Credit)
+		a.WeightedScore += int64(sign * points * int(course.Credit))
+	}
+}
+
+// upsertUserGPAAggregates は user_gpa_aggregates に差分を加える
+func upsertUserGPAAggregates(tx sqlx.Execer, aggregates []userGPAAggregate) error {
+	const chunkSize = 1000
+	for len(aggregates) > 0 {
+		chunk := aggregates
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		aggregates = aggregates[len(chunk):]
+
+		query := "INSERT INTO `user_gpa_aggregates` (`user_id`, `credits`, `gpa_credits`, `weighted_score`) VALUES "
+		args := make([]interface{}, 0, len(chunk)*4)
+		for i, a := range chunk {
+			if i > 0 {
+				query += ", "
+			}
+			query += "(?, ?, ?, ?)"
+			args = append(args, a.UserID, a.Credits, a.GPACredits, a.WeightedScore)
+		}
+		query += " ON DUPLICATE KEY UPDATE `credits` = `credits` + VALUES(`credits`), `gpa_credits` = `gpa_credits` + VALUES(`gpa_credits`), `weighted_score` = `weighted_score` + VALUES(`weighted_score`)"
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeCourseGPA は科目の修了(sign = 1)・修了の取り消し(sign = -1)を履修者のGPAの集計値に反映する
+func closeCourseGPA(tx *sqlx.Tx, course *Course, sign int) error {
+	policy, err := loadGradingPolicy(tx, course.ID)
+	if err != nil {
+		return err
+	}
+	maxScore, err := loadMaxScore(tx, course.ID, policy)
+	if err != nil {
+		return err
+	}
+
+	var totals []struct {
+		UserID     string `db:"user_id"`
+		TotalScore int    `db:"total_score"`
+	}
+	query := "SELECT `registrations`.`user_id`, IFNULL(`course_score_totals`.`total_score`, 0) AS `total_score`" +
+		" FROM `registrations`" +
+		" LEFT JOIN `course_score_totals` ON `course_score_totals`.`course_id` = `registrations`.`course_id` AND `course_score_totals`.`user_id` = `registrations`.`user_id`" +
+		" WHERE `registrations`.`course_id` = ?" +
+		" ORDER BY `registrations`.`user_id`"
+	if err := tx.Select(&totals, query, course.ID); err != nil {
+		return err
+	}
+
+	aggregates := make([]userGPAAggregate, 0, len(totals))
+	for _, total := range totals {
+		a := userGPAAggregate{UserID: total.UserID}
+		a.add(course, policy, maxScore, total.TotalScore, sign)
+		aggregates = append(aggregates, a)
+	}
+	return upsertUserGPAAggregates(tx, aggregates)
+}
+
+// courseScorePointsQuery は合計点を構成する点数を (course_id, user_id, points) の行として返すサブクエリ
+// 点数を公開した講義の重みを掛けた点数と、出席点からなる。プレースホルダには講義の重みのデフォルト値を渡す
+const courseScorePointsQuery = "SELECT `classes`.`course_id`, `submissions`.`user_id`, `submissions`.`score` * IFNULL(`grading_weights`.`weight`, ?) AS `points`" +
+	" FROM `submissions`" +
+	" JOIN `classes` ON `classes`.`id` = `submissions`.`class_id`" +
+	" LEFT JOIN `grading_weights` ON `grading_weights`.`course_id` = `classes`.`course_id` AND `grading_weights`.`part` = `classes`.`part`" +
+	" WHERE `classes`.`scores_published` = true AND `submissions`.`score` IS NOT NULL" +
+	" UNION ALL" +
+	" SELECT `classes`.`course_id`, `attendances`.`user_id`, `grading_policies`.`attendance_weight` AS `points`" +
+	" FROM `attendances`" +
+	" JOIN `classes` ON `classes`.`id` = `attendances`.`class_id`" +
+	" JOIN `grading_policies` ON `grading_policies`.`course_id` = `classes`.`course_id`" +
+	" WHERE `grading_policies`.`attendance_weight` > 0"
+
+// rebuildCourseScoreTotals は科目の合計点を submissions, attendances から作り直す
+// 講義の重みや出席点を変更した場合に利用する
+func rebuildCourseScoreTotals(tx sqlx.Execer, courseID string) error {
+	if _, err := tx.Exec("DELETE FROM `course_score_totals` WHERE `course_id` = ?", courseID); err != nil {
+		return err
+	}
+	query := "INSERT INTO `course_score_totals` (`course_id`, `user_id`, `total_score`)" +
+		" SELECT `course_id`, `user_id`, SUM(`points`) FROM (" + courseScorePointsQuery + ") AS `p`" +
+		" WHERE `course_id` = ?" +
+		" GROUP BY `course_id`, `user_id`"
+	_, err := tx.Exec(query, defaultClassWeight, courseID)
+	return err
+}
+
+// rebuildGradeAggregates は成績の集計値を submissions, attendances, registrations, courses と成績評価の方針から作り直す
+func rebuildGradeAggregates(tx *sqlx.Tx) error {
+	queries := []string{
+		"DELETE FROM `user_gpa_aggregates`",
+		"DELETE FROM `course_score_totals`",
+		"DELETE FROM `class_aggregates`",
+		"INSERT INTO `class_aggregates` (`class_id`, `submitters`)" +
+			" SELECT `class_id`, COUNT(*) FROM `submissions` GROUP BY `class_id`",
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	query := "INSERT INTO `course_score_totals` (`course_id`, `user_id`, `total_score`)" +
+		" SELECT `course_id`, `user_id`, SUM(`points`) FROM (" + courseScorePointsQuery + ") AS `p`" +
+		" GROUP BY `course_id`, `user_id`"
+	if _, err := tx.Exec(query, defaultClassWeight); err != nil {
+		return err
+	}
+
+	aggregates, err := expectedUserGPAAggregates(tx)
+	if err != nil {
+		return err
+	}
+	return upsertUserGPAAggregates(tx, aggregates)
+}
+
+// expectedUserGPAAggregates は user_gpa_aggregates のあるべき値を submissions, attendances から計算する
+func expectedUserGPAAggregates(q sqlx.Queryer) ([]userGPAAggregate, error) {
+	var closedCourses []Course
+	if err := sqlx.Select(q, &closedCourses, "SELECT * FROM `courses` WHERE `status` = ?", StatusClosed); err != nil {
+		return nil, err
+	}
+	courses := make(map[string]*Course, len(closedCourses))
+	courseIDs := make([]string, 0, len(closedCourses))
+	for i := range closedCourses {
+		courses[closedCourses[i].ID] = &closedCourses[i]
+		courseIDs = append(courseIDs, closedCourses[i].ID)
+	}
+	policies, err := loadGradingPolicies(q, courseIDs)
+	if err != nil {
+		return nil, err
+	}
+	maxScores, err := loadMaxScores(q, policies)
+	if err != nil {
+		return nil, err
+	}
+
+	// 修了済みの科目の履修者毎の合計点
+	var totals []struct {
+		CourseID   string `db:"course_id"`
+		UserID     string `db:"user_id"`
+		TotalScore int    `db:"total_score"`
+	}
+	query := "SELECT `registrations`.`course_id`, `registrations`.`user_id`, IFNULL(SUM(`p`.`points`), 0) AS `total_score`" +
+		" FROM `registrations`" +
+		" JOIN `courses` ON `registrations`.`course_id` = `courses`.`id` AND `courses`.`status` = ?" +
+		" LEFT JOIN (" + courseScorePointsQuery + ") AS `p` ON `p`.`course_id` = `registrations`.`course_id` AND `p`.`user_id` = `registrations`.`user_id`" +
+		" GROUP BY `registrations`.`course_id`, `registrations`.`user_id`"
+	if err := sqlx.Select(q, &totals, query, StatusClosed, defaultClassWeight); err != nil {
+		return nil, err
+	}
+
+	byUser := make(map[string]*userGPAAggregate)
+	for _, total := range totals {
+		a, ok := byUser[total.UserID]
+		if !ok {
+			a = &userGPAAggregate{UserID: total.UserID}
+			byUser[total.UserID] = a
+		}
+		course := courses[total.CourseID]
+		policy := policies[total.CourseID]
+		a.add(course, policy, maxScores[total.CourseID], total.TotalScore, 1)
+	}
+
+	aggregates := make([]userGPAAggregate, 0, len(byUser))
+	for _, a := range byUser {
+		aggregates = append(aggregates, *a)
+	}
+	sort.Slice(aggregates, func(i, j int) bool {
+		return aggregates[i].UserID < aggregates[j].UserID
+	})
+	return aggregates, nil
+}
+
+// GradeAggregateMismatch は集計値と元のテーブルから計算した値の食い違い
+type GradeAggregateMismatch struct {
+	Table    string `json:"table" db:"table_name"`
+	Column   string `json:"column" db:"column_name"`
+	Key      string `json:"key" db:"key"`
+	Expected int64  `json:"expected" db:"expected"`
+	Actual   int64  `json:"actual" db:"actual"`
+}
+
+// checkGradeAggregates は成績の集計値を、submissions などから直接計算した値と比較する
+func checkGradeAggregates(db sqlx.Queryer) ([]GradeAggregateMismatch, error) {
+	mismatches := make([]GradeAggregateMismatch, 0)
+
+	// 講義毎の課題提出者数
+	var submitters []GradeAggregateMismatch
+	query := "SELECT 'class_aggregates' AS `table_name`, 'submitters' AS `column_name`, `classes`.`id` AS `key`," +
+		" COUNT(`submissions`.`user_id`) AS `expected`, IFNULL(MAX(`class_aggregates`.`submitters`), 0) AS `actual`" +
+		" FROM `classes`" +
+		" LEFT JOIN `submissions` ON `submissions`.`class_id` = `classes`.`id`" +
+		" LEFT JOIN `class_aggregates` ON `class_aggregates`.`class_id` = `classes`.`id`" +
+		" GROUP BY `classes`.`id`" +
+		" HAVING `expected` <> `actual`"
+	if err := sqlx.Select(db, &submitters, query); err != nil {
+		return nil, err
+	}
+	mismatches = append(mismatches, submitters...)
+
+	// 学生毎・科目毎の合計点
+	var totals []GradeAggregateMismatch
+	query = "SELECT 'course_score_totals' AS `table_name`, 'total_score' AS `column_name`, CONCAT(`registrations`.`course_id`, '/', `registrations`.`user_id`) AS `key`," +
+		" IFNULL(SUM(`p`.`points`), 0) AS `expected`, IFNULL(MAX(`course_score_totals`.`total_score`), 0) AS `actual`" +
+		" FROM `registrations`" +
+		" LEFT JOIN (" + courseScorePointsQuery + ") AS `p` ON `p`.`course_id` = `registrations`.`course_id` AND `p`.`user_id` = `registrations`.`user_id`" +
+		" LEFT JOIN `course_score_totals` ON `course_score_totals`.`course_id` = `registrations`.`course_id` AND `course_score_totals`.`user_id` = `registrations`.`user_id`" +
+		" GROUP BY `registrations`.`course_id`, `registrations`.`user_id`" +
+		" HAVING `expected` <> `actual`"
+	if err := sqlx.Select(db, &totals, query, defaultClassWeight); err != nil {
+		return nil, err
+	}
+	mismatches = append(mismatches, totals...)
+
+	// 学生毎の単位数とグレードポイント
+	expected, err := expectedUserGPAAggregates(db)
+	if err != nil {
+		return nil, err
+	}
+	var actual []userGPAAggregate
+	if err := sqlx.Select(db, &actual, "SELECT * FROM `user_gpa_aggregates` ORDER BY `user_id`"); err != nil {
+		return nil, err
+	}
+	actualByUser := make(map[string]userGPAAggregate, len(actual))
+	for _, a := range actual {
+		actualByUser[a.UserID] = a
+	}
+	compare := func(userID string, e userGPAAggregate, a userGPAAggregate) {
+		columns := []struct {
+			name     string
+			expected int64
+			actual   int64
+		}{
+			{"credits", int64(e.Credits), int64(a.Credits)},
+			{"gpa_credits", int64(e.GPACredits), int64(a.GPACredits)},
+			{"weighted_score", e.WeightedScore, a.WeightedScore},
+		}
+		for _, column := range columns {
+			if column.expected != column.actual {
+				mismatches = append(mismatches, GradeAggregateMismatch{
+					Table:    "user_gpa_aggregates",
+					Column:   column.name,
+					Key:      userID,
+					Expected: column.expected,
+					Actual:   column.actual,
+				})
+			}
+		}
+	}
+	for _, e := range expected {
+		compare(e.UserID, e, actualByUser[e.UserID])
+		delete(actualByUser, e.UserID)
+	}
+	// 修了済みの科目がない学生の集計値はすべて0になっているはず
+	for _, a := range actual {
+		if _, ok := actualByUser[a.UserID]; ok {
+			compare(a.UserID, userGPAAggregate{UserID: a.UserID}, a)
+		}
+	}
+
+	return mismatches, nil
+}
+
+type CheckGradeAggregatesResponse struct {
+	Consistent bool                     `json:"consistent"`
+	Mismatches []GradeAggregateMismatch `json:"mismatches"`
+}
+
+// CheckGradeAggregates GET /api/admin/grade-aggregates 成績の集計値の整合性チェック
+func (h *handlers) CheckGradeAggregates(c echo.Context) error {
+	mismatches, err := checkGradeAggregates(h.DB)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, CheckGradeAggregatesResponse{
+		Consistent: len(mismatches) == 0,
+		Mismatches: mismatches,
+	})
+}
+
+// RebuildGradeAggregates POST /api/admin/grade-aggregates/rebuild 成績の集計値の再計算
+func (h *handlers) RebuildGradeAggregates(c echo.Context) error {
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	if err := rebuildGradeAggregates(tx); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// GradingType は科目の成績評価の方式
+type GradingType string
+
+const (
+	// GradingScore は 合計点/100 をグレードポイントとする方式(デフォルト)
+	GradingScore GradingType = "score"
+	// GradingLetter は得点率に応じた評語(S/A/B/C/F)のグレードポイントを用いる方式
+	GradingLetter GradingType = "letter"
+	// GradingPassFail は合否のみを評価する方式。GPAの計算には含めない
+	GradingPassFail GradingType = "pass_fail"
+)
+
+type LetterGrade string
+
+const (
+	GradeS LetterGrade = "S"
+	GradeA LetterGrade = "A"
+	GradeB LetterGrade = "B"
+	GradeC LetterGrade = "C"
+	GradeF LetterGrade = "F"
+	// GradePass は合否評価の科目の合格
+	GradePass LetterGrade = "P"
+)
+
+var letterGrades = []LetterGrade{GradeS, GradeA, GradeB, GradeC, GradeF}
+
+const (
+	// defaultClassWeight は重みを指定していない講義の重み
+	defaultClassWeight = 1
+	defaultPassScore   = 60
+)
+
+type ClassWeight struct {
+	Part   uint8 `json:"part" db:"part"`
+	Weight uint8 `json:"weight" db:"weight"`
+}
+
+// LetterGradeThreshold は評語と、その評語になる最低の得点率(0~100)・グレードポイント
+type LetterGradeThreshold struct {
+	Grade      LetterGrade `json:"grade" db:"grade"`
+	MinScore   uint8       `json:"min_score" db:"min_score"`
+	GradePoint float64     `json:"grade_point" db:"grade_point"`
+}
+
+// GradingPolicy は科目の成績評価の方針
+// 合計点は講義毎の点数に講義の重みを掛けたものの和で、得点率は合計点の満点(100*重みの和)に対する割合
+// AttendanceWeight が0でない場合は、出席を取った講義1回につき AttendanceWeight 点を満点に加え、出席した学生の合計点に加点する
+// (得点率に出席率が反映される)
+type GradingPolicy struct {
+	Type         GradingType            `json:"type"`
+	ClassWeights []ClassWeight          `json:"class_weights"`
+	LetterGrades []LetterGradeThreshold `json:"letter_grades"`
+	// PassScore は合否評価の科目で合格となる最低の得点率
+	PassScore        uint8 `json:"pass_score"`
+	AttendanceWeight uint8 `json:"attendance_weight"`
+}
+
+func defaultLetterGrades() []LetterGradeThreshold {
+	return []LetterGradeThreshold{
+		{Grade: GradeS, MinScore: 90, GradePoint: 4},
+		{Grade: GradeA, MinScore: 80, GradePoint: 3},
+		{Grade: GradeB, MinScore: 70, GradePoint: 2},
+		{Grade: GradeC, MinScore: 60, GradePoint: 1},
+		{Grade: GradeF, MinScore: 0, GradePoint: 0},
+	}
+}
+
+func defaultGradingPolicy() *GradingPolicy {
+	return &GradingPolicy{
+		Type:         GradingScore,
+		ClassWeights: []ClassWeight{},
+		LetterGrades: defaultLetterGrades(),
+		PassScore:    defaultPassScore,
+	}
+}
+
+// normalize は省略された項目をデフォルト値で埋めて検証する
+func (p *GradingPolicy) normalize() error {
+	if p.Type == "" {
+		p.Type = GradingScore
+	}
+	if p.Type != GradingScore && p.Type != GradingLetter && p.Type != GradingPassFail {
+		return fmt.Errorf("invalid grading type: %q", p.Type)
+	}
+
+	if p.ClassWeights == nil {
+		p.ClassWeights = []ClassWeight{}
+	}
+	parts := make(map[uint8]bool, len(p.ClassWeights))
+	for _, w := range p.ClassWeights {
+		if parts[w.Part] {
+			return fmt.Errorf("duplicate weight for part %d", w.Part)
+		}
+		parts[w.Part] = true
+		if w.Weight == 0 || w.Weight > 100 {
+			return fmt.Errorf("weight for part %d must be between 1 and 100", w.Part)
+		}
+	}
+
+	if len(p.LetterGrades) == 0 {
+		p.LetterGrades = defaultLetterGrades()
+	}
+	if len(p.LetterGrades) != len(letterGrades) {
+		return errors.New("letter grades must be S, A, B, C and F")
+	}
+	for i, g := range p.LetterGrades {
+		if g.Grade != letterGrades[i] {
+			return errors.New("letter grades must be S, A, B, C and F in this order")
+		}
+		if g.MinScore > 100 || g.GradePoint < 0 || g.GradePoint > 4 {
+			return fmt.Errorf("invalid threshold for grade %s", g.Grade)
+		}
+		if i > 0 && (g.MinScore > p.LetterGrades[i-1].MinScore || g.GradePoint > p.LetterGrades[i-1].GradePoint) {
+			return fmt.Errorf("threshold for grade %s must not exceed the higher grade", g.Grade)
+		}
+	}
+	if p.LetterGrades[len(p.LetterGrades)-1].MinScore != 0 {
+		return errors.New("min score for grade F must be 0")
+	}
+
+	if p.PassScore > 100 {
+		return errors.New("pass score must be between 0 and 100")
+	}
+	if p.AttendanceWeight > 100 {
+		return errors.New("attendance weight must be between 0 and 100")
+	}
+	return nil
+}
+
+// Weight は講義の重みを返す
+func (p *GradingPolicy) Weight(part uint8) int {
+	for _, w := range p.ClassWeights {
+		if w.Part == part {
+			return int(w.Weight)
+		}
+	}
+	return defaultClassWeight
+}
+
+// CourseMaxScore は科目の合計点の満点
+type CourseMaxScore struct {
+	// Weighted は講義の重みを掛けた満点で、合計点と比較する
+	Weighted int
+	// Unweighted はすべての講義の重みを1とした場合の満点
+	Unweighted int
+}
+
+// MaxScore は点数を公開した講義の回の一覧と、出席を取った講義の数から合計点の満点を求める
+func (p *GradingPolicy) MaxScore(parts []uint8, attendanceClasses int) CourseMaxScore {
+	attendance := attendanceClasses * int(p.AttendanceWeight)
+	max := CourseMaxScore{Weighted: attendance, Unweighted: attendance}
+	for _, part := range parts {
+		max.Weighted += 100 * p.Weight(part)
+		max.Unweighted += 100
+	}
+	return max
+}
+
+// Grade は合計点と満点から評語とグレードポイント(1/100単位)を求める
+// countsForGPA が false の科目はGPAの計算に含めない
+func (p *GradingPolicy) Grade(totalScore int, max CourseMaxScore) (grade LetterGrade, gradePoints int, countsForGPA bool) {
+	switch p.Type {
+	case GradingLetter:
+		for _, g := range p.LetterGrades {
+			if reachesRate(totalScore, max.Weighted, g.MinScore) {
+				return g.Grade, int(math.Round(g.GradePoint * 100)), true
+			}
+		}
+		return GradeF, 0, true
+	case GradingPassFail:
+		if reachesRate(totalScore, max.Weighted, p.PassScore) {
+			return GradePass, 0, false
+		}
+		return GradeF, 0, false
+	default:
+		// 重みを付けた科目がGPAで過大に扱われないように、合計点を重みを1とした場合の点数に換算する
+		if max.Weighted == 0 {
+			return "", 0, true
+		}
+		return "", int(math.Round(float64(totalScore) * float64(max.Unweighted) / float64(max.Weighted))), true
+	}
+}
+
+// reachesRate は得点率が rate(%) 以上かどうかを返す。講義がない科目の得点率は0とする
+func reachesRate(totalScore int, maxScore int, rate uint8) bool {
+	if maxScore == 0 {
+		return rate == 0
+	}
+	return totalScore*100 >= int(rate)*maxScore
+}
+
+// ----- 永続化 -----
+
+// loadGradingPolicies は科目毎の成績評価の方針を取得する。方針を設定していない科目はデフォルトの方針になる
+func loadGradingPolicies(q sqlx.Queryer, courseIDs []string) (map[string]*GradingPolicy, error) {
+	policies := make(map[string]*GradingPolicy, len(courseIDs))
+	if len(courseIDs) == 0 {
+		return policies, nil
+	}
+	args := make([]interface{}, 0, len(courseIDs))
+	for _, id := range courseIDs {
+		policies[id] = defaultGradingPolicy()
+		args = append(args, id)
+	}
+
+	var rows []struct {
+		CourseID         string      `db:"course_id"`
+		Type             GradingType `db:"type"`
+		PassScore        uint8       `db:"pass_score"`
+		AttendanceWeight uint8       `db:"attendance_weight"`
+	}
+	if err := sqlx.Select(q, &rows, "SELECT * FROM `grading_policies` WHERE `course_id` IN ("+placeholders(len(args))+")", args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		policies[row.CourseID].Type = row.Type
+		policies[row.CourseID].PassScore = row.PassScore
+		policies[row.CourseID].AttendanceWeight = row.AttendanceWeight
+	}
+
+	var weights []struct {
+		CourseID string `db:"course_id"`
+		ClassWeight
+	}
+	if err := sqlx.Select(q, &weights, "SELECT * FROM `grading_weights` WHERE `course_id` IN ("+placeholders(len(args))+") ORDER BY `part`", args...); err != nil {
+		return nil, err
+	}
+	for _, w := range weights {
+		policies[w.CourseID].ClassWeights = append(policies[w.CourseID].ClassWeights, w.ClassWeight)
+	}
+
+	// grade_point は 1/100 単位で保存している
+	var grades []struct {
+		CourseID   string      `db:"course_id"`
+		Grade      LetterGrade `db:"grade"`
+		MinScore   uint8       `db:"min_score"`
+		GradePoint int         `db:"grade_point"`
+	}
+	if err := sqlx.Select(q, &grades, "SELECT * FROM `letter_grades` WHERE `course_id` IN ("+placeholders(len(args))+") ORDER BY `course_id`, `grade`", args...); err != nil {
+		return nil, err
+	}
+	custom := make(map[string]bool)
+	for _, g := range grades {
+		if !custom[g.CourseID] {
+			custom[g.CourseID] = true
+			policies[g.CourseID].LetterGrades = make([]LetterGradeThreshold, 0, len(letterGrades))
+		}
+		policies[g.CourseID].LetterGrades = append(policies[g.CourseID].LetterGrades, LetterGradeThreshold{
+			Grade:      g.Grade,
+			MinScore:   g.MinScore,
+			GradePoint: float64(g.GradePoint) / 100,
+		})
+	}
+
+	return policies, nil
+}
+
+func loadGradingPolicy(q sqlx.Queryer, courseID string) (*GradingPolicy, error) {
+	policies, err := loadGradingPolicies(q, []string{courseID})
+	if err != nil {
+		return nil, err
+	}
+	return policies[courseID], nil
+}
+
+// saveGradingPolicy は科目の成績評価の方針を置き換える
+func saveGradingPolicy(tx sqlx.Execer, courseID string, p *GradingPolicy) error {
+	if _, err := tx.Exec("INSERT INTO `grading_policies` (`course_id`, `type`, `pass_score`, `attendance_weight`) VALUES (?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE `type` = VALUES(`type`), `pass_score` = VALUES(`pass_score`), `attendance_weight` = VALUES(`attendance_weight`)",
+		courseID, p.Type, p.PassScore, p.AttendanceWeight); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM `grading_weights` WHERE `course_id` = ?", courseID); err != nil {
+		return err
+	}
+	for _, w := range p.ClassWeights {
+		if _, err := tx.Exec("INSERT INTO `grading_weights` (`course_id`, `part`, `weight`) VALUES (?, ?, ?)", courseID, w.Part, w.Weight); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM `letter_grades` WHERE `course_id` = ?", courseID); err != nil {
+		return err
+	}
+	for _, g := range p.LetterGrades {
+		if _, err := tx.Exec("INSERT INTO `letter_grades` (`course_id`, `grade`, `min_score`, `grade_point`) VALUES (?, ?, ?, ?)",
+			courseID, g.Grade, g.MinScore, int(math.Round(g.GradePoint*100))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPublishedClassParts は科目毎の、点数を公開した講義の回の一覧を取得する
+// 点数を公開していない講義は合計点にも満点にも含めない
+func loadPublishedClassParts(q sqlx.Queryer, courseIDs []string) (map[string][]uint8, error) {
+	parts := make(map[string][]uint8, len(courseIDs))
+	if len(courseIDs) == 0 {
+		return parts, nil
+	}
+	args := make([]interface{}, 0, len(courseIDs))
+	for _, id := range courseIDs {
+		args = append(args, id)
+	}
+	var classes []struct {
+		CourseID string `db:"course_id"`
+		Part     uint8  `db:"part"`
+	}
+	if err := sqlx.Select(q, &classes, "SELECT `course_id`, `part` FROM `classes` WHERE `course_id` IN ("+placeholders(len(args))+") AND `scores_published` = true", args...); err != nil {
+		return nil, err
+	}
+	for _, class := range classes {
+		parts[class.CourseID] = append(parts[class.CourseID], class.Part)
+	}
+	return parts, nil
+}
+
+// loadMaxScores は科目毎の合計点の満点を求める
+func loadMaxScores(q sqlx.Queryer, policies map[string]*GradingPolicy) (map[string]CourseMaxScore, error) {
+	courseIDs := make([]string, 0, len(policies))
+	for id := range policies {
+		courseIDs = append(courseIDs, id)
+	}
+	parts, err := loadPublishedClassParts(q, courseIDs)
+	if err != nil {
+		return nil, err
+	}
+	attendanceClasses, err := loadAttendanceClassCounts(q, courseIDs)
+	if err != nil {
+		return nil, err
+	}
+	maxScores := make(map[string]CourseMaxScore, len(policies))
+	for id, policy := range policies {
+		maxScores[id] = policy.MaxScore(parts[id], attendanceClasses[id])
+	}
+	return maxScores, nil
+}
+
+func loadMaxScore(q sqlx.Queryer, courseID string, policy *GradingPolicy) (CourseMaxScore, error) {
+	maxScores, err := loadMaxScores(q, map[string]*GradingPolicy{courseID: policy})
+	if err != nil {
+		return CourseMaxScore{}, err
+	}
+	return maxScores[courseID], nil
+}
+
+// GetGradingPolicy GET /api/courses/:courseID/grading-policy 科目の成績評価の方針の取得
+func (h *handlers) GetGradingPolicy(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	var count int
+	if err := h.DB.Get(&count, "SELECT COUNT(*) FROM `courses` WHERE `id` = ?", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+
+	policy, err := loadGradingPolicy(h.DB, courseID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, policy)
+}
+
+// SetGradingPolicy PUT /api/courses/:courseID/grading-policy 科目の成績評価の方針の変更
+// GPAに反映済みの成績が変わらないように、修了済みの科目の方針は変更できない
+func (h *handlers) SetGradingPolicy(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	var req GradingPolicy
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if err := req.normalize(); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid grading policy: "+err.Error()+".")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var status CourseStatus
+	if err := tx.Get(&status, "SELECT `status` FROM `courses` WHERE `id` = ? FOR SHARE", courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+	if status == StatusClosed {
+		return c.String(http.StatusBadRequest, "The grading policy of a closed course cannot be changed.")
+	}
+
+	if err := saveGradingPolicy(tx, courseID, &req); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 講義の重みが変わるので合計点を作り直す
+	if err := rebuildCourseScoreTotals(tx, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, req)
+}
+
+// PublishScores PUT /api/courses/:courseID/classes/:classID/assignments/scores/publish 採点結果の公開
+func (h *handlers) PublishScores(c echo.Context) error {
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var class Class
+	if err := tx.Get(&class, "SELECT * FROM `classes` WHERE `id` = ? AND `course_id` = ? FOR UPDATE", classID, courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such class.")
+	}
+	if class.ScoresPublished {
+		return c.NoContent(http.StatusOK)
+	}
+
+	var course Course
+	if err := tx.Get(&course, "SELECT * FROM `courses` WHERE `id` = ? FOR SHARE", class.CourseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	policy, err := loadGradingPolicy(tx, course.ID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 修了済みの科目では満点が変わって全員の評語が変わりうるため、GPAの集計値から一度取り除いてから反映し直す
+	if course.Status == StatusClosed {
+		if err := closeCourseGPA(tx, &course, -1); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE `classes` SET `scores_published` = true WHERE `id` = ?", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	query := "INSERT INTO `course_score_totals` (`course_id`, `user_id`, `total_score`)" +
+		" SELECT ?, `user_id`, `score` * ? FROM `submissions`" +
+		" WHERE `class_id` = ? AND `score` IS NOT NULL" +
+		" ORDER BY `user_id`" +
+		" ON DUPLICATE KEY UPDATE `total_score` = `total_score` + VALUES(`total_score`)"
+	if _, err := tx.Exec(query, course.ID, policy.Weight(class.Part), classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if course.Status == StatusClosed {
+		if err := closeCourseGPA(tx, &course, 1); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGradingPolicyNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  GradingPolicy
+		want    *GradingPolicy
+		wantErr bool
+	}{
+		{
+			name:   "empty policy gets default type and letter grades",
+			policy: GradingPolicy{},
+			want: &GradingPolicy{
+				Type:         GradingScore,
+				ClassWeights: []ClassWeight{},
+				LetterGrades: defaultLetterGrades(),
+			},
+		},
+		{
+			name:   "pass_fail keeps pass score and weights",
+			policy: GradingPolicy{Type: GradingPassFail, ClassWeights: []ClassWeight{{Part: 1, Weight: 3}}, PassScore: 50},
+			want: &GradingPolicy{
+				Type:         GradingPassFail,
+				ClassWeights: []ClassWeight{{Part: 1, Weight: 3}},
+				LetterGrades: defaultLetterGrades(),
+				PassScore:    50,
+			},
+		},
+		{
+			name:    "unknown type",
+			policy:  GradingPolicy{Type: "curve"},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate part",
+			policy:  GradingPolicy{ClassWeights: []ClassWeight{{Part: 1, Weight: 2}, {Part: 1, Weight: 3}}},
+			wantErr: true,
+		},
+		{
+			name:    "zero weight",
+			policy:  GradingPolicy{ClassWeights: []ClassWeight{{Part: 1, Weight: 0}}},
+			wantErr: true,
+		},
+		{
+			name:    "weight over 100",
+			policy:  GradingPolicy{ClassWeights: []ClassWeight{{Part: 1, Weight: 101}}},
+			wantErr: true,
+		},
+		{
+			name: "letter grades out of order",
+			policy: GradingPolicy{LetterGrades: []LetterGradeThreshold{
+				{Grade: GradeA, MinScore: 80, GradePoint: 3},
+				{Grade: GradeS, MinScore: 90, GradePoint: 4},
+				{Grade: GradeB, MinScore: 70, GradePoint: 2},
+				{Grade: GradeC, MinScore: 60, GradePoint: 1},
+				{Grade: GradeF, MinScore: 0, GradePoint: 0},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "lower grade has higher threshold",
+			policy: GradingPolicy{LetterGrades: []LetterGradeThreshold{
+				{Grade: GradeS, MinScore: 90, GradePoint: 4},
+				{Grade: GradeA, MinScore: 95, GradePoint: 3},
+				{Grade: GradeB, MinScore: 70, GradePoint: 2},
+				{Grade: GradeC, MinScore: 60, GradePoint: 1},
+				{Grade: GradeF, MinScore: 0, GradePoint: 0},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "grade F must start at 0",
+			policy: GradingPolicy{LetterGrades: []LetterGradeThreshold{
+				{Grade: GradeS, MinScore: 90, GradePoint: 4},
+				{Grade: GradeA, MinScore: 80, GradePoint: 3},
+				{Grade: GradeB, MinScore: 70, GradePoint: 2},
+				{Grade: GradeC, MinScore: 60, GradePoint: 1},
+				{Grade: GradeF, MinScore: 10, GradePoint: 0},
+			}},
+			wantErr: true,
+		},
+		{
+			name:    "grade point over 4",
+			policy:  GradingPolicy{LetterGrades: []LetterGradeThreshold{{Grade: GradeS, MinScore: 90, GradePoint: 5}, {Grade: GradeA}, {Grade: GradeB}, {Grade: GradeC}, {Grade: GradeF}}},
+			wantErr: true,
+		},
+		{
+			name:    "pass score over 100",
+			policy:  GradingPolicy{Type: GradingPassFail, PassScore: 101},
+			wantErr: true,
+		},
+		{
+			name:    "attendance weight over 100",
+			policy:  GradingPolicy{AttendanceWeight: 101},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := tt.policy
+			err := policy.normalize()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("normalize() = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("normalize() = %v", err)
+			}
+			if !reflect.DeepEqual(&policy, tt.want) {
+				t.Errorf("normalize() = %+v, want %+v", policy, *tt.want)
+			}
+		})
+	}
+}
+
+func TestGradingPolicyMaxScore(t *testing.T) {
+	policy := &GradingPolicy{
+		ClassWeights:     []ClassWeight{{Part: 2, Weight: 3}, {Part: 5, Weight: 2}},
+		AttendanceWeight: 10,
+	}
+	tests := []struct {
+		name              string
+		parts             []uint8
+		attendanceClasses int
+		want              CourseMaxScore
+	}{
+		{name: "no classes", parts: nil, attendanceClasses: 0, want: CourseMaxScore{Weighted: 0, Unweighted: 0}},
+		{name: "default weights only", parts: []uint8{1, 3}, attendanceClasses: 0, want: CourseMaxScore{Weighted: 200, Unweighted: 200}},
+		{name: "weighted classes", parts: []uint8{1, 2, 3, 4, 5}, attendanceClasses: 0, want: CourseMaxScore{Weighted: 100 + 300 + 100 + 100 + 200, Unweighted: 500}},
+		{name: "with attendance", parts: []uint8{1, 2}, attendanceClasses: 4, want: CourseMaxScore{Weighted: 100 + 300 + 40, Unweighted: 200 + 40}},
+		{name: "attendance only", parts: nil, attendanceClasses: 2, want: CourseMaxScore{Weighted: 20, Unweighted: 20}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.MaxScore(tt.parts, tt.attendanceClasses); got != tt.want {
+				t.Errorf("MaxScore(%v, %d) = %+v, want %+v", tt.parts, tt.attendanceClasses, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGradingPolicyGrade(t *testing.T) {
+	score := defaultGradingPolicy()
+	weightedScore := defaultGradingPolicy()
+	weightedScore.ClassWeights = []ClassWeight{{Part: 1, Weight: 100}}
+	letter := defaultGradingPolicy()
+	letter.Type = GradingLetter
+	passFail := defaultGradingPolicy()
+	passFail.Type = GradingPassFail
+
+	unweighted := func(max int) CourseMaxScore { return CourseMaxScore{Weighted: max, Unweighted: max} }
+	tests := []struct {
+		name             string
+		policy           *GradingPolicy
+		total            int
+		max              CourseMaxScore
+		wantGrade        LetterGrade
+		wantGradePoints  int
+		wantCountsForGPA bool
+	}{
+		{name: "score uses total as grade points", policy: score, total: 345, max: unweighted(500), wantGrade: "", wantGradePoints: 345, wantCountsForGPA: true},
+		{name: "score with no classes", policy: score, total: 0, max: unweighted(0), wantGrade: "", wantGradePoints: 0, wantCountsForGPA: true},
+		// 第1回(重み100)で満点、第2回(重み1)で0点: 合計点 10000 / 満点 10100
+		{name: "weighted score is scaled to unweighted max", policy: weightedScore, total: 10000, max: weightedScore.MaxScore([]uint8{1, 2}, 0), wantGrade: "", wantGradePoints: 198, wantCountsForGPA: true},
+		{name: "weighted score with full marks", policy: weightedScore, total: 10100, max: weightedScore.MaxScore([]uint8{1, 2}, 0), wantGrade: "", wantGradePoints: 200, wantCountsForGPA: true},
+		{name: "weighted score with no classes", policy: weightedScore, total: 0, max: weightedScore.MaxScore(nil, 0), wantGrade: "", wantGradePoints: 0, wantCountsForGPA: true},
+		{name: "letter S at boundary", policy: letter, total: 450, max: unweighted(500), wantGrade: GradeS, wantGradePoints: 400, wantCountsForGPA: true},
+		{name: "letter A just below S", policy: letter, total: 449, max: unweighted(500), wantGrade: GradeA, wantGradePoints: 300, wantCountsForGPA: true},
+		{name: "letter B", policy: letter, total: 70, max: unweighted(100), wantGrade: GradeB, wantGradePoints: 200, wantCountsForGPA: true},
+		{name: "letter C at boundary", policy: letter, total: 300, max: unweighted(500), wantGrade: GradeC, wantGradePoints: 100, wantCountsForGPA: true},
+		{name: "letter F", policy: letter, total: 299, max: unweighted(500), wantGrade: GradeF, wantGradePoints: 0, wantCountsForGPA: true},
+		{name: "letter with no classes", policy: letter, total: 0, max: unweighted(0), wantGrade: GradeF, wantGradePoints: 0, wantCountsForGPA: true},
+		{name: "letter uses weighted max", policy: letter, total: 900, max: CourseMaxScore{Weighted: 1000, Unweighted: 200}, wantGrade: GradeS, wantGradePoints: 400, wantCountsForGPA: true},
+		{name: "pass at boundary", policy: passFail, total: 60, max: unweighted(100), wantGrade: GradePass, wantGradePoints: 0, wantCountsForGPA: false},
+		{name: "fail", policy: passFail, total: 59, max: unweighted(100), wantGrade: GradeF, wantGradePoints: 0, wantCountsForGPA: false},
+		{name: "pass_fail with no classes", policy: passFail, total: 0, max: unweighted(0), wantGrade: GradeF, wantGradePoints: 0, wantCountsForGPA: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grade, gradePoints, countsForGPA := tt.policy.Grade(tt.total, tt.max)
+			if grade != tt.wantGrade || gradePoints != tt.wantGradePoints || countsForGPA != tt.wantCountsForGPA {
+				t.Errorf("Grade(%d, %+v) = (%q, %d, %v), want (%q, %d, %v)",
+					tt.total, tt.max, grade, gradePoints, countsForGPA, tt.wantGrade, tt.wantGradePoints, tt.wantCountsForGPA)
+			}
+		})
+	}
+}
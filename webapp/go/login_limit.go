@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// loginFailureWindow は最後の失敗からこの時間が経過すると失敗回数をリセットする
+	loginFailureWindow = 15 * time.Minute
+	// loginLockoutBase は上限回数に達した時点でのロック時間で、以降の失敗毎に倍になる
+	loginLockoutBase = 1 * time.Second
+	loginLockoutMax  = 15 * time.Minute
+	// アカウント毎の連続失敗回数の上限
+	loginAccountFailureLimit = 5
+	// defaultLoginIPFailureLimit はIPアドレス毎の失敗回数の上限のデフォルト値で、LOGIN_IP_FAILURE_LIMIT で変更できる
+	// 学内のNATの背後など多くの利用者が同じIPアドレスからログインするので、アカウント毎の上限より十分大きくする
+	defaultLoginIPFailureLimit = 1000
+)
+
+type LoginAttemptScope string
+
+const (
+	LoginAttemptAccount LoginAttemptScope = "account"
+	LoginAttemptIP      LoginAttemptScope = "ip"
+)
+
+type LoginResult string
+
+const (
+	LoginSucceeded LoginResult = "success"
+	LoginFailed    LoginResult = "failure"
+	LoginLocked    LoginResult = "locked"
+	// LoginDeactivated は認証には成功したが、アカウントが無効化されていたことを表す
+	LoginDeactivated LoginResult = "deactivated"
+)
+
+type LoginAttempt struct {
+	Scope        LoginAttemptScope `db:"scope"`
+	Key          string            `db:"key"`
+	FailureCount int               `db:"failure_count"`
+	LastFailedAt time.Time         `db:"last_failed_at"`
+	LockedUntil  sql.NullTime      `db:"locked_until"`
+}
+
+// lockoutDuration は連続失敗回数に応じたロック時間を返す
+func lockoutDuration(failureCount, limit int) time.Duration {
+	if failureCount < limit {
+		return 0
+	}
+	d := float64(loginLockoutBase) * math.Pow(2, float64(failureCount-limit))
+	if d > float64(loginLockoutMax) {
+		return loginLockoutMax
+	}
+	return time.Duration(d)
+}
+
+// getLoginLockedUntil はアカウントもしくはIPアドレスがロックされていればその解除時刻を返す
+func getLoginLockedUntil(db sqlx.Queryer, code, ip string, now time.Time) (time.Time, bool, error) {
+	var lockedUntil sql.NullTime
+	query := "SELECT MAX(`locked_until`) FROM `login_attempts`" +
+		" WHERE (`scope` = ? AND `key` = ?) OR (`scope` = ? AND `key` = ?)"
+	if err := sqlx.Get(db, &lockedUntil, query, LoginAttemptAccount, code, LoginAttemptIP, ip); err != nil {
+		return time.Time{}, false, err
+	}
+	if !lockedUntil.Valid || !lockedUntil.Time.After(now) {
+		return time.Time{}, false, nil
+	}
+	return lockedUntil.Time, true, nil
+}
+
+// recordLoginFailure は失敗回数を加算し、上限に達していればロックする
+func recordLoginFailure(tx *sqlx.Tx, scope LoginAttemptScope, key string, limit int, now time.Time) error {
+	var attempt LoginAttempt
+	if err := tx.Get(&attempt, "SELECT * FROM `login_attempts` WHERE `scope` = ? AND `key` = ? FOR UPDATE", scope, key); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	failureCount := attempt.FailureCount + 1
+	if now.Sub(attempt.LastFailedAt) > loginFailureWindow {
+		failureCount = 1
+	}
+	var lockedUntil sql.NullTime
+	if d := lockoutDuration(failureCount, limit); d > 0 {
+		lockedUntil = sql.NullTime{Time: now.Add(d), Valid: true}
+	}
+
+	_, err := tx.Exec("INSERT INTO `login_attempts` (`scope`, `key`, `failure_count`, `last_failed_at`, `locked_until`) VALUES (?, ?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE `failure_count` = VALUES(`failure_count`), `last_failed_at` = VALUES(`last_failed_at`), `locked_until` = VALUES(`locked_until`)",
+		scope, key, failureCount, now, lockedUntil)
+	return err
+}
+
+// recordLoginSuccess はアカウントの失敗回数をリセットし、IPアドレスの失敗回数を1回分減らす
+// IPアドレスは多くの利用者で共有されうるので、ログインの成功で失敗回数を打ち消すが、1回の成功で全てはリセットしない
+func recordLoginSuccess(db sqlx.Execer, code, ip string) error {
+	if _, err := db.Exec("DELETE FROM `login_attempts` WHERE `scope` = ? AND `key` = ?", LoginAttemptAccount, code); err != nil {
+		return err
+	}
+	_, err := db.Exec("UPDATE `login_attempts` SET `failure_count` = GREATEST(`failure_count` - 1, 0) WHERE `scope` = ? AND `key` = ?", LoginAttemptIP, ip)
+	return err
+}
+
+// recordLoginEvent はログイン試行を監査ログに記録する
+func recordLoginEvent(db sqlx.Execer, code string, userID sql.NullString, result LoginResult, ip, userAgent string, now time.Time) error {
+	_, err := db.Exec("INSERT INTO `login_events` (`id`, `user_code`, `user_id`, `result`, `ip`, `user_agent`, `created_at`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		newULID(), code, userID, result, ip, userAgent, now)
+	return err
+}
+
+// recordPasswordFailure はパスワードの検証の失敗をアカウントとIPアドレスの失敗回数に加算し、監査ログに記録する
+func (h *handlers) recordPasswordFailure(code string, userID sql.NullString, ip, userAgent string, now time.Time) error {
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := recordLoginFailure(tx, LoginAttemptAccount, code, loginAccountFailureLimit, now); err != nil {
+		return err
+	}
+	if err := recordLoginFailure(tx, LoginAttemptIP, ip, h.LoginIPFailureLimit, now); err != nil {
+		return err
+	}
+	if err := recordLoginEvent(tx, code, userID, LoginFailed, ip, userAgent, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// failLogin はログインの失敗を記録して 401 を返す
+func (h *handlers) failLogin(c echo.Context, code string, userID sql.NullString, ip, userAgent string, now time.Time) error {
+	if err := h.recordPasswordFailure(code, userID, ip, userAgent, now); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.String(http.StatusUnauthorized, "Code or Password is wrong.")
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"mime/multipart"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
@@ -31,7 +35,14 @@ const (
 )
 
 type handlers struct {
-	DB *sqlx.DB
+	DB           *sqlx.DB
+	SessionStore *ServerSideStore
+	// OIDC はSSOが設定されていない場合 nil
+	OIDC        *OIDCSettings
+	Timetable   *Timetable
+	CourseIndex *CourseIndex
+	// LoginIPFailureLimit はIPアドレス毎のログイン失敗回数の上限
+	LoginIPFailureLimit int
 }
 
 func main() {
@@ -40,47 +51,154 @@ func main() {
 	e.Server.Addr = fmt.Sprintf(":%v", GetEnv("PORT", "7000"))
 	e.HideBanner = true
 
-	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte("trapnomura"))))
-
 	db, _ := GetDB(false)
 	db.SetMaxOpenConns(10)
 
+	sessionKey := []byte(GetEnv("SESSION_KEY", ""))
+	if len(sessionKey) == 0 {
+		// 鍵が設定されていない場合は起動ごとにランダムな鍵を使う(再起動すると全セッションが無効になる)
+		e.Logger.Warn("SESSION_KEY is not set; using a random key")
+		sessionKey = securecookie.GenerateRandomKey(32)
+	}
+	var sessionBackend SessionBackend
+	if GetEnv("SESSION_STORE", "mysql") == "memory" {
+		sessionBackend = NewMemorySessionBackend()
+	} else {
+		sessionBackend = &MySQLSessionBackend{DB: db}
+	}
+	sessionStore := NewServerSideStore(sessionBackend, sessionKey)
+
+	timetable, err := NewTimetable()
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	courseIndex := NewCourseIndex()
+	if err := courseIndex.Rebuild(db); err != nil {
+		// DBの準備ができていない場合でも /initialize で作り直される
+		e.Logger.Error(err)
+	}
+
+	var oidcSettings *OIDCSettings
+	if issuer := GetEnv("OIDC_ISSUER", ""); issuer != "" {
+		provider, err := NewOIDCProvider(context.Background(), OIDCProviderConfig{
+			Issuer:       issuer,
+			ClientID:     GetEnv("OIDC_CLIENT_ID", ""),
+			ClientSecret: GetEnv("OIDC_CLIENT_SECRET", ""),
+			RedirectURL:  GetEnv("OIDC_REDIRECT_URL", ""),
+		})
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		oidcSettings = &OIDCSettings{
+			Provider:        provider,
+			CodeClaim:       OIDCCodeClaim(GetEnv("OIDC_CODE_CLAIM", string(OIDCCodeClaimSubject))),
+			EmailDomain:     GetEnv("OIDC_EMAIL_DOMAIN", ""),
+			JITProvisioning: GetEnv("OIDC_JIT_PROVISIONING", "") == "true",
+		}
+		if err := oidcSettings.validate(); err != nil {
+			e.Logger.Fatal(err)
+		}
+	}
+
+	loginIPFailureLimit, err := strconv.Atoi(GetEnv("LOGIN_IP_FAILURE_LIMIT", strconv.Itoa(defaultLoginIPFailureLimit)))
+	if err != nil || loginIPFailureLimit <= 0 {
+		e.Logger.Fatalf("invalid LOGIN_IP_FAILURE_LIMIT: %q", GetEnv("LOGIN_IP_FAILURE_LIMIT", ""))
+	}
+
+	e.Use(middleware.Logger())
+	e.Use(middleware.Recover())
+	e.Use(session.Middleware(sessionStore))
+
 	h := &handlers{
-		DB: db,
+		DB:           db,
+		SessionStore: sessionStore,
+		OIDC:         oidcSettings,
+		Timetable:    timetable,
+		CourseIndex:  courseIndex,
+
+		LoginIPFailureLimit: loginIPFailureLimit,
 	}
 
 	e.POST("/initialize", h.Initialize)
 
 	e.POST("/login", h.Login)
 	e.POST("/logout", h.Logout)
+	e.POST("/password-reset", h.ResetPassword)
+	e.GET("/auth/oidc/login", h.OIDCLogin)
+	e.GET("/auth/oidc/callback", h.OIDCCallback)
+	e.GET("/transcripts/verify/:hash", h.VerifyTranscript)
 	API := e.Group("/api", h.IsLoggedIn)
 	{
 		usersAPI := API.Group("/users")
 		{
 			usersAPI.GET("/me", h.GetMe)
+			usersAPI.PUT("/me", h.UpdateMe)
+			usersAPI.DELETE("/me/sessions", h.DeleteMySessions)
+			usersAPI.PUT("/me/password", h.ChangePassword)
+			usersAPI.GET("/me/tokens", h.GetMyTokens)
+			usersAPI.POST("/me/tokens", h.CreateMyToken)
+			usersAPI.DELETE("/me/tokens/:tokenID", h.DeleteMyToken)
 			usersAPI.GET("/me/courses", h.GetRegisteredCourses)
 			usersAPI.PUT("/me/courses", h.RegisterCourses)
+			usersAPI.GET("/me/courses.ics", h.GetRegisteredCoursesICS)
 			usersAPI.GET("/me/grades", h.GetGrades)
+			usersAPI.GET("/me/transcript.json", h.GetMyTranscript)
+			usersAPI.GET("/me/transcript.pdf", h.GetMyTranscriptPDF)
+			usersAPI.GET("/:userCode", h.GetUser, h.IsAdmin, h.RequireRole(Teacher, TeachingAssistant, Registrar))
 		}
 		coursesAPI := API.Group("/courses")
 		{
 			coursesAPI.GET("", h.SearchCourses)
-			coursesAPI.POST("", h.AddCourse, h.IsAdmin)
+			coursesAPI.POST("", h.AddCourse, h.IsAdmin, h.RequireRole(Teacher))
 			coursesAPI.GET("/:courseID", h.GetCourseDetail)
-			coursesAPI.PUT("/:courseID/status", h.SetCourseStatus, h.IsAdmin)
+			coursesAPI.PUT("/:courseID", h.UpdateCourse, h.IsAdmin, h.Authorize(PermManageCourse))
+			coursesAPI.POST("/:courseID/copy", h.CopyCourse, h.IsAdmin, h.Authorize(PermManageCourse))
+			coursesAPI.PUT("/:courseID/status", h.SetCourseStatus, h.IsAdmin, h.Authorize(PermManageCourse))
+			coursesAPI.GET("/:courseID/grading-policy", h.GetGradingPolicy)
+			coursesAPI.PUT("/:courseID/grading-policy", h.SetGradingPolicy, h.IsAdmin, h.Authorize(PermManageCourse))
+			coursesAPI.GET("/:courseID/stats", h.GetCourseStats, h.IsAdmin, h.Authorize(PermGradeSubmissions))
+			coursesAPI.GET("/:courseID/syllabus", h.DownloadSyllabus)
+			coursesAPI.PUT("/:courseID/syllabus", h.SetSyllabus, h.IsAdmin, h.Authorize(PermManageCourse))
+			coursesAPI.DELETE("/:courseID/syllabus", h.DeleteSyllabus, h.IsAdmin, h.Authorize(PermManageCourse))
 			coursesAPI.GET("/:courseID/classes", h.GetClasses)
-			coursesAPI.POST("/:courseID/classes", h.AddClass, h.IsAdmin)
+			coursesAPI.POST("/:courseID/classes", h.AddClass, h.IsAdmin, h.Authorize(PermManageCourse))
+			coursesAPI.PUT("/:courseID/classes/:classID", h.UpdateClass, h.IsAdmin, h.Authorize(PermManageCourse))
+			coursesAPI.DELETE("/:courseID/classes/:classID", h.DeleteClass, h.IsAdmin, h.Authorize(PermManageCourse))
 			coursesAPI.POST("/:courseID/classes/:classID/assignments", h.SubmitAssignment)
-			coursesAPI.PUT("/:courseID/classes/:classID/assignments/scores", h.RegisterScores, h.IsAdmin)
-			coursesAPI.GET("/:courseID/classes/:classID/assignments/export", h.DownloadSubmittedAssignments, h.IsAdmin)
+			coursesAPI.PUT("/:courseID/classes/:classID/assignments/scores", h.RegisterScores, h.IsAdmin, h.Authorize(PermGradeSubmissions))
+			coursesAPI.PUT("/:courseID/classes/:classID/assignments/scores/publish", h.PublishScores, h.IsAdmin, h.Authorize(PermPublishScores))
+			coursesAPI.GET("/:courseID/classes/:classID/materials", h.GetClassMaterials)
+			coursesAPI.POST("/:courseID/classes/:classID/materials", h.AddClassMaterial, h.IsAdmin, h.Authorize(PermManageCourse))
+			coursesAPI.GET("/:courseID/classes/:classID/materials/:materialID", h.DownloadClassMaterial)
+			coursesAPI.DELETE("/:courseID/classes/:classID/materials/:materialID", h.DeleteClassMaterial, h.IsAdmin, h.Authorize(PermManageCourse))
+			coursesAPI.POST("/:courseID/classes/:classID/attendance/session", h.OpenAttendanceSession, h.IsAdmin, h.Authorize(PermTakeAttendance))
+			coursesAPI.POST("/:courseID/classes/:classID/attendance", h.CheckIn)
+			coursesAPI.GET("/:courseID/attendance", h.GetAttendanceRoster, h.IsAdmin, h.Authorize(PermTakeAttendance))
+			coursesAPI.POST("/:courseID/classes/:classID/appeals", h.SubmitAppeal)
+			coursesAPI.GET("/:courseID/appeals", h.GetAppeals, h.IsAdmin, h.Authorize(PermGradeSubmissions))
+			coursesAPI.PUT("/:courseID/appeals/:appealID", h.ResolveAppeal, h.IsAdmin, h.Authorize(PermGradeSubmissions))
+			coursesAPI.GET("/:courseID/classes/:classID/assignments/export", h.DownloadSubmittedAssignments, h.IsAdmin, h.Authorize(PermExportSubmissions))
+			coursesAPI.GET("/:courseID/staff", h.GetCourseStaff, h.IsAdmin, h.Authorize(PermManageStaff))
+			coursesAPI.PUT("/:courseID/staff/:userCode", h.AddCourseStaff, h.IsAdmin, h.Authorize(PermManageStaff))
+			coursesAPI.DELETE("/:courseID/staff/:userCode", h.RemoveCourseStaff, h.IsAdmin, h.Authorize(PermManageStaff))
 		}
 		announcementsAPI := API.Group("/announcements")
 		{
 			announcementsAPI.GET("", h.GetAnnouncementList)
 			announcementsAPI.POST("", h.AddAnnouncement, h.IsAdmin)
 			announcementsAPI.GET("/:announcementID", h.GetAnnouncementDetail)
+			announcementsAPI.GET("/:announcementID/attachments/:attachmentID", h.DownloadAnnouncementAttachment)
+		}
+		adminAPI := API.Group("/admin", h.IsAdmin, h.RequireRole(Registrar))
+		{
+			adminAPI.POST("/users", h.AddUser)
+			adminAPI.POST("/users/import", h.ImportUsers)
+			adminAPI.PUT("/users/:userCode", h.UpdateUser)
+			adminAPI.DELETE("/users/:userCode", h.DeactivateUser)
+			adminAPI.POST("/users/:userCode/password-reset", h.IssuePasswordResetToken)
+			adminAPI.GET("/grade-aggregates", h.CheckGradeAggregates)
+			adminAPI.POST("/grade-aggregates/rebuild", h.RebuildGradeAggregates)
 		}
 	}
 
@@ -112,6 +230,25 @@ func (h *handlers) Initialize(c echo.Context) error {
 		}
 	}
 
+	if err := h.CourseIndex.Rebuild(h.DB); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+	if err := rebuildGradeAggregates(tx); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	if err := exec.Command("rm", "-rf", AssignmentsDirectory).Run(); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -128,8 +265,21 @@ func (h *handlers) Initialize(c echo.Context) error {
 }
 
 // IsLoggedIn ログイン確認用middleware
+// セッションcookieの代わりに Authorization: Bearer のAPIトークンでも認証できる
 func (h *handlers) IsLoggedIn(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		if auth := c.Request().Header.Get(echo.HeaderAuthorization); auth != "" {
+			token := strings.TrimPrefix(auth, "Bearer ")
+			if token == auth || token == "" {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_request"`)
+				return c.String(http.StatusUnauthorized, "Invalid Authorization header.")
+			}
+			return h.authenticateBearer(c, token, next)
+		}
+		if token := c.QueryParam("access_token"); token != "" && queryTokenRoutes[c.Request().Method+" "+c.Path()] {
+			return h.authenticateBearer(c, token, next)
+		}
+
 		sess, err := session.Get(SessionName, c)
 		if err != nil {
 			c.Logger().Error(err)
@@ -150,17 +300,17 @@ func (h *handlers) IsLoggedIn(next echo.HandlerFunc) echo.HandlerFunc {
 // IsAdmin admin確認用middleware
 func (h *handlers) IsAdmin(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		sess, err := session.Get(SessionName, c)
+		userID, _, _, err := getUserInfo(c)
 		if err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
-		isAdmin, ok := sess.Values["isAdmin"]
-		if !ok {
-			c.Logger().Error("failed to get isAdmin from session")
+		// セッションの isAdmin はログイン時点のものなので信用せず、現在の users.type を確認する
+		userType, err := h.getUserType(userID)
+		if err != nil && err != sql.ErrNoRows {
+			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
-		}
-		if !isAdmin.(bool) {
+		} else if err == sql.ErrNoRows || !isStaff(userType) {
 			return c.String(http.StatusForbidden, "You are not admin user.")
 		}
 
@@ -169,6 +319,9 @@ func (h *handlers) IsAdmin(next echo.HandlerFunc) echo.HandlerFunc {
 }
 
 func getUserInfo(c echo.Context) (userID string, userName string, isAdmin bool, err error) {
+	if u, ok := c.Get(tokenUserContextKey).(*tokenUser); ok {
+		return u.ID, u.Name, u.IsAdmin, nil
+	}
 	sess, err := session.Get(SessionName, c)
 	if err != nil {
 		return "", "", false, err
@@ -191,8 +344,10 @@ func getUserInfo(c echo.Context) (userID string, userName string, isAdmin bool,
 type UserType string
 
 const (
-	Student UserType = "student"
-	Teacher UserType = "teacher"
+	Student           UserType = "student"
+	Teacher           UserType = "teacher"
+	TeachingAssistant UserType = "ta"
+	Registrar         UserType = "registrar"
 )
 
 type User struct {
@@ -201,6 +356,12 @@ type User struct {
 	Name           string   `db:"name"`
 	HashedPassword []byte   `db:"hashed_password"`
 	Type           UserType `db:"type"`
+	Deactivated    bool     `db:"deactivated"`
+	// 以下はプロフィール
+	Email          string        `db:"email"`
+	Department     string        `db:"department"`
+	EnrollmentYear sql.NullInt32 `db:"enrollment_year"`
+	AvatarURL      string        `db:"avatar_url"`
 }
 
 type CourseType string
@@ -258,16 +419,46 @@ func (h *handlers) Login(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid format.")
 	}
 
+	// login_attempts のキーに収まらない学内コードは存在しない
+	if len(req.Code) > 255 {
+		return c.String(http.StatusUnauthorized, "Code or Password is wrong.")
+	}
+
+	now := time.Now()
+	ip := c.RealIP()
+	userAgent := c.Request().UserAgent()
+
+	// 連続で失敗しているアカウントもしくはIPアドレスからのログインはパスワードを検証せずに拒否する
+	if lockedUntil, locked, err := getLoginLockedUntil(h.DB, req.Code, ip, now); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if locked {
+		if err := recordLoginEvent(h.DB, req.Code, sql.NullString{}, LoginLocked, ip, userAgent, now); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockedUntil.Sub(now).Seconds()))))
+		return c.String(http.StatusTooManyRequests, "Too many failed login attempts.")
+	}
+
 	var user User
 	if err := h.DB.Get(&user, "SELECT * FROM `users` WHERE `code` = ?", req.Code); err != nil && err != sql.ErrNoRows {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	} else if err == sql.ErrNoRows {
-		return c.String(http.StatusUnauthorized, "Code or Password is wrong.")
+		return h.failLogin(c, req.Code, sql.NullString{}, ip, userAgent, now)
 	}
 
 	if bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(req.Password)) != nil {
-		return c.String(http.StatusUnauthorized, "Code or Password is wrong.")
+		return h.failLogin(c, req.Code, sql.NullString{String: user.ID, Valid: true}, ip, userAgent, now)
+	}
+
+	if user.Deactivated {
+		if err := recordLoginEvent(h.DB, user.Code, sql.NullString{String: user.ID, Valid: true}, LoginDeactivated, ip, userAgent, now); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(http.StatusForbidden, "This account is deactivated.")
 	}
 
 	sess, err := session.Get(SessionName, c)
@@ -280,15 +471,16 @@ func (h *handlers) Login(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "You are already logged in.")
 	}
 
-	sess.Values["userID"] = user.ID
-	sess.Values["userName"] = user.Name
-	sess.Values["isAdmin"] = user.Type == Teacher
-	sess.Options = &sessions.Options{
-		Path:   "/",
-		MaxAge: 3600,
+	if err := h.saveLoginSession(c, sess, user); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	if err := sess.Save(c.Request(), c.Response()); err != nil {
+	if err := recordLoginSuccess(h.DB, user.Code, ip); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := recordLoginEvent(h.DB, user.Code, sql.NullString{String: user.ID, Valid: true}, LoginSucceeded, ip, userAgent, now); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
@@ -323,26 +515,28 @@ type GetMeResponse struct {
 	Code    string `json:"code"`
 	Name    string `json:"name"`
 	IsAdmin bool   `json:"is_admin"`
+	UserProfile
 }
 
 // GetMe GET /api/users/me 自身の情報を取得
 func (h *handlers) GetMe(c echo.Context) error {
-	userID, userName, isAdmin, err := getUserInfo(c)
+	userID, userName, _, err := getUserInfo(c)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	var userCode string
-	if err := h.DB.Get(&userCode, "SELECT `code` FROM `users` WHERE `id` = ?", userID); err != nil {
+	var user User
+	if err := h.DB.Get(&user, "SELECT * FROM `users` WHERE `id` = ?", userID); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	return c.JSON(http.StatusOK, GetMeResponse{
-		Code:    userCode,
-		Name:    userName,
-		IsAdmin: isAdmin,
+		Code:        user.Code,
+		Name:        userName,
+		IsAdmin:     isStaff(user.Type),
+		UserProfile: newUserProfile(user),
 	})
 }
 
@@ -516,6 +710,7 @@ type Class struct {
 	Title            string `db:"title"`
 	Description      string `db:"description"`
 	SubmissionClosed bool   `db:"submission_closed"`
+	ScoresPublished  bool   `db:"scores_published"`
 }
 
 type GetGradeResponse struct {
@@ -533,14 +728,21 @@ type Summary struct {
 }
 
 type CourseResult struct {
-	Name             string       `json:"name"`
-	Code             string       `json:"code"`
-	TotalScore       int          `json:"total_score"`
-	TotalScoreTScore float64      `json:"total_score_t_score"` // 偏差値
-	TotalScoreAvg    float64      `json:"total_score_avg"`     // 平均値
-	TotalScoreMax    int          `json:"total_score_max"`     // 最大値
-	TotalScoreMin    int          `json:"total_score_min"`     // 最小値
-	ClassScores      []ClassScore `json:"class_scores"`
+	Name             string      `json:"name"`
+	Code             string      `json:"code"`
+	GradingType      GradingType `json:"grading_type"`
+	Grade            LetterGrade `json:"grade,omitempty"` // 修了済みの科目の評語 (S/A/B/C/F, 合否評価の科目は P/F)
+	TotalScore       int         `json:"total_score"`
+	TotalScoreTScore float64     `json:"total_score_t_score"` // 偏差値
+	TotalScoreAvg    float64     `json:"total_score_avg"`     // 平均値
+	TotalScoreMax    int         `json:"total_score_max"`     // 最大値
+	TotalScoreMin    int         `json:"total_score_min"`     // 最小値
+	// 四分位数と度数分布
+	TotalScoreQ1        float64           `json:"total_score_q1"`
+	TotalScoreMedian    float64           `json:"total_score_median"`
+	TotalScoreQ3        float64           `json:"total_score_q3"`
+	TotalScoreHistogram []HistogramBucket `json:"total_score_histogram"`
+	ClassScores         []ClassScore      `json:"class_scores"`
 }
 
 type ClassScore struct {
@@ -549,9 +751,17 @@ type ClassScore struct {
 	Part       uint8  `json:"part"`
 	Score      *int   `json:"score"`      // 0~100点
 	Submitters int    `json:"submitters"` // 提出した学生数
+	// ScoresPublished が false の講義は点数が未公開で、Score は null になる
+	ScoresPublished bool `json:"scores_published"`
+	// 採点済みの提出の四分位数と度数分布
+	ScoreQ1        float64           `json:"score_q1"`
+	ScoreMedian    float64           `json:"score_median"`
+	ScoreQ3        float64           `json:"score_q3"`
+	ScoreHistogram []HistogramBucket `json:"score_histogram"`
 }
 
 // GetGrades GET /api/users/me/grades 成績取得
+// 提出者数・合計点・GPAは成績の集計値(grade_aggregates.go)から取得する
 func (h *handlers) GetGrades(c echo.Context) error {
 	userID, _, _, err := getUserInfo(c)
 	if err != nil {
@@ -559,123 +769,175 @@ func (h *handlers) GetGrades(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	// 履修している科目一覧取得
-	var registeredCourses []Course
-	query := "SELECT `courses`.*" +
+	bucketWidth, err := parseBucketWidth(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid bucket_width.")
+	}
+
+	// 履修している科目一覧と自分の合計点の取得
+	var registeredCourses []struct {
+		Course
+		TotalScore int `db:"total_score"`
+	}
+	query := "SELECT `courses`.*, IFNULL(`course_score_totals`.`total_score`, 0) AS `total_score`" +
 		" FROM `registrations`" +
 		" JOIN `courses` ON `registrations`.`course_id` = `courses`.`id`" +
-		" WHERE `user_id` = ?"
+		" LEFT JOIN `course_score_totals` ON `course_score_totals`.`course_id` = `registrations`.`course_id` AND `course_score_totals`.`user_id` = `registrations`.`user_id`" +
+		" WHERE `registrations`.`user_id` = ?"
 	if err := h.DB.Select(&registeredCourses, query, userID); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	// 科目毎の成績計算処理
-	courseResults := make([]CourseResult, 0, len(registeredCourses))
-	myGPA := 0.0
-	myCredits := 0
+	courseIDs := make([]interface{}, 0, len(registeredCourses))
+	registeredCourseIDs := make([]string, 0, len(registeredCourses))
 	for _, course := range registeredCourses {
-		// 講義一覧の取得
-		var classes []Class
-		query = "SELECT *" +
-			" FROM `classes`" +
-			" WHERE `course_id` = ?" +
-			" ORDER BY `part` DESC"
-		if err := h.DB.Select(&classes, query, course.ID); err != nil {
+		courseIDs = append(courseIDs, course.ID)
+		registeredCourseIDs = append(registeredCourseIDs, course.ID)
+	}
+	policies, err := loadGradingPolicies(h.DB, registeredCourseIDs)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	maxScores, err := loadMaxScores(h.DB, policies)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	classScores := make(map[string][]ClassScore, len(registeredCourses))
+	totals := make(map[string][]int, len(registeredCourses))
+	if len(registeredCourses) > 0 {
+		// 講義毎の採点済みの点数一覧
+		var submissionScores []struct {
+			ClassID string `db:"class_id"`
+			Score   int    `db:"score"`
+		}
+		query = "SELECT `submissions`.`class_id`, `submissions`.`score`" +
+			" FROM `submissions`" +
+			" JOIN `classes` ON `classes`.`id` = `submissions`.`class_id`" +
+			" WHERE `classes`.`course_id` IN (" + placeholders(len(courseIDs)) + ") AND `classes`.`scores_published` = true AND `submissions`.`score` IS NOT NULL"
+		if err := h.DB.Select(&submissionScores, query, courseIDs...); err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
+		classScoreLists := make(map[string][]int)
+		for _, s := range submissionScores {
+			classScoreLists[s.ClassID] = append(classScoreLists[s.ClassID], s.Score)
+		}
 
-		// 講義毎の成績計算処理
-		classScores := make([]ClassScore, 0, len(classes))
-		var myTotalScore int
+		// 講義毎の提出者数と自分の点数
+		var classes []struct {
+			Class
+			Submitters int           `db:"submitters"`
+			MyScore    sql.NullInt64 `db:"my_score"`
+		}
+		query = "SELECT `classes`.*, IFNULL(`class_aggregates`.`submitters`, 0) AS `submitters`, `submissions`.`score` AS `my_score`" +
+			" FROM `classes`" +
+			" LEFT JOIN `class_aggregates` ON `class_aggregates`.`class_id` = `classes`.`id`" +
+			" LEFT JOIN `submissions` ON `submissions`.`class_id` = `classes`.`id` AND `submissions`.`user_id` = ?" +
+			" WHERE `classes`.`course_id` IN (" + placeholders(len(courseIDs)) + ")" +
+			" ORDER BY `classes`.`part` DESC"
+		if err := h.DB.Select(&classes, query, append([]interface{}{userID}, courseIDs...)...); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
 		for _, class := range classes {
-			var submissionsCount int
-			if err := h.DB.Get(&submissionsCount, "SELECT COUNT(*) FROM `submissions` WHERE `class_id` = ?", class.ID); err != nil {
-				c.Logger().Error(err)
-				return c.NoContent(http.StatusInternalServerError)
+			classScore := ClassScore{
+				ClassID:         class.ID,
+				Part:            class.Part,
+				Title:           class.Title,
+				Score:           nil,
+				Submitters:      class.Submitters,
+				ScoresPublished: class.ScoresPublished,
+
+				ScoreQ1:        percentileInt(classScoreLists[class.ID], 25, 0),
+				ScoreMedian:    medianInt(classScoreLists[class.ID], 0),
+				ScoreQ3:        percentileInt(classScoreLists[class.ID], 75, 0),
+				ScoreHistogram: newHistogram(classScoreLists[class.ID], histogramBucketWidth(bucketWidth, 100), 100),
 			}
-
-			var myScore sql.NullInt64
-			if err := h.DB.Get(&myScore, "SELECT `submissions`.`score` FROM `submissions` WHERE `user_id` = ? AND `class_id` = ?", userID, class.ID); err != nil && err != sql.ErrNoRows {
-				c.Logger().Error(err)
-				return c.NoContent(http.StatusInternalServerError)
-			} else if err == sql.ErrNoRows || !myScore.Valid {
-				classScores = append(classScores, ClassScore{
-					ClassID:    class.ID,
-					Part:       class.Part,
-					Title:      class.Title,
-					Score:      nil,
-					Submitters: submissionsCount,
-				})
-			} else {
-				score := int(myScore.Int64)
-				myTotalScore += score
-				classScores = append(classScores, ClassScore{
-					ClassID:    class.ID,
-					Part:       class.Part,
-					Title:      class.Title,
-					Score:      &score,
-					Submitters: submissionsCount,
-				})
+			// 点数を公開していない講義は自分の点数を返さない
+			if class.ScoresPublished && class.MyScore.Valid {
+				score := int(class.MyScore.Int64)
+				classScore.Score = &score
 			}
+			classScores[class.CourseID] = append(classScores[class.CourseID], classScore)
 		}
 
-		// この科目を履修している学生のTotalScore一覧を取得
-		var totals []int
-		query := "SELECT IFNULL(SUM(`submissions`.`score`), 0) AS `total_score`" +
-			" FROM `users`" +
-			" JOIN `registrations` ON `users`.`id` = `registrations`.`user_id`" +
-			" JOIN `courses` ON `registrations`.`course_id` = `courses`.`id`" +
-			" LEFT JOIN `classes` ON `courses`.`id` = `classes`.`course_id`" +
-			" LEFT JOIN `submissions` ON `users`.`id` = `submissions`.`user_id` AND `submissions`.`class_id` = `classes`.`id`" +
-			" WHERE `courses`.`id` = ?" +
-			" GROUP BY `users`.`id`"
-		if err := h.DB.Select(&totals, query, course.ID); err != nil {
+		// 科目を履修している学生のTotalScore一覧
+		var courseTotals []struct {
+			CourseID   string `db:"course_id"`
+			TotalScore int    `db:"total_score"`
+		}
+		query = "SELECT `registrations`.`course_id`, IFNULL(`course_score_totals`.`total_score`, 0) AS `total_score`" +
+			" FROM `registrations`" +
+			" LEFT JOIN `course_score_totals` ON `course_score_totals`.`course_id` = `registrations`.`course_id` AND `course_score_totals`.`user_id` = `registrations`.`user_id`" +
+			" WHERE `registrations`.`course_id` IN (" + placeholders(len(courseIDs)) + ")"
+		if err := h.DB.Select(&courseTotals, query, courseIDs...); err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
+		for _, total := range courseTotals {
+			totals[total.CourseID] = append(totals[total.CourseID], total.TotalScore)
+		}
+	}
+
+	// 科目毎の成績計算処理
+	courseResults := make([]CourseResult, 0, len(registeredCourses))
+	myGPA := 0.0
+	myCredits := 0
+	myGPACredits := 0
+	for _, course := range registeredCourses {
+		scores := classScores[course.ID]
+		if scores == nil {
+			scores = make([]ClassScore, 0)
+		}
+		policy := policies[course.ID]
+		grade, gradePoints, countsForGPA := policy.Grade(course.TotalScore, maxScores[course.ID])
 
-		courseResults = append(courseResults, CourseResult{
+		result := CourseResult{
 			Name:             course.Name,
 			Code:             course.Code,
-			TotalScore:       myTotalScore,
-			TotalScoreTScore: tScoreInt(myTotalScore, totals),
-			TotalScoreAvg:    averageInt(totals, 0),
-			TotalScoreMax:    maxInt(totals, 0),
-			TotalScoreMin:    minInt(totals, 0),
-			ClassScores:      classScores,
-		})
+			GradingType:      policy.Type,
+			TotalScore:       course.TotalScore,
+			TotalScoreTScore: tScoreInt(course.TotalScore, totals[course.ID]),
+			TotalScoreAvg:    averageInt(totals[course.ID], 0),
+			TotalScoreMax:    maxInt(totals[course.ID], 0),
+			TotalScoreMin:    minInt(totals[course.ID], 0),
+
+			TotalScoreQ1:        percentileInt(totals[course.ID], 25, 0),
+			TotalScoreMedian:    medianInt(totals[course.ID], 0),
+			TotalScoreQ3:        percentileInt(totals[course.ID], 75, 0),
+			TotalScoreHistogram: newHistogram(totals[course.ID], histogramBucketWidth(bucketWidth, maxScores[course.ID].Weighted), maxScores[course.ID].Weighted),
+			ClassScores:         scores,
+		}
 
 		// 自分のGPA計算
+		// 合否評価の科目は単位数には含めるがGPAには含めない
 		if course.Status == StatusClosed {
-			myGPA += float64(myTotalScore * int(course.Credit))
+			result.Grade = grade
 			myCredits += int(course.Credit)
+			if countsForGPA {
+				myGPA += float64(gradePoints * int(course.Credit))
+				myGPACredits += int(course.Credit)
+			}
 		}
+		courseResults = append(courseResults, result)
 	}
-	if myCredits > 0 {
-		myGPA = myGPA / 100 / float64(myCredits)
+	if myGPACredits > 0 {
+		myGPA = myGPA / 100 / float64(myGPACredits)
 	}
 
 	// GPAの統計値
-	// 一つでも修了した科目がある学生のGPA一覧
+	// GPAの計算に含める(合否評価以外の)科目を一つでも修了した学生のGPA一覧
 	var gpas []float64
-	query = "SELECT IFNULL(SUM(`submissions`.`score` * `courses`.`credit`), 0) / 100 / `credits`.`credits` AS `gpa`" +
-		" FROM `users`" +
-		" JOIN (" +
-		"     SELECT `users`.`id` AS `user_id`, SUM(`courses`.`credit`) AS `credits`" +
-		"     FROM `users`" +
-		"     JOIN `registrations` ON `users`.`id` = `registrations`.`user_id`" +
-		"     JOIN `courses` ON `registrations`.`course_id` = `courses`.`id` AND `courses`.`status` = ?" +
-		"     GROUP BY `users`.`id`" +
-		" ) AS `credits` ON `credits`.`user_id` = `users`.`id`" +
-		" JOIN `registrations` ON `users`.`id` = `registrations`.`user_id`" +
-		" JOIN `courses` ON `registrations`.`course_id` = `courses`.`id` AND `courses`.`status` = ?" +
-		" LEFT JOIN `classes` ON `courses`.`id` = `classes`.`course_id`" +
-		" LEFT JOIN `submissions` ON `users`.`id` = `submissions`.`user_id` AND `submissions`.`class_id` = `classes`.`id`" +
-		" WHERE `users`.`type` = ?" +
-		" GROUP BY `users`.`id`"
-	if err := h.DB.Select(&gpas, query, StatusClosed, StatusClosed, Student); err != nil {
+	query = "SELECT `user_gpa_aggregates`.`weighted_score` / 100 / `user_gpa_aggregates`.`gpa_credits` AS `gpa`" +
+		" FROM `user_gpa_aggregates`" +
+		" JOIN `users` ON `users`.`id` = `user_gpa_aggregates`.`user_id`" +
+		" WHERE `user_gpa_aggregates`.`gpa_credits` > 0 AND `users`.`type` = ?"
+	if err := h.DB.Select(&gpas, query, Student); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
@@ -698,110 +960,32 @@ func (h *handlers) GetGrades(c echo.Context) error {
 // ---------- Courses API ----------
 
 // SearchCourses GET /api/courses 科目検索
+// 通常はプロセス内の索引(CourseIndex)から検索し、mode=ranked の場合は searchCoursesRanked で関連度順に検索する
 func (h *handlers) SearchCourses(c echo.Context) error {
-	query := "SELECT `courses`.*, `users`.`name` AS `teacher`" +
-		" FROM `courses` JOIN `users` ON `courses`.`teacher_id` = `users`.`id`" +
-		" WHERE 1=1"
-	var condition string
-	var args []interface{}
-
-	// 無効な検索条件はエラーを返さず無視して良い
-
-	if courseType := c.QueryParam("type"); courseType != "" {
-		condition += " AND `courses`.`type` = ?"
-		args = append(args, courseType)
+	if c.QueryParam("mode") == "ranked" {
+		return h.searchCoursesRanked(c)
 	}
 
-	if credit, err := strconv.Atoi(c.QueryParam("credit")); err == nil && credit > 0 {
-		condition += " AND `courses`.`credit` = ?"
-		args = append(args, credit)
-	}
-
-	if teacher := c.QueryParam("teacher"); teacher != "" {
-		condition += " AND `users`.`name` = ?"
-		args = append(args, teacher)
-	}
-
-	if period, err := strconv.Atoi(c.QueryParam("period")); err == nil && period > 0 {
-		condition += " AND `courses`.`period` = ?"
-		args = append(args, period)
-	}
-
-	if dayOfWeek := c.QueryParam("day_of_week"); dayOfWeek != "" {
-		condition += " AND `courses`.`day_of_week` = ?"
-		args = append(args, dayOfWeek)
-	}
-
-	if keywords := c.QueryParam("keywords"); keywords != "" {
-		arr := strings.Split(keywords, " ")
-		var nameCondition string
-		for _, keyword := range arr {
-			nameCondition += " AND `courses`.`name` LIKE ?"
-			args = append(args, "%"+keyword+"%")
-		}
-		var keywordsCondition string
-		for _, keyword := range arr {
-			keywordsCondition += " AND `courses`.`keywords` LIKE ?"
-			args = append(args, "%"+keyword+"%")
-		}
-		condition += fmt.Sprintf(" AND ((1=1%s) OR (1=1%s))", nameCondition, keywordsCondition)
-	}
-
-	if status := c.QueryParam("status"); status != "" {
-		condition += " AND `courses`.`status` = ?"
-		args = append(args, status)
-	}
-
-	condition += " ORDER BY `courses`.`code`"
-
-	var page int
-	if c.QueryParam("page") == "" {
-		page = 1
-	} else {
-		var err error
-		page, err = strconv.Atoi(c.QueryParam("page"))
-		if err != nil || page <= 0 {
-			return c.String(http.StatusBadRequest, "Invalid page.")
-		}
+	params := parseCourseSearchParams(c)
+	p, err := parsePagination(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid page.")
 	}
 	limit := 20
-	offset := limit * (page - 1)
 
-	// limitより多く上限を設定し、実際にlimitより多くレコードが取得できた場合は次のページが存在する
-	condition += " LIMIT ? OFFSET ?"
-	args = append(args, limit+1, offset)
+	res, hasMore := h.CourseIndex.Search(params, p, limit)
 
-	// 結果が0件の時は空配列を返却
-	res := make([]GetCourseDetailResponse, 0)
-	if err := h.DB.Select(&res, query+condition, args...); err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+	var firstCode, lastCode string
+	if len(res) > 0 {
+		firstCode, lastCode = res[0].Code, res[len(res)-1].Code
 	}
-
-	var links []string
-	linkURL, err := url.Parse(c.Request().URL.Path + "?" + c.Request().URL.RawQuery)
+	link, err := pagingLinkHeader(c, p, hasMore, firstCode, lastCode)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-
-	q := linkURL.Query()
-	if page > 1 {
-		q.Set("page", strconv.Itoa(page-1))
-		linkURL.RawQuery = q.Encode()
-		links = append(links, fmt.Sprintf("<%v>; rel=\"prev\"", linkURL))
-	}
-	if len(res) > limit {
-		q.Set("page", strconv.Itoa(page+1))
-		linkURL.RawQuery = q.Encode()
-		links = append(links, fmt.Sprintf("<%v>; rel=\"next\"", linkURL))
-	}
-	if len(links) > 0 {
-		c.Response().Header().Set("Link", strings.Join(links, ","))
-	}
-
-	if len(res) == limit+1 {
-		res = res[:len(res)-1]
+	if link != "" {
+		c.Response().Header().Set("Link", link)
 	}
 
 	return c.JSON(http.StatusOK, res)
@@ -816,6 +1000,8 @@ type AddCourseRequest struct {
 	Period      int        `json:"period"`
 	DayOfWeek   DayOfWeek  `json:"day_of_week"`
 	Keywords    string     `json:"keywords"`
+	// GradingPolicy を省略した場合はデフォルトの方針で評価する
+	GradingPolicy *GradingPolicy `json:"grading_policy"`
 }
 
 type AddCourseResponse struct {
@@ -835,17 +1021,39 @@ func (h *handlers) AddCourse(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid format.")
 	}
 
+	if err := validateCourseCode(req.Code); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid course code.")
+	}
 	if req.Type != LiberalArts && req.Type != MajorSubjects {
 		return c.String(http.StatusBadRequest, "Invalid course type.")
 	}
 	if !contains(daysOfWeek, req.DayOfWeek) {
 		return c.String(http.StatusBadRequest, "Invalid day of week.")
 	}
+	if err := validateCredit(req.Credit); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid credit.")
+	}
+	if !h.Timetable.HasPeriod(req.Period) {
+		return c.String(http.StatusBadRequest, "Invalid period.")
+	}
+	if req.GradingPolicy != nil {
+		if err := req.GradingPolicy.normalize(); err != nil {
+			return c.String(http.StatusBadRequest, "Invalid grading policy: "+err.Error()+".")
+		}
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
 
 	courseID := newULID()
-	_, err = h.DB.Exec("INSERT INTO `courses` (`id`, `code`, `type`, `name`, `description`, `credit`, `period`, `day_of_week`, `teacher_id`, `keywords`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+	_, err = tx.Exec("INSERT INTO `courses` (`id`, `code`, `type`, `name`, `description`, `credit`, `period`, `day_of_week`, `teacher_id`, `keywords`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		courseID, req.Code, req.Type, req.Name, req.Description, req.Credit, req.Period, req.DayOfWeek, userID, req.Keywords)
 	if err != nil {
+		_ = tx.Rollback()
 		if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
 			var course Course
 			if err := h.DB.Get(&course, "SELECT * FROM `courses` WHERE `code` = ?", req.Code); err != nil {
@@ -860,6 +1068,26 @@ func (h *handlers) AddCourse(c echo.Context) error {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	if req.GradingPolicy != nil {
+		if err := saveGradingPolicy(tx, courseID, req.GradingPolicy); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	var course GetCourseDetailResponse
+	query := "SELECT `courses`.*, `users`.`name` AS `teacher`" +
+		" FROM `courses` JOIN `users` ON `courses`.`teacher_id` = `users`.`id`" +
+		" WHERE `courses`.`id` = ?"
+	if err := tx.Get(&course, query, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	h.CourseIndex.Add(course)
 
 	return c.JSON(http.StatusCreated, AddCourseResponse{ID: courseID})
 }
@@ -918,12 +1146,11 @@ func (h *handlers) SetCourseStatus(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var count int
-	if err := tx.Get(&count, "SELECT COUNT(*) FROM `courses` WHERE `id` = ? FOR UPDATE", courseID); err != nil {
+	var course Course
+	if err := tx.Get(&course, "SELECT * FROM `courses` WHERE `id` = ? FOR UPDATE", courseID); err != nil && err != sql.ErrNoRows {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
-	}
-	if count == 0 {
+	} else if err == sql.ErrNoRows {
 		return c.String(http.StatusNotFound, "No such course.")
 	}
 
@@ -932,10 +1159,24 @@ func (h *handlers) SetCourseStatus(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	// 修了済みの科目の単位と成績をGPAの集計値に反映する
+	if course.Status != StatusClosed && req.Status == StatusClosed {
+		if err := closeCourseGPA(tx, &course, 1); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	} else if course.Status == StatusClosed && req.Status != StatusClosed {
+		if err := closeCourseGPA(tx, &course, -1); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	h.CourseIndex.SetStatus(courseID, req.Status)
 
 	return c.NoContent(http.StatusOK)
 }
@@ -947,6 +1188,7 @@ type ClassWithSubmitted struct {
 	Title            string `db:"title"`
 	Description      string `db:"description"`
 	SubmissionClosed bool   `db:"submission_closed"`
+	ScoresPublished  bool   `db:"scores_published"`
 	Submitted        bool   `db:"submitted"`
 }
 
@@ -956,7 +1198,10 @@ type GetClassResponse struct {
 	Title            string `json:"title"`
 	Description      string `json:"description"`
 	SubmissionClosed bool   `json:"submission_closed"`
+	ScoresPublished  bool   `json:"scores_published"`
 	Submitted        bool   `json:"submitted"`
+	// Materials は講義資料。科目の担当者と履修している学生以外には空配列を返す
+	Materials []ClassMaterialResponse `json:"materials"`
 }
 
 // GetClasses GET /api/courses/:courseID/classes 科目に紐づく講義一覧の取得
@@ -996,6 +1241,24 @@ func (h *handlers) GetClasses(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	materials := make(map[string][]ClassMaterial)
+	canAccessMaterials, err := h.canAccessCourseMaterials(userID, courseID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if canAccessMaterials {
+		classIDs := make([]string, 0, len(classes))
+		for _, class := range classes {
+			classIDs = append(classIDs, class.ID)
+		}
+		materials, err = loadClassMaterials(tx, classIDs)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -1004,13 +1267,19 @@ func (h *handlers) GetClasses(c echo.Context) error {
 	// 結果が0件の時は空配列を返却
 	res := make([]GetClassResponse, 0, len(classes))
 	for _, class := range classes {
+		classMaterials := make([]ClassMaterialResponse, 0, len(materials[class.ID]))
+		for _, m := range materials[class.ID] {
+			classMaterials = append(classMaterials, m.response(courseID))
+		}
 		res = append(res, GetClassResponse{
 			ID:               class.ID,
 			Part:             class.Part,
 			Title:            class.Title,
 			Description:      class.Description,
 			SubmissionClosed: class.SubmissionClosed,
+			ScoresPublished:  class.ScoresPublished,
 			Submitted:        class.Submitted,
+			Materials:        classMaterials,
 		})
 	}
 
@@ -1120,7 +1389,7 @@ func (h *handlers) SubmitAssignment(c echo.Context) error {
 	}
 
 	var submissionClosed bool
-	if err := tx.Get(&submissionClosed, "SELECT `submission_closed` FROM `classes` WHERE `id` = ? FOR SHARE", classID); err != nil && err != sql.ErrNoRows {
+	if err := tx.Get(&submissionClosed, "SELECT `submission_closed` FROM `classes` WHERE `id` = ? AND `course_id` = ? FOR SHARE", classID, courseID); err != nil && err != sql.ErrNoRows {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	} else if err == sql.ErrNoRows {
@@ -1136,10 +1405,21 @@ func (h *handlers) SubmitAssignment(c echo.Context) error {
 	}
 	defer file.Close()
 
-	if _, err := tx.Exec("INSERT INTO `submissions` (`user_id`, `class_id`, `file_name`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `file_name` = VALUES(`file_name`)", userID, classID, header.Filename); err != nil {
+	result, err := tx.Exec("INSERT INTO `submissions` (`user_id`, `class_id`, `file_name`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `file_name` = VALUES(`file_name`)", userID, classID, header.Filename)
+	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	// 再提出の場合は更新された行数が 2 (ファイル名が同じ場合は 0) になる
+	if rows, err := result.RowsAffected(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if rows == 1 {
+		if err := addSubmitter(tx, classID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
 
 	data, err := io.ReadAll(file)
 	if err != nil {
@@ -1168,6 +1448,7 @@ type Score struct {
 
 // RegisterScores PUT /api/courses/:courseID/classes/:classID/assignments/scores 採点結果登録
 func (h *handlers) RegisterScores(c echo.Context) error {
+	courseID := c.Param("courseID")
 	classID := c.Param("classID")
 
 	tx, err := h.DB.Beginx()
@@ -1177,15 +1458,15 @@ func (h *handlers) RegisterScores(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var submissionClosed bool
-	if err := tx.Get(&submissionClosed, "SELECT `submission_closed` FROM `classes` WHERE `id` = ? FOR SHARE", classID); err != nil && err != sql.ErrNoRows {
+	var class Class
+	if err := tx.Get(&class, "SELECT * FROM `classes` WHERE `id` = ? AND `course_id` = ? FOR SHARE", classID, courseID); err != nil && err != sql.ErrNoRows {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	} else if err == sql.ErrNoRows {
 		return c.String(http.StatusNotFound, "No such class.")
 	}
 
-	if !submissionClosed {
+	if !class.SubmissionClosed {
 		return c.String(http.StatusBadRequest, "This assignment is not closed yet.")
 	}
 
@@ -1194,11 +1475,71 @@ func (h *handlers) RegisterScores(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid format.")
 	}
 
+	// 成績の集計値に反映するため、科目のステータスを変更されないようにしてから採点前の点数を取得する
+	var course Course
+	if err := tx.Get(&course, "SELECT * FROM `courses` WHERE `id` = ? FOR SHARE", class.CourseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	policy, err := loadGradingPolicy(tx, course.ID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	maxScore, err := loadMaxScore(tx, course.ID, policy)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	weight := policy.Weight(class.Part)
+	var submissions []struct {
+		UserID   string        `db:"user_id"`
+		UserCode string        `db:"user_code"`
+		Score    sql.NullInt64 `db:"score"`
+	}
+	query := "SELECT `submissions`.`user_id`, `users`.`code` AS `user_code`, `submissions`.`score`" +
+		" FROM `submissions`" +
+		" JOIN `users` ON `users`.`id` = `submissions`.`user_id`" +
+		" WHERE `submissions`.`class_id` = ?" +
+		" ORDER BY `submissions`.`user_id`" +
+		" FOR UPDATE"
+	if err := tx.Select(&submissions, query, classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	userIDs := make(map[string]string, len(submissions))
+	for _, submission := range submissions {
+		userIDs[submission.UserCode] = submission.UserID
+	}
+
+	newScores := make(map[string]int, len(req))
 	for _, score := range req {
-		if _, err := tx.Exec("UPDATE `submissions` JOIN `users` ON `users`.`id` = `submissions`.`user_id` SET `score` = ? WHERE `users`.`code` = ? AND `class_id` = ?", score.Score, score.UserCode, classID); err != nil {
+		userID, ok := userIDs[score.UserCode]
+		if !ok {
+			// 課題を提出していない学生の点数は登録しない
+			continue
+		}
+		if _, err := tx.Exec("UPDATE `submissions` SET `score` = ? WHERE `user_id` = ? AND `class_id` = ?", score.Score, userID, classID); err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
+		newScores[userID] = score.Score
+	}
+
+	// 点数を公開していない講義の点数は、公開するまで合計点に含めない
+	// デッドロックを避けるため、集計値の行は user_id の順に更新する
+	if class.ScoresPublished {
+		for _, submission := range submissions {
+			score, ok := newScores[submission.UserID]
+			if !ok {
+				continue
+			}
+			delta := (score - int(submission.Score.Int64)) * weight
+			if err := addCourseScore(tx, &course, policy, maxScore, submission.UserID, delta); err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -1217,6 +1558,7 @@ type Submission struct {
 
 // DownloadSubmittedAssignments GET /api/courses/:courseID/classes/:classID/assignments/export 提出済みの課題ファイルをzip形式で一括ダウンロード
 func (h *handlers) DownloadSubmittedAssignments(c echo.Context) error {
+	courseID := c.Param("courseID")
 	classID := c.Param("classID")
 
 	tx, err := h.DB.Beginx()
@@ -1227,7 +1569,7 @@ func (h *handlers) DownloadSubmittedAssignments(c echo.Context) error {
 	defer tx.Rollback()
 
 	var classCount int
-	if err := tx.Get(&classCount, "SELECT COUNT(*) FROM `classes` WHERE `id` = ? FOR UPDATE", classID); err != nil {
+	if err := tx.Get(&classCount, "SELECT COUNT(*) FROM `classes` WHERE `id` = ? AND `course_id` = ? FOR UPDATE", classID, courseID); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
@@ -1331,25 +1673,75 @@ func (h *handlers) GetAnnouncementList(c echo.Context) error {
 		args = append(args, courseID)
 	}
 
+	if q := c.QueryParam("q"); q != "" {
+		// BOOLEAN MODE では + - * " などが演算子として解釈されるので、科目検索と同様に NATURAL LANGUAGE MODE で検索する
+		query += " AND MATCH (`announcements`.`title`, `announcements`.`message`) AGAINST (? IN NATURAL LANGUAGE MODE)"
+		args = append(args, q)
+	}
+
+	if c.QueryParam("unread") == "true" {
+		query += " AND NOT `unread_announcements`.`is_deleted`"
+	}
+
+	// お知らせの ID は ULID なので、期間指定は ID の範囲として扱う
+	// 日付のみの指定は学内の時刻(Timetable.Location)の日付とする
+	if since := c.QueryParam("since"); since != "" {
+		t, _, err := parseDateParam(since, h.Timetable.Location)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid since.")
+		}
+		lowerBound, err := ulidLowerBound(t)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid since.")
+		}
+		query += " AND `announcements`.`id` >= ?"
+		args = append(args, lowerBound)
+	}
+	if until := c.QueryParam("until"); until != "" {
+		t, dateOnly, err := parseDateParam(until, h.Timetable.Location)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid until.")
+		}
+		// 日付のみの指定はその日の終わりまでを含む
+		if dateOnly {
+			t = t.AddDate(0, 0, 1)
+		} else {
+			t = t.Add(time.Millisecond)
+		}
+		upperBound, err := ulidLowerBound(t)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid until.")
+		}
+		query += " AND `announcements`.`id` < ?"
+		args = append(args, upperBound)
+	}
+
 	query += " AND `unread_announcements`.`user_id` = ?" +
-		" AND `registrations`.`user_id` = ?" +
-		" ORDER BY `announcements`.`id` DESC" +
-		" LIMIT ? OFFSET ?"
+		" AND `registrations`.`user_id` = ?"
 	args = append(args, userID, userID)
 
-	var page int
-	if c.QueryParam("page") == "" {
-		page = 1
-	} else {
-		page, err = strconv.Atoi(c.QueryParam("page"))
-		if err != nil || page <= 0 {
-			return c.String(http.StatusBadRequest, "Invalid page.")
-		}
+	p, err := parsePagination(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid page.")
 	}
 	limit := 20
-	offset := limit * (page - 1)
+
 	// limitより多く上限を設定し、実際にlimitより多くレコードが取得できた場合は次のページが存在する
-	args = append(args, limit+1, offset)
+	switch {
+	case p.Page > 0:
+		// page= による指定は非推奨だが互換性のために残している
+		query += " ORDER BY `announcements`.`id` DESC LIMIT ? OFFSET ?"
+		args = append(args, limit+1, limit*(p.Page-1))
+	case p.Direction == CursorPrev:
+		query += " AND `announcements`.`id` > ? ORDER BY `announcements`.`id` LIMIT ?"
+		args = append(args, p.Key, limit+1)
+	case p.Direction == CursorNext:
+		query += " AND `announcements`.`id` < ? ORDER BY `announcements`.`id` DESC LIMIT ?"
+		args = append(args, p.Key, limit+1)
+	default:
+		query += " ORDER BY `announcements`.`id` DESC LIMIT ?"
+		args = append(args, limit+1)
+	}
 
 	if err := tx.Select(&announcements, query, args...); err != nil {
 		c.Logger().Error(err)
@@ -1367,30 +1759,27 @@ func (h *handlers) GetAnnouncementList(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	var links []string
-	linkURL, err := url.Parse(c.Request().URL.Path + "?" + c.Request().URL.RawQuery)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+	hasMore := len(announcements) > limit
+	if hasMore {
+		announcements = announcements[:limit]
 	}
-
-	q := linkURL.Query()
-	if page > 1 {
-		q.Set("page", strconv.Itoa(page-1))
-		linkURL.RawQuery = q.Encode()
-		links = append(links, fmt.Sprintf("<%v>; rel=\"prev\"", linkURL))
+	if p.Direction == CursorPrev {
+		for i, j := 0, len(announcements)-1; i < j; i, j = i+1, j-1 {
+			announcements[i], announcements[j] = announcements[j], announcements[i]
+		}
 	}
-	if len(announcements) > limit {
-		q.Set("page", strconv.Itoa(page+1))
-		linkURL.RawQuery = q.Encode()
-		links = append(links, fmt.Sprintf("<%v>; rel=\"next\"", linkURL))
+
+	var firstID, lastID string
+	if len(announcements) > 0 {
+		firstID, lastID = announcements[0].ID, announcements[len(announcements)-1].ID
 	}
-	if len(links) > 0 {
-		c.Response().Header().Set("Link", strings.Join(links, ","))
+	link, err := pagingLinkHeader(c, p, hasMore, firstID, lastID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
-
-	if len(announcements) == limit+1 {
-		announcements = announcements[:len(announcements)-1]
+	if link != "" {
+		c.Response().Header().Set("Link", link)
 	}
 
 	// 対象になっているお知らせが0件の時は空配列を返却
@@ -1410,19 +1799,35 @@ type Announcement struct {
 }
 
 type AddAnnouncementRequest struct {
-	ID       string `json:"id"`
-	CourseID string `json:"course_id"`
-	Title    string `json:"title"`
-	Message  string `json:"message"`
+	ID       string `json:"id" form:"id"`
+	CourseID string `json:"course_id" form:"course_id"`
+	Title    string `json:"title" form:"title"`
+	Message  string `json:"message" form:"message"`
 }
 
 // AddAnnouncement POST /api/announcements 新規お知らせ追加
 func (h *handlers) AddAnnouncement(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	var req AddAnnouncementRequest
 	if err := c.Bind(&req); err != nil {
 		return c.String(http.StatusBadRequest, "Invalid format.")
 	}
 
+	// multipart/form-data で送られてきた場合は添付ファイルも受け付ける
+	var attachments []*multipart.FileHeader
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		form, err := c.MultipartForm()
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid format.")
+		}
+		attachments = form.File["files"]
+	}
+
 	tx, err := h.DB.Beginx()
 	if err != nil {
 		c.Logger().Error(err)
@@ -1430,14 +1835,17 @@ func (h *handlers) AddAnnouncement(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var count int
-	if err := tx.Get(&count, "SELECT COUNT(*) FROM `courses` WHERE `id` = ?", req.CourseID); err != nil {
+	role, courseExists, err := h.getCourseRole(userID, req.CourseID)
+	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	if count == 0 {
+	if !courseExists {
 		return c.String(http.StatusNotFound, "No such course.")
 	}
+	if !role.Can(PermPostAnnouncement) {
+		return c.String(http.StatusForbidden, "You are not allowed to manage this course.")
+	}
 
 	if _, err := tx.Exec("INSERT INTO `announcements` (`id`, `course_id`, `title`, `message`) VALUES (?, ?, ?, ?)",
 		req.ID, req.CourseID, req.Title, req.Message); err != nil {
@@ -1460,7 +1868,7 @@ func (h *handlers) AddAnnouncement(c echo.Context) error {
 	var targets []User
 	query := "SELECT `users`.* FROM `users`" +
 		" JOIN `registrations` ON `users`.`id` = `registrations`.`user_id`" +
-		" WHERE `registrations`.`course_id` = ?"
+		" WHERE `registrations`.`course_id` = ? AND NOT `users`.`deactivated`"
 	if err := tx.Select(&targets, query, req.CourseID); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -1473,21 +1881,53 @@ func (h *handlers) AddAnnouncement(c echo.Context) error {
 		}
 	}
 
+	// 添付ファイルは一時ファイルに書き込み、コミットに成功してから本来のパスに移動する
+	var staged stagedFiles
+	defer staged.discard()
+	for _, fileHeader := range attachments {
+		attachmentID := newULID()
+		if _, err := tx.Exec("INSERT INTO `announcement_attachments` (`id`, `announcement_id`, `file_name`) VALUES (?, ?, ?)", attachmentID, req.ID, fileHeader.Filename); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		file, err := fileHeader.Open()
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid file.")
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		if err := staged.stage(announcementAttachmentPath(req.ID, attachmentID), data); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	if err := staged.commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
 	return c.NoContent(http.StatusCreated)
 }
 
 type AnnouncementDetail struct {
-	ID         string `json:"id" db:"id"`
-	CourseID   string `json:"course_id" db:"course_id"`
-	CourseName string `json:"course_name" db:"course_name"`
-	Title      string `json:"title" db:"title"`
-	Message    string `json:"message" db:"message"`
-	Unread     bool   `json:"unread" db:"unread"`
+	ID          string                           `json:"id" db:"id"`
+	CourseID    string                           `json:"course_id" db:"course_id"`
+	CourseName  string                           `json:"course_name" db:"course_name"`
+	Title       string                           `json:"title" db:"title"`
+	Message     string                           `json:"message" db:"message"`
+	Unread      bool                             `json:"unread" db:"unread"`
+	Attachments []AnnouncementAttachmentResponse `json:"attachments" db:"-"`
 }
 
 // GetAnnouncementDetail GET /api/announcements/:announcementID お知らせ詳細取得
@@ -1530,6 +1970,21 @@ func (h *handlers) GetAnnouncementDetail(c echo.Context) error {
 		return c.String(http.StatusNotFound, "No such announcement.")
 	}
 
+	var attachments []AnnouncementAttachment
+	if err := tx.Select(&attachments, "SELECT * FROM `announcement_attachments` WHERE `announcement_id` = ? ORDER BY `id`", announcementID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 添付ファイルが0件の時は空配列を返却
+	announcement.Attachments = make([]AnnouncementAttachmentResponse, 0, len(attachments))
+	for _, attachment := range attachments {
+		announcement.Attachments = append(announcement.Attachments, AnnouncementAttachmentResponse{
+			ID:       attachment.ID,
+			FileName: attachment.FileName,
+			URL:      fmt.Sprintf("/api/announcements/%s/attachments/%s", announcementID, attachment.ID),
+		})
+	}
+
 	if _, err := tx.Exec("UPDATE `unread_announcements` SET `is_deleted` = true WHERE `announcement_id` = ? AND `user_id` = ?", announcementID, userID); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
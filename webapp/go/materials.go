@@ -0,0 +1,454 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// MaterialKind は講義資料の種類
+type MaterialKind string
+
+const (
+	MaterialFile MaterialKind = "file"
+	MaterialLink MaterialKind = "link"
+)
+
+type ClassMaterial struct {
+	ID        string       `db:"id"`
+	ClassID   string       `db:"class_id"`
+	Kind      MaterialKind `db:"kind"`
+	Title     string       `db:"title"`
+	FileName  string       `db:"file_name"`
+	URL       string       `db:"url"`
+	CreatedAt time.Time    `db:"created_at"`
+}
+
+type ClassMaterialResponse struct {
+	ID       string       `json:"id"`
+	Kind     MaterialKind `json:"kind"`
+	Title    string       `json:"title"`
+	FileName string       `json:"file_name,omitempty"`
+	// URL はファイルの場合はダウンロード用のURL、リンクの場合はリンク先
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (m *ClassMaterial) response(courseID string) ClassMaterialResponse {
+	res := ClassMaterialResponse{
+		ID:        m.ID,
+		Kind:      m.Kind,
+		Title:     m.Title,
+		URL:       m.URL,
+		CreatedAt: m.CreatedAt,
+	}
+	if m.Kind == MaterialFile {
+		res.FileName = m.FileName
+		res.URL = fmt.Sprintf("/api/courses/%s/classes/%s/materials/%s", courseID, m.ClassID, m.ID)
+	}
+	return res
+}
+
+func classMaterialPath(materialID string) string {
+	return AssignmentsDirectory + "material-" + materialID
+}
+
+func courseSyllabusPath(courseID string) string {
+	return AssignmentsDirectory + "syllabus-" + courseID
+}
+
+// isValidMaterialURL はリンクの講義資料として登録できるURL(http, https)かどうかを返す
+func isValidMaterialURL(s string) bool {
+	if len(s) > 2048 {
+		return false
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// loadClassMaterials は講義毎の資料を追加した順に取得する
+func loadClassMaterials(q sqlx.Queryer, classIDs []string) (map[string][]ClassMaterial, error) {
+	materials := make(map[string][]ClassMaterial, len(classIDs))
+	if len(classIDs) == 0 {
+		return materials, nil
+	}
+	args := make([]interface{}, 0, len(classIDs))
+	for _, id := range classIDs {
+		args = append(args, id)
+	}
+	var rows []ClassMaterial
+	if err := sqlx.Select(q, &rows, "SELECT * FROM `class_materials` WHERE `class_id` IN ("+placeholders(len(args))+") ORDER BY `id`", args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		materials[row.ClassID] = append(materials[row.ClassID], row)
+	}
+	return materials, nil
+}
+
+// canAccessCourseMaterials は講義資料を閲覧できるユーザ(科目の担当者か履修している学生)かどうかを返す
+func (h *handlers) canAccessCourseMaterials(userID string, courseID string) (bool, error) {
+	role, courseExists, err := h.getCourseRole(userID, courseID)
+	if err != nil || !courseExists {
+		return false, err
+	}
+	if role != CourseRoleNone {
+		return true, nil
+	}
+	var registrationCount int
+	if err := h.DB.Get(&registrationCount, "SELECT COUNT(*) FROM `registrations` WHERE `course_id` = ? AND `user_id` = ?", courseID, userID); err != nil {
+		return false, err
+	}
+	return registrationCount > 0, nil
+}
+
+// DownloadSyllabus GET /api/courses/:courseID/syllabus シラバスのダウンロード
+// シラバスは履修登録の前に参照するものなので、履修していない学生もダウンロードできる
+func (h *handlers) DownloadSyllabus(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	var fileName string
+	if err := h.DB.Get(&fileName, "SELECT `file_name` FROM `course_syllabi` WHERE `course_id` = ?", courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such syllabus.")
+	}
+
+	return c.Attachment(courseSyllabusPath(courseID), fileName)
+}
+
+// SetSyllabus PUT /api/courses/:courseID/syllabus シラバスのアップロード
+func (h *handlers) SetSyllabus(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	file, header, err := c.Request().FormFile("file")
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid file.")
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.Get(&count, "SELECT COUNT(*) FROM `courses` WHERE `id` = ? FOR SHARE", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+
+	if _, err := tx.Exec("INSERT INTO `course_syllabi` (`course_id`, `file_name`, `updated_at`) VALUES (?, ?, NOW(6))"+
+		" ON DUPLICATE KEY UPDATE `file_name` = VALUES(`file_name`), `updated_at` = VALUES(`updated_at`)", courseID, header.Filename); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 既存のシラバスを上書きするので、一時ファイルに書き込んでコミットに成功してから置き換える
+	var staged stagedFiles
+	defer staged.discard()
+	if err := staged.stage(courseSyllabusPath(courseID), data); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := staged.commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// DeleteSyllabus DELETE /api/courses/:courseID/syllabus シラバスの削除
+func (h *handlers) DeleteSyllabus(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM `course_syllabi` WHERE `course_id` = ?", courseID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if n == 0 {
+		return c.String(http.StatusNotFound, "No such syllabus.")
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// ファイルはコミットに成功してから削除する
+	if err := os.Remove(courseSyllabusPath(courseID)); err != nil && !os.IsNotExist(err) {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type AddClassMaterialRequest struct {
+	Title string `json:"title" form:"title"`
+	// URL はリンクの資料の場合に指定する。ファイルの場合は multipart/form-data の file で送る
+	URL string `json:"url" form:"url"`
+}
+
+type AddClassMaterialResponse struct {
+	ID string `json:"id"`
+}
+
+// AddClassMaterial POST /api/courses/:courseID/classes/:classID/materials 講義資料(ファイルまたはリンク)の追加
+func (h *handlers) AddClassMaterial(c echo.Context) error {
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+
+	var req AddClassMaterialRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+
+	var header *multipart.FileHeader
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		file, fileHeader, err := c.Request().FormFile("file")
+		if err != nil && err != http.ErrMissingFile {
+			return c.String(http.StatusBadRequest, "Invalid file.")
+		} else if err == nil {
+			file.Close()
+			header = fileHeader
+		}
+	}
+	kind := MaterialLink
+	if header != nil {
+		if req.URL != "" {
+			return c.String(http.StatusBadRequest, "Specify either file or url.")
+		}
+		kind = MaterialFile
+	} else if !isValidMaterialURL(req.URL) {
+		return c.String(http.StatusBadRequest, "Invalid url.")
+	}
+	if req.Title == "" {
+		if kind == MaterialFile {
+			req.Title = header.Filename
+		} else {
+			req.Title = req.URL
+		}
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var classCount int
+	if err := tx.Get(&classCount, "SELECT COUNT(*) FROM `classes` WHERE `id` = ? AND `course_id` = ? FOR SHARE", classID, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if classCount == 0 {
+		return c.String(http.StatusNotFound, "No such class.")
+	}
+
+	materialID := newULID()
+	material := ClassMaterial{
+		ID:      materialID,
+		ClassID: classID,
+		Kind:    kind,
+		Title:   req.Title,
+		URL:     req.URL,
+	}
+	if kind == MaterialFile {
+		material.FileName = header.Filename
+	}
+	if _, err := tx.Exec("INSERT INTO `class_materials` (`id`, `class_id`, `kind`, `title`, `file_name`, `url`, `created_at`) VALUES (?, ?, ?, ?, ?, ?, NOW(6))",
+		material.ID, material.ClassID, material.Kind, material.Title, material.FileName, material.URL); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// ファイルは一時ファイルに書き込み、コミットに成功してから本来のパスに移動する
+	var staged stagedFiles
+	defer staged.discard()
+	if kind == MaterialFile {
+		file, err := header.Open()
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid file.")
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if err := staged.stage(classMaterialPath(materialID), data); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := staged.commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, AddClassMaterialResponse{ID: materialID})
+}
+
+// GetClassMaterials GET /api/courses/:courseID/classes/:classID/materials 講義資料一覧の取得
+func (h *handlers) GetClassMaterials(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+
+	var classCount int
+	if err := h.DB.Get(&classCount, "SELECT COUNT(*) FROM `classes` WHERE `id` = ? AND `course_id` = ?", classID, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if classCount == 0 {
+		return c.String(http.StatusNotFound, "No such class.")
+	}
+	if ok, err := h.canAccessCourseMaterials(userID, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if !ok {
+		return c.String(http.StatusForbidden, "You have not taken this course.")
+	}
+
+	materials, err := loadClassMaterials(h.DB, []string{classID})
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	res := make([]ClassMaterialResponse, 0, len(materials[classID]))
+	for _, m := range materials[classID] {
+		res = append(res, m.response(courseID))
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// DownloadClassMaterial GET /api/courses/:courseID/classes/:classID/materials/:materialID 講義資料のダウンロード
+// リンクの資料の場合はリンク先にリダイレクトする
+func (h *handlers) DownloadClassMaterial(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+	materialID := c.Param("materialID")
+
+	var material ClassMaterial
+	query := "SELECT `class_materials`.* FROM `class_materials`" +
+		" JOIN `classes` ON `classes`.`id` = `class_materials`.`class_id`" +
+		" WHERE `class_materials`.`id` = ? AND `class_materials`.`class_id` = ? AND `classes`.`course_id` = ?"
+	if err := h.DB.Get(&material, query, materialID, classID, courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such material.")
+	}
+	if ok, err := h.canAccessCourseMaterials(userID, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if !ok {
+		return c.String(http.StatusForbidden, "You have not taken this course.")
+	}
+
+	if material.Kind == MaterialLink {
+		return c.Redirect(http.StatusFound, material.URL)
+	}
+	return c.Attachment(classMaterialPath(material.ID), material.FileName)
+}
+
+// DeleteClassMaterial DELETE /api/courses/:courseID/classes/:classID/materials/:materialID 講義資料の削除
+func (h *handlers) DeleteClassMaterial(c echo.Context) error {
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+	materialID := c.Param("materialID")
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var material ClassMaterial
+	query := "SELECT `class_materials`.* FROM `class_materials`" +
+		" JOIN `classes` ON `classes`.`id` = `class_materials`.`class_id`" +
+		" WHERE `class_materials`.`id` = ? AND `class_materials`.`class_id` = ? AND `classes`.`course_id` = ? FOR UPDATE"
+	if err := tx.Get(&material, query, materialID, classID, courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such material.")
+	}
+
+	if _, err := tx.Exec("DELETE FROM `class_materials` WHERE `id` = ?", material.ID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// ファイルはコミットに成功してから削除する
+	if material.Kind == MaterialFile {
+		if err := os.Remove(classMaterialPath(material.ID)); err != nil && !os.IsNotExist(err) {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
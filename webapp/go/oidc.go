@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// IDTokenClaims はIdPから受け取ったIDトークンのうち、ログインに利用するクレーム
+type IDTokenClaims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Nonce         string
+}
+
+// IdentityProvider はOIDCの認可コードフローを提供するIdP
+// テストではローカルの偽IdPに差し替えられるようにインターフェースにしている
+type IdentityProvider interface {
+	// AuthCodeURL は認可リクエストのリダイレクト先URLを返す
+	AuthCodeURL(state, nonce string) string
+	// Exchange は認可コードをトークンと交換し、検証済みのIDトークンのクレームを返す
+	Exchange(ctx context.Context, code string) (*IDTokenClaims, error)
+}
+
+// OIDCCodeClaim はIdPのどのクレームを学内コード(users.code)に対応させるか
+type OIDCCodeClaim string
+
+const (
+	OIDCCodeClaimSubject OIDCCodeClaim = "sub"
+	// OIDCCodeClaimEmail はメールアドレスの@より前を学内コードとして扱う
+	// 他のドメインのアドレスで学内のユーザになりすませないよう、EmailDomain のアドレスのみ受け付ける
+	OIDCCodeClaimEmail OIDCCodeClaim = "email"
+)
+
+type OIDCSettings struct {
+	Provider  IdentityProvider
+	CodeClaim OIDCCodeClaim
+	// EmailDomain は CodeClaim が email の場合に受け付けるメールアドレスのドメイン
+	EmailDomain string
+	// JITProvisioning が有効な場合、存在しない学内コードのユーザを学生として作成する
+	JITProvisioning bool
+}
+
+// validate は設定の組み合わせを検証する
+func (s *OIDCSettings) validate() error {
+	if s.CodeClaim == OIDCCodeClaimEmail && s.EmailDomain == "" {
+		return errors.New("OIDC_EMAIL_DOMAIN is required when OIDC_CODE_CLAIM is email")
+	}
+	return nil
+}
+
+// userCode はクレームから学内コードを取り出す
+func (s *OIDCSettings) userCode(claims *IDTokenClaims) (string, error) {
+	switch s.CodeClaim {
+	case OIDCCodeClaimEmail:
+		if claims.Email == "" || !claims.EmailVerified {
+			return "", errors.New("verified email claim is required")
+		}
+		i := strings.LastIndex(claims.Email, "@")
+		if i <= 0 {
+			return "", errors.New("invalid email claim")
+		}
+		if s.EmailDomain == "" || !strings.EqualFold(claims.Email[i+1:], s.EmailDomain) {
+			return "", fmt.Errorf("email domain is not allowed: %q", claims.Email[i+1:])
+		}
+		return claims.Email[:i], nil
+	default:
+		if claims.Subject == "" {
+			return "", errors.New("sub claim is required")
+		}
+		return claims.Subject, nil
+	}
+}
+
+// canProvision は存在しない学内コードのユーザを作成してよいかどうかを返す
+func (s *OIDCSettings) canProvision(code string) bool {
+	return s.JITProvisioning && len(code) == 6
+}
+
+// ----- OpenID Connect Discovery -----
+
+type OIDCProviderConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// OIDCProvider はDiscoveryで取得したエンドポイントを利用するIdentityProvider
+type OIDCProvider struct {
+	config                OIDCProviderConfig
+	client                *http.Client
+	authorizationEndpoint string
+	tokenEndpoint         string
+	jwksURI               string
+
+	mu   sync.RWMutex
+	keys map[string]*rsa.PublicKey
+}
+
+type oidcDiscoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewOIDCProvider(ctx context.Context, config OIDCProviderConfig) (*OIDCProvider, error) {
+	p := &OIDCProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   make(map[string]*rsa.PublicKey),
+	}
+
+	var doc oidcDiscoveryDocument
+	if err := p.getJSON(ctx, strings.TrimSuffix(config.Issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, err
+	}
+	if doc.Issuer != config.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: expected %q, got %q", config.Issuer, doc.Issuer)
+	}
+	p.authorizationEndpoint = doc.AuthorizationEndpoint
+	p.tokenEndpoint = doc.TokenEndpoint
+	p.jwksURI = doc.JWKSURI
+
+	if err := p.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *OIDCProvider) AuthCodeURL(state, nonce string) string {
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientID)
+	q.Set("redirect_uri", p.config.RedirectURL)
+	q.Set("scope", "openid email profile")
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	if strings.Contains(p.authorizationEndpoint, "?") {
+		return p.authorizationEndpoint + "&" + q.Encode()
+	}
+	return p.authorizationEndpoint + "?" + q.Encode()
+}
+
+type oidcTokenResponse struct {
+	IDToken string `json:"id_token"`
+}
+
+func (p *OIDCProvider) Exchange(ctx context.Context, code string) (*IDTokenClaims, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %d", res.StatusCode)
+	}
+	var token oidcTokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("id_token is missing in token response")
+	}
+
+	return p.verifyIDToken(ctx, token.IDToken)
+}
+
+// verifyIDToken はIDトークンの署名とiss, aud, expを検証する
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, rawIDToken string) (*IDTokenClaims, error) {
+	mapClaims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, mapClaims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !mapClaims.VerifyIssuer(p.config.Issuer, true) {
+		return nil, errors.New("invalid iss claim")
+	}
+	if !mapClaims.VerifyAudience(p.config.ClientID, true) {
+		return nil, errors.New("invalid aud claim")
+	}
+	if !mapClaims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("id token is expired")
+	}
+
+	claims := &IDTokenClaims{}
+	claims.Subject, _ = mapClaims["sub"].(string)
+	claims.Email, _ = mapClaims["email"].(string)
+	claims.EmailVerified, _ = mapClaims["email_verified"].(bool)
+	claims.Name, _ = mapClaims["name"].(string)
+	claims.Nonce, _ = mapClaims["nonce"].(string)
+	return claims, nil
+}
+
+// key は署名鍵を返す。知らないkidの場合は鍵のローテーションに備えてJWKSを取得し直す
+func (p *OIDCProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.RLock()
+	key, ok := p.keys[kid]
+	p.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	if err := p.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id: %q", kid)
+}
+
+type jsonWebKeySet struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+func (p *OIDCProvider) refreshKeys(ctx context.Context) error {
+	var jwks jsonWebKeySet
+	if err := p.getJSON(ctx, p.jwksURI, &jwks); err != nil {
+		return err
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return err
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", u, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// OIDCLogin GET /auth/oidc/login IdPの認可エンドポイントへリダイレクト
+func (h *handlers) OIDCLogin(c echo.Context) error {
+	if h.OIDC == nil {
+		return c.String(http.StatusNotFound, "OIDC login is not enabled.")
+	}
+
+	state, _, err := newSecretToken("")
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	nonce, _, err := newSecretToken("")
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	sess.Values["oidcState"] = state
+	sess.Values["oidcNonce"] = nonce
+	if sess.IsNew {
+		sess.Options = &sessions.Options{
+			Path:   "/",
+			MaxAge: 600,
+		}
+	}
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.Redirect(http.StatusFound, h.OIDC.Provider.AuthCodeURL(state, nonce))
+}
+
+// OIDCCallback GET /auth/oidc/callback IdPからのリダイレクトを受けてログイン
+func (h *handlers) OIDCCallback(c echo.Context) error {
+	if h.OIDC == nil {
+		return c.String(http.StatusNotFound, "OIDC login is not enabled.")
+	}
+
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	state, _ := sess.Values["oidcState"].(string)
+	nonce, _ := sess.Values["oidcNonce"].(string)
+	if state == "" {
+		return c.String(http.StatusBadRequest, "Invalid state.")
+	}
+	// state, nonce は一度しか使えないようにする
+	delete(sess.Values, "oidcState")
+	delete(sess.Values, "oidcNonce")
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if c.QueryParam("state") != state {
+		return c.String(http.StatusBadRequest, "Invalid state.")
+	}
+	if errCode := c.QueryParam("error"); errCode != "" {
+		return c.String(http.StatusUnauthorized, "Authentication was denied by the identity provider: "+errCode)
+	}
+
+	claims, err := h.OIDC.Provider.Exchange(c.Request().Context(), c.QueryParam("code"))
+	if err != nil {
+		c.Logger().Error(err)
+		return c.String(http.StatusUnauthorized, "Failed to authenticate with the identity provider.")
+	}
+	if claims.Nonce != nonce {
+		return c.String(http.StatusUnauthorized, "Invalid nonce.")
+	}
+	code, err := h.OIDC.userCode(claims)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.String(http.StatusUnauthorized, "Failed to authenticate with the identity provider.")
+	}
+
+	var user User
+	if err := h.DB.Get(&user, "SELECT * FROM `users` WHERE `code` = ?", code); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		if !h.OIDC.canProvision(code) {
+			return c.String(http.StatusForbidden, "No such user.")
+		}
+		provisioned, err := h.provisionStudent(code, claims.Name)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		user = provisioned
+	}
+	if user.Deactivated {
+		if err := recordLoginEvent(h.DB, user.Code, sql.NullString{String: user.ID, Valid: true}, LoginDeactivated, c.RealIP(), c.Request().UserAgent(), time.Now()); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(http.StatusForbidden, "This account is deactivated.")
+	}
+
+	if err := h.saveLoginSession(c, sess, user); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := recordLoginEvent(h.DB, user.Code, sql.NullString{String: user.ID, Valid: true}, LoginSucceeded, c.RealIP(), c.Request().UserAgent(), time.Now()); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.Redirect(http.StatusFound, "/")
+}
+
+// provisionStudent はSSOで初めてログインしたユーザを学生として作成する
+// パスワードは推測できない値にしておき、パスワードでのログインにはリセットを必要とする
+func (h *handlers) provisionStudent(code string, name string) (User, error) {
+	user, err := newProvisionedStudent(code, name)
+	if err != nil {
+		return User{}, err
+	}
+	err = insertUser(h.DB, user)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
+		// 同時に初回ログインした場合は先に作成されたユーザを使う
+		err = h.DB.Get(&user, "SELECT * FROM `users` WHERE `code` = ?", code)
+	}
+	return user, err
+}
+
+// newProvisionedStudent はSSOで初めてログインしたユーザの学生を作る。名前のクレームがない場合は学内コードを名前にする
+func newProvisionedStudent(code string, name string) (User, error) {
+	if name == "" {
+		name = code
+	}
+	password, _, err := newSecretToken("")
+	if err != nil {
+		return User{}, err
+	}
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+	return User{
+		ID:             newULID(),
+		Code:           code,
+		Name:           name,
+		HashedPassword: hashedPassword,
+		Type:           Student,
+	}, nil
+}
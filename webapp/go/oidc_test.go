@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	testOIDCClientID  = "isucholar"
+	testOIDCAuthCode  = "test-auth-code"
+	testOIDCKeyID     = "test-key"
+	testOIDCNonce     = "test-nonce"
+	testOIDCUserCode  = "S99999"
+	testOIDCDomain    = "isucholar.example.ac.jp"
+	testOIDCRedirect  = "http://localhost/auth/oidc/callback"
+	testOIDCUserName  = "椅子 太郎"
+	testOIDCUserEmail = testOIDCUserCode + "@" + testOIDCDomain
+)
+
+// fakeIdP はテスト用のローカルのIdP
+// Discovery, JWKS, トークンエンドポイントを持ち、トークンエンドポイントは claims に署名したIDトークンを返す
+type fakeIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	// discoveryIssuer は Discovery で返す issuer。空の場合はサーバのURL
+	discoveryIssuer string
+	// claims はIDトークンのクレーム
+	claims jwt.MapClaims
+	// signingKey, signingKeyID はIDトークンの署名に使う鍵。nil の場合は JWKS で公開している鍵
+	signingKey   *rsa.PrivateKey
+	signingKeyID string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{key: key, signingKeyID: testOIDCKeyID}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := idp.discoveryIssuer
+		if issuer == "" {
+			issuer = idp.issuer()
+		}
+		writeTestJSON(w, oidcDiscoveryDocument{
+			Issuer:                issuer,
+			AuthorizationEndpoint: idp.issuer() + "/authorize",
+			TokenEndpoint:         idp.issuer() + "/token",
+			JWKSURI:               idp.issuer() + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": testOIDCKeyID,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(idp.key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.PublicKey.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("code") != testOIDCAuthCode {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if clientID, _, ok := r.BasicAuth(); !ok || clientID != testOIDCClientID {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		signingKey := idp.signingKey
+		if signingKey == nil {
+			signingKey = idp.key
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, idp.claims)
+		token.Header["kid"] = idp.signingKeyID
+		signed, err := token.SignedString(signingKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeTestJSON(w, oidcTokenResponse{IDToken: signed})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	idp.claims = idp.validClaims(testOIDCNonce)
+	return idp
+}
+
+func (idp *fakeIdP) issuer() string {
+	return idp.server.URL
+}
+
+// validClaims はすべての検証を通るIDトークンのクレームを返す
+func (idp *fakeIdP) validClaims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            idp.issuer(),
+		"aud":            testOIDCClientID,
+		"sub":            testOIDCUserCode,
+		"email":          testOIDCUserEmail,
+		"email_verified": true,
+		"name":           testOIDCUserName,
+		"nonce":          nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+	}
+}
+
+func (idp *fakeIdP) provider(t *testing.T) *OIDCProvider {
+	t.Helper()
+	provider, err := NewOIDCProvider(context.Background(), OIDCProviderConfig{
+		Issuer:       idp.issuer(),
+		ClientID:     testOIDCClientID,
+		ClientSecret: "secret",
+		RedirectURL:  testOIDCRedirect,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func writeTestJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestOIDCProviderDiscovery(t *testing.T) {
+	idp := newFakeIdP(t)
+	provider := idp.provider(t)
+
+	authURL, err := url.Parse(provider.AuthCodeURL("state-value", "nonce-value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := authURL.Scheme + "://" + authURL.Host + authURL.Path; got != idp.issuer()+"/authorize" {
+		t.Errorf("authorization endpoint = %q, want %q", got, idp.issuer()+"/authorize")
+	}
+	q := authURL.Query()
+	for name, want := range map[string]string{
+		"response_type": "code",
+		"client_id":     testOIDCClientID,
+		"redirect_uri":  testOIDCRedirect,
+		"state":         "state-value",
+		"nonce":         "nonce-value",
+	} {
+		if got := q.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if _, ok := provider.keys[testOIDCKeyID]; !ok {
+		t.Errorf("signing key %q is not loaded from JWKS", testOIDCKeyID)
+	}
+
+	idp.discoveryIssuer = "https://evil.example.com"
+	if _, err := NewOIDCProvider(context.Background(), OIDCProviderConfig{Issuer: idp.issuer(), ClientID: testOIDCClientID}); err == nil {
+		t.Error("NewOIDCProvider succeeded with a mismatched issuer in the discovery document")
+	}
+}
+
+func TestOIDCProviderExchange(t *testing.T) {
+	idp := newFakeIdP(t)
+	provider := idp.provider(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		setup   func(idp *fakeIdP)
+		wantErr bool
+	}{
+		{name: "valid", setup: func(idp *fakeIdP) {}},
+		{name: "bad signature", setup: func(idp *fakeIdP) { idp.signingKey = otherKey }, wantErr: true},
+		{name: "unknown key id", setup: func(idp *fakeIdP) { idp.signingKeyID = "unknown-key" }, wantErr: true},
+		{name: "bad audience", setup: func(idp *fakeIdP) { idp.claims["aud"] = "other-client" }, wantErr: true},
+		{name: "bad issuer", setup: func(idp *fakeIdP) { idp.claims["iss"] = "https://evil.example.com" }, wantErr: true},
+		{name: "expired", setup: func(idp *fakeIdP) { idp.claims["exp"] = time.Now().Add(-time.Minute).Unix() }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp.claims = idp.validClaims(testOIDCNonce)
+			idp.signingKey = nil
+			idp.signingKeyID = testOIDCKeyID
+			tt.setup(idp)
+
+			claims, err := provider.Exchange(context.Background(), testOIDCAuthCode)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Exchange succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Exchange failed: %v", err)
+			}
+			want := IDTokenClaims{Subject: testOIDCUserCode, Email: testOIDCUserEmail, EmailVerified: true, Name: testOIDCUserName, Nonce: testOIDCNonce}
+			if *claims != want {
+				t.Errorf("claims = %+v, want %+v", *claims, want)
+			}
+		})
+	}
+
+	if _, err := provider.Exchange(context.Background(), "wrong-code"); err == nil {
+		t.Error("Exchange succeeded with an authorization code the IdP rejected")
+	}
+}
+
+// TestOIDCCallbackRejectsInvalidStateAndNonce はログイン開始時のstate, nonceと一致しないコールバックを拒否することを確認する
+// 拒否はDBにアクセスする前に行うので、DBなしでハンドラを動かせる
+func TestOIDCCallbackRejectsInvalidStateAndNonce(t *testing.T) {
+	idp := newFakeIdP(t)
+	h := &handlers{
+		SessionStore: NewServerSideStore(NewMemorySessionBackend(), []byte("test-session-key")),
+		OIDC:         &OIDCSettings{Provider: idp.provider(t), CodeClaim: OIDCCodeClaimSubject},
+	}
+	e := echo.New()
+	e.Use(session.Middleware(h.SessionStore))
+	e.GET("/auth/oidc/login", h.OIDCLogin)
+	e.GET("/auth/oidc/callback", h.OIDCCallback)
+
+	// login はログインを開始し、セッションのcookieとIdPに渡したstate, nonceを返す
+	login := func() (*http.Cookie, string, string) {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil))
+		if rec.Code != http.StatusFound {
+			t.Fatalf("login status = %d, want %d", rec.Code, http.StatusFound)
+		}
+		location, err := url.Parse(rec.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookies := rec.Result().Cookies()
+		if len(cookies) == 0 {
+			t.Fatal("login did not set a session cookie")
+		}
+		return cookies[0], location.Query().Get("state"), location.Query().Get("nonce")
+	}
+	callback := func(cookie *http.Cookie, state string) *httptest.ResponseRecorder {
+		q := url.Values{}
+		q.Set("state", state)
+		q.Set("code", testOIDCAuthCode)
+		req := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?"+q.Encode(), nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	cookie, state, _ := login()
+	if rec := callback(cookie, state+"x"); rec.Code != http.StatusBadRequest {
+		t.Errorf("callback with a wrong state: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	// state は一度しか使えない
+	if rec := callback(cookie, state); rec.Code != http.StatusBadRequest {
+		t.Errorf("callback with a used state: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	cookie, state, nonce := login()
+	idp.claims = idp.validClaims(nonce + "x")
+	rec := callback(cookie, state)
+	if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), "nonce") {
+		t.Errorf("callback with a wrong nonce: status = %d, body = %q, want %d", rec.Code, rec.Body.String(), http.StatusUnauthorized)
+	}
+}
+
+func TestOIDCUserCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings OIDCSettings
+		claims   IDTokenClaims
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "sub",
+			settings: OIDCSettings{CodeClaim: OIDCCodeClaimSubject},
+			claims:   IDTokenClaims{Subject: "T00001"},
+			want:     "T00001",
+		},
+		{
+			name:     "missing sub",
+			settings: OIDCSettings{CodeClaim: OIDCCodeClaimSubject},
+			claims:   IDTokenClaims{Email: "T00001@" + testOIDCDomain, EmailVerified: true},
+			wantErr:  true,
+		},
+		{
+			name:     "email in the allowed domain",
+			settings: OIDCSettings{CodeClaim: OIDCCodeClaimEmail, EmailDomain: testOIDCDomain},
+			claims:   IDTokenClaims{Email: "T00001@" + testOIDCDomain, EmailVerified: true},
+			want:     "T00001",
+		},
+		{
+			name:     "domain is case-insensitive",
+			settings: OIDCSettings{CodeClaim: OIDCCodeClaimEmail, EmailDomain: testOIDCDomain},
+			claims:   IDTokenClaims{Email: "T00001@" + strings.ToUpper(testOIDCDomain), EmailVerified: true},
+			want:     "T00001",
+		},
+		{
+			name:     "email in another domain",
+			settings: OIDCSettings{CodeClaim: OIDCCodeClaimEmail, EmailDomain: testOIDCDomain},
+			claims:   IDTokenClaims{Email: "T00001@gmail.com", EmailVerified: true},
+			wantErr:  true,
+		},
+		{
+			name:     "subdomain of the allowed domain",
+			settings: OIDCSettings{CodeClaim: OIDCCodeClaimEmail, EmailDomain: testOIDCDomain},
+			claims:   IDTokenClaims{Email: "T00001@evil." + testOIDCDomain, EmailVerified: true},
+			wantErr:  true,
+		},
+		{
+			name:     "no allowed domain configured",
+			settings: OIDCSettings{CodeClaim: OIDCCodeClaimEmail},
+			claims:   IDTokenClaims{Email: "T00001@" + testOIDCDomain, EmailVerified: true},
+			wantErr:  true,
+		},
+		{
+			name:     "unverified email",
+			settings: OIDCSettings{CodeClaim: OIDCCodeClaimEmail, EmailDomain: testOIDCDomain},
+			claims:   IDTokenClaims{Email: "T00001@" + testOIDCDomain},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.settings.userCode(&tt.claims)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("userCode = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("userCode failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("userCode = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if err := (&OIDCSettings{CodeClaim: OIDCCodeClaimEmail}).validate(); err == nil {
+		t.Error("validate succeeded for email mode without an allowed domain")
+	}
+}
+
+// TestOIDCJITProvisioning はIdPで認証した未登録のユーザを学生として作成する流れを確認する(DBへの保存は除く)
+func TestOIDCJITProvisioning(t *testing.T) {
+	idp := newFakeIdP(t)
+	settings := &OIDCSettings{
+		Provider:        idp.provider(t),
+		CodeClaim:       OIDCCodeClaimEmail,
+		EmailDomain:     testOIDCDomain,
+		JITProvisioning: true,
+	}
+
+	claims, err := settings.Provider.Exchange(context.Background(), testOIDCAuthCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := settings.userCode(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !settings.canProvision(code) {
+		t.Fatalf("canProvision(%q) = false, want true", code)
+	}
+	user, err := newProvisionedStudent(code, claims.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Code != testOIDCUserCode || user.Name != testOIDCUserName || user.Type != Student || user.ID == "" || len(user.HashedPassword) == 0 {
+		t.Errorf("provisioned user = %+v", user)
+	}
+
+	// 名前のクレームがない場合は学内コードを名前にする
+	if user, err := newProvisionedStudent(code, ""); err != nil || user.Name != code {
+		t.Errorf("provisioned user without a name = %+v, %v", user, err)
+	}
+
+	if settings.canProvision("S1234") {
+		t.Error("canProvision accepted a code that is not 6 characters long")
+	}
+	settings.JITProvisioning = false
+	if settings.canProvision(code) {
+		t.Error("canProvision = true while JIT provisioning is disabled")
+	}
+}
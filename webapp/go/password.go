@@ -0,0 +1,303 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordMinLength = 8
+	// passwordResetTokenTTL はパスワードリセット用トークンの有効期間
+	passwordResetTokenTTL = 24 * time.Hour
+)
+
+var (
+	ErrPasswordTooShort = errors.New("password must be at least 8 characters")
+	ErrPasswordTooWeak  = errors.New("password must contain both letters and digits")
+	ErrPasswordIsCode   = errors.New("password must not be the same as the user code")
+)
+
+// validatePasswordStrength はパスワードが最低限の強度を満たしているか確認する
+func validatePasswordStrength(password, userCode string) error {
+	if len([]rune(password)) < passwordMinLength {
+		return ErrPasswordTooShort
+	}
+	var hasLetter, hasDigit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+	if !hasLetter || !hasDigit {
+		return ErrPasswordTooWeak
+	}
+	if password == userCode {
+		return ErrPasswordIsCode
+	}
+	return nil
+}
+
+func hashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// newPasswordResetToken はリセット用トークンと、DBに保存するそのハッシュ値を生成する
+func newPasswordResetToken() (token string, tokenHash string, err error) {
+	return newSecretToken("")
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type PasswordResetToken struct {
+	TokenHash string       `db:"token_hash"`
+	UserID    string       `db:"user_id"`
+	ExpiresAt time.Time    `db:"expires_at"`
+	UsedAt    sql.NullTime `db:"used_at"`
+	CreatedAt time.Time    `db:"created_at"`
+}
+
+// ResetPassword POST /password-reset リセット用トークンによるパスワード再設定
+func (h *handlers) ResetPassword(c echo.Context) error {
+	var req ResetPasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var token PasswordResetToken
+	if err := tx.Get(&token, "SELECT * FROM `password_reset_tokens` WHERE `token_hash` = ? FOR UPDATE", hashSecretToken(req.Token)); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows || token.UsedAt.Valid || !token.ExpiresAt.After(now) {
+		return c.String(http.StatusBadRequest, "Invalid or expired token.")
+	}
+
+	var user User
+	if err := tx.Get(&user, "SELECT * FROM `users` WHERE `id` = ? FOR UPDATE", token.UserID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := validatePasswordStrength(req.NewPassword, user.Code); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	hashedPassword, err := hashPassword(req.NewPassword)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if _, err := tx.Exec("UPDATE `users` SET `hashed_password` = ? WHERE `id` = ?", hashedPassword, user.ID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if _, err := tx.Exec("UPDATE `password_reset_tokens` SET `used_at` = ? WHERE `token_hash` = ?", now, token.TokenHash); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 古いパスワードで発行したAPIトークンはすべて失効させる
+	if _, err := tx.Exec("DELETE FROM `api_tokens` WHERE `user_id` = ?", user.ID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// パスワードを再設定したアカウントのロックは解除する
+	if _, err := tx.Exec("DELETE FROM `login_attempts` WHERE `scope` = ? AND `key` = ?", LoginAttemptAccount, user.Code); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 古いパスワードでログインしていたセッションはすべて失効させる
+	if err := h.SessionStore.Backend.DeleteByUser(user.ID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ChangePassword PUT /api/users/me/password パスワード変更
+// 他の端末のセッションとAPIトークンは失効させる
+// 現在のパスワードの検証はログインと失敗回数を共有し、ロック中のアカウントは 429 で拒否する
+func (h *handlers) ChangePassword(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var req ChangePasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+
+	var user User
+	if err := h.DB.Get(&user, "SELECT * FROM `users` WHERE `id` = ?", userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	now := time.Now()
+	ip := c.RealIP()
+	userAgent := c.Request().UserAgent()
+	userIDValue := sql.NullString{String: user.ID, Valid: true}
+
+	// セッションを奪われた場合に現在のパスワードを総当たりされないように、ログインと同じロックを適用する
+	if lockedUntil, locked, err := getLoginLockedUntil(h.DB, user.Code, ip, now); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if locked {
+		if err := recordLoginEvent(h.DB, user.Code, userIDValue, LoginLocked, ip, userAgent, now); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockedUntil.Sub(now).Seconds()))))
+		return c.String(http.StatusTooManyRequests, "Too many failed password attempts.")
+	}
+
+	if bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(req.CurrentPassword)) != nil {
+		if err := h.recordPasswordFailure(user.Code, userIDValue, ip, userAgent, now); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(http.StatusBadRequest, "Current password is wrong.")
+	}
+	if err := recordLoginSuccess(h.DB, user.Code, ip); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := validatePasswordStrength(req.NewPassword, user.Code); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	hashedPassword, err := hashPassword(req.NewPassword)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE `users` SET `hashed_password` = ? WHERE `id` = ?", hashedPassword, userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// パスワードの再設定と同様に、古いパスワードで発行したAPIトークンはすべて失効させる
+	if _, err := tx.Exec("DELETE FROM `api_tokens` WHERE `user_id` = ?", userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 他の端末のセッションは失効させ、現在のセッションのみ保存し直す
+	if err := h.SessionStore.Backend.DeleteByUser(userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+type IssuePasswordResetTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// IssuePasswordResetToken POST /api/admin/users/:userCode/password-reset パスワードリセット用トークンの発行
+func (h *handlers) IssuePasswordResetToken(c echo.Context) error {
+	userCode := c.Param("userCode")
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var userID string
+	if err := tx.Get(&userID, "SELECT `id` FROM `users` WHERE `code` = ? FOR UPDATE", userCode); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such user.")
+	}
+
+	// 未使用のトークンは新しいトークンの発行によって無効になる
+	if _, err := tx.Exec("DELETE FROM `password_reset_tokens` WHERE `user_id` = ? AND `used_at` IS NULL", userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	token, tokenHash, err := newPasswordResetToken()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	now := time.Now()
+	expiresAt := now.Add(passwordResetTokenTTL)
+	if _, err := tx.Exec("INSERT INTO `password_reset_tokens` (`token_hash`, `user_id`, `expires_at`, `created_at`) VALUES (?, ?, ?, ?)",
+		tokenHash, userID, expiresAt, now); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// トークンの平文はこのレスポンスでのみ返却する
+	return c.JSON(http.StatusCreated, IssuePasswordResetTokenResponse{
+		Token:     token,
+		ExpiresAt: expiresAt,
+	})
+}
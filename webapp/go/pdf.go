@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// PDFDocument はテキストのみを含むPDF(PDF 1.7)を生成する
+// フォントは埋め込まず、ビューアが持つ日本語フォント(小塚明朝)を Adobe-Japan1 のCIDフォントとして参照する
+type PDFDocument struct {
+	Width  float64
+	Height float64
+	pages  []*bytes.Buffer
+}
+
+const (
+	// A4 (pt)
+	pdfA4Width  = 595.28
+	pdfA4Height = 841.89
+)
+
+func NewPDFDocument() *PDFDocument {
+	return &PDFDocument{
+		Width:  pdfA4Width,
+		Height: pdfA4Height,
+	}
+}
+
+// AddPage は新しいページを追加する。以降の描画は追加したページに行われる
+func (d *PDFDocument) AddPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+}
+
+func (d *PDFDocument) currentPage() *bytes.Buffer {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+	return d.pages[len(d.pages)-1]
+}
+
+// Text は左下を原点とした座標 (x, y) にテキストを描画する
+func (d *PDFDocument) Text(x, y, size float64, text string) {
+	fmt.Fprintf(d.currentPage(), "BT /F1 %.2f Tf %.2f %.2f Td <%s> Tj ET\n", size, x, y, encodePDFText(text))
+}
+
+// Line は (x1, y1) から (x2, y2) へ線を引く
+func (d *PDFDocument) Line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(d.currentPage(), "%.2f %.2f m %.2f %.2f l S\n", x1, y1, x2, y2)
+}
+
+// encodePDFText は UniJIS-UCS2-HW-H で参照するためにテキストをUTF-16BEの16進文字列にする
+// UCS-2 で表せない文字は「?」に置き換える
+func encodePDFText(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		if r > 0xFFFF || utf16.IsSurrogate(r) {
+			r = '?'
+		}
+		fmt.Fprintf(&b, "%04X", r)
+	}
+	return b.String()
+}
+
+// WriteTo はPDFを書き出す
+func (d *PDFDocument) WriteTo(w io.Writer) (int64, error) {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+
+	// 1: Catalog, 2: Pages, 3: Type0 フォント, 4: CIDフォント, 5: FontDescriptor, 6以降: ページとコンテンツ
+	const fixedObjects = 5
+	kids := make([]string, 0, len(d.pages))
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", fixedObjects+1+i*2))
+	}
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d /MediaBox [0 0 %.2f %.2f] >>", strings.Join(kids, " "), len(d.pages), d.Width, d.Height),
+		"<< /Type /Font /Subtype /Type0 /BaseFont /KozMinPr6N-Regular /Encoding /UniJIS-UCS2-HW-H /DescendantFonts [4 0 R] >>",
+		// CID 231-632 は半角文字
+		"<< /Type /Font /Subtype /CIDFontType0 /BaseFont /KozMinPr6N-Regular" +
+			" /CIDSystemInfo << /Registry (Adobe) /Ordering (Japan1) /Supplement 6 >>" +
+			" /FontDescriptor 5 0 R /DW 1000 /W [231 632 500] >>",
+		"<< /Type /FontDescriptor /FontName /KozMinPr6N-Regular /Flags 6 /FontBBox [-437 -340 1147 1317]" +
+			" /ItalicAngle 0 /Ascent 1317 /Descent -349 /CapHeight 742 /StemV 80 >>",
+	}
+	for i, content := range d.pages {
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", fixedObjects+2+i*2),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+		)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return buf.WriteTo(w)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/mail"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+)
+
+type UserProfile struct {
+	Email          string `json:"email"`
+	Department     string `json:"department"`
+	EnrollmentYear *int   `json:"enrollment_year"`
+	AvatarURL      string `json:"avatar_url"`
+}
+
+func newUserProfile(user User) UserProfile {
+	profile := UserProfile{
+		Email:      user.Email,
+		Department: user.Department,
+		AvatarURL:  user.AvatarURL,
+	}
+	if user.EnrollmentYear.Valid {
+		year := int(user.EnrollmentYear.Int32)
+		profile.EnrollmentYear = &year
+	}
+	return profile
+}
+
+type UpdateMeRequest struct {
+	Email     *string `json:"email"`
+	AvatarURL *string `json:"avatar_url"`
+}
+
+// validateEmail は空文字列(未設定)もしくは単一のメールアドレスのみ許可する
+func validateEmail(email string) error {
+	if email == "" {
+		return nil
+	}
+	if len(email) > 255 {
+		return errors.New("email is too long")
+	}
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return errors.New("invalid email")
+	}
+	return nil
+}
+
+// validateAvatarURL は空文字列(未設定)もしくはhttp(s)の絶対URLのみ許可する
+func validateAvatarURL(avatarURL string) error {
+	if avatarURL == "" {
+		return nil
+	}
+	if len(avatarURL) > 255 {
+		return errors.New("avatar_url is too long")
+	}
+	u, err := url.Parse(avatarURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("invalid avatar_url")
+	}
+	return nil
+}
+
+// UpdateMe PUT /api/users/me 自身のプロフィールを更新
+// 所属と入学年度は教務のみが変更できる
+func (h *handlers) UpdateMe(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var req UpdateMeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	// 一部の項目だけが更新されないように、全ての項目を検証してから1回で更新する
+	if req.Email != nil {
+		if err := validateEmail(*req.Email); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+	}
+	if req.AvatarURL != nil {
+		if err := validateAvatarURL(*req.AvatarURL); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	if req.Email != nil || req.AvatarURL != nil {
+		// 指定されなかった項目は NULL を渡して元の値のままにする
+		if _, err := h.DB.Exec("UPDATE `users` SET `email` = IFNULL(?, `email`), `avatar_url` = IFNULL(?, `avatar_url`) WHERE `id` = ?",
+			req.Email, req.AvatarURL, userID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	return h.GetMe(c)
+}
+
+type GetUserRegistration struct {
+	ID     string       `json:"id" db:"id"`
+	Code   string       `json:"code" db:"code"`
+	Name   string       `json:"name" db:"name"`
+	Status CourseStatus `json:"status" db:"status"`
+}
+
+type GetUserResponse struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	UserProfile
+	Registrations []GetUserRegistration `json:"registrations"`
+}
+
+// GetUser GET /api/users/:userCode 学生のプロフィールと自身の科目の履修状況を取得
+// 教務以外は自身が担当(もしくはTAを)している科目を履修している学生のみ参照できる
+func (h *handlers) GetUser(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	userType, err := h.getUserType(userID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var student User
+	if err := h.DB.Get(&student, "SELECT * FROM `users` WHERE `code` = ? AND `type` = ?", c.Param("userCode"), Student); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such student.")
+	}
+
+	query := "SELECT `courses`.`id`, `courses`.`code`, `courses`.`name`, `courses`.`status`" +
+		" FROM `registrations`" +
+		" JOIN `courses` ON `registrations`.`course_id` = `courses`.`id`" +
+		" WHERE `registrations`.`user_id` = ?"
+	args := []interface{}{student.ID}
+	if userType != Registrar {
+		query += " AND (`courses`.`teacher_id` = ? OR `courses`.`id` IN (SELECT `course_id` FROM `course_staff` WHERE `user_id` = ?))"
+		args = append(args, userID, userID)
+	}
+	query += " ORDER BY `courses`.`code`"
+
+	registrations := make([]GetUserRegistration, 0)
+	if err := h.DB.Select(&registrations, query, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if userType != Registrar && len(registrations) == 0 {
+		return c.String(http.StatusNotFound, "No such student.")
+	}
+
+	return c.JSON(http.StatusOK, GetUserResponse{
+		Code:          student.Code,
+		Name:          student.Name,
+		UserProfile:   newUserProfile(student),
+		Registrations: registrations,
+	})
+}
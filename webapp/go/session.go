@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// SessionBackend はセッションの中身を保存するサーバー側のストレージ
+type SessionBackend interface {
+	Load(id string) (data []byte, ok bool, err error)
+	Save(id string, userID string, data []byte, expiresAt time.Time) error
+	Delete(id string) error
+	DeleteByUser(userID string) error
+}
+
+// ServerSideStore はセッションIDのみをcookieに持ち、中身をSessionBackendに保存するsessions.Store
+type ServerSideStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	Backend SessionBackend
+}
+
+func NewServerSideStore(backend SessionBackend, keyPairs ...[]byte) *ServerSideStore {
+	return &ServerSideStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400,
+		},
+		Backend: backend,
+	}
+}
+
+func (s *ServerSideStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *ServerSideStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	sess := sessions.NewSession(s, name)
+	opts := *s.Options
+	sess.Options = &opts
+	sess.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return sess, nil
+	}
+	// 改ざんされたcookieや失効済みのセッションは新規セッションとして扱う
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.Codecs...); err != nil {
+		return sess, nil
+	}
+	data, ok, err := s.Backend.Load(id)
+	if err != nil {
+		return sess, err
+	}
+	if !ok {
+		return sess, nil
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &sess.Values); err != nil {
+		return sess, err
+	}
+	sess.ID = id
+	sess.IsNew = false
+	return sess, nil
+}
+
+func (s *ServerSideStore) Save(r *http.Request, w http.ResponseWriter, sess *sessions.Session) error {
+	if sess.Options.MaxAge < 0 {
+		if sess.ID != "" {
+			if err := s.Backend.Delete(sess.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(sess.Name(), "", sess.Options))
+		return nil
+	}
+
+	if sess.ID == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		sess.ID = id
+	}
+
+	data, err := (securecookie.GobEncoder{}).Serialize(sess.Values)
+	if err != nil {
+		return err
+	}
+	maxAge := sess.Options.MaxAge
+	if maxAge == 0 {
+		maxAge = s.Options.MaxAge
+	}
+	userID, _ := sess.Values["userID"].(string)
+	if err := s.Backend.Save(sess.ID, userID, data, time.Now().Add(time.Duration(maxAge)*time.Second)); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(sess.Name(), sess.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(sess.Name(), encoded, sess.Options))
+	return nil
+}
+
+// Regenerate はセッションの中身を保ったまま、次の Save で新しいIDを発行するようにする
+// 古いIDのセッションは削除するので、以前のcookieは使えなくなる
+func (s *ServerSideStore) Regenerate(sess *sessions.Session) error {
+	if sess.ID != "" {
+		if err := s.Backend.Delete(sess.ID); err != nil {
+			return err
+		}
+	}
+	sess.ID = ""
+	sess.IsNew = true
+	return nil
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ----- MySQL -----
+
+type MySQLSessionBackend struct {
+	DB *sqlx.DB
+}
+
+func (b *MySQLSessionBackend) Load(id string) ([]byte, bool, error) {
+	var data []byte
+	if err := b.DB.Get(&data, "SELECT `data` FROM `sessions` WHERE `id` = ? AND `expires_at` > NOW(6)", id); err != nil && err != sql.ErrNoRows {
+		return nil, false, err
+	} else if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	return data, true, nil
+}
+
+func (b *MySQLSessionBackend) Save(id string, userID string, data []byte, expiresAt time.Time) error {
+	_, err := b.DB.Exec("INSERT INTO `sessions` (`id`, `user_id`, `data`, `expires_at`) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE `user_id` = VALUES(`user_id`), `data` = VALUES(`data`), `expires_at` = VALUES(`expires_at`)",
+		id, userID, data, expiresAt)
+	return err
+}
+
+func (b *MySQLSessionBackend) Delete(id string) error {
+	_, err := b.DB.Exec("DELETE FROM `sessions` WHERE `id` = ?", id)
+	return err
+}
+
+func (b *MySQLSessionBackend) DeleteByUser(userID string) error {
+	_, err := b.DB.Exec("DELETE FROM `sessions` WHERE `user_id` = ?", userID)
+	return err
+}
+
+// ----- in-memory -----
+
+// memorySessionSweepInterval は期限切れのセッションをまとめて削除する間隔
+// 読み込まれないまま期限切れになったセッションが溜まり続けないように、Save の際にこの間隔で削除する
+const memorySessionSweepInterval = 1 * time.Minute
+
+type memorySession struct {
+	userID    string
+	data      []byte
+	expiresAt time.Time
+}
+
+type MemorySessionBackend struct {
+	mu        sync.RWMutex
+	sessions  map[string]memorySession
+	lastSweep time.Time
+}
+
+func NewMemorySessionBackend() *MemorySessionBackend {
+	return &MemorySessionBackend{
+		sessions: make(map[string]memorySession),
+	}
+}
+
+func (b *MemorySessionBackend) Load(id string) ([]byte, bool, error) {
+	b.mu.RLock()
+	sess, ok := b.sessions[id]
+	b.mu.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+	if !sess.expiresAt.After(time.Now()) {
+		_ = b.Delete(id)
+		return nil, false, nil
+	}
+	return sess.data, true, nil
+}
+
+func (b *MemorySessionBackend) Save(id string, userID string, data []byte, expiresAt time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now := time.Now(); now.Sub(b.lastSweep) >= memorySessionSweepInterval {
+		b.sweep(now)
+	}
+	b.sessions[id] = memorySession{userID: userID, data: data, expiresAt: expiresAt}
+	return nil
+}
+
+// sweep は期限切れのセッションを削除する。呼び出し元で b.mu のロックを取っておくこと
+func (b *MemorySessionBackend) sweep(now time.Time) {
+	for id, sess := range b.sessions {
+		if !sess.expiresAt.After(now) {
+			delete(b.sessions, id)
+		}
+	}
+	b.lastSweep = now
+}
+
+func (b *MemorySessionBackend) Delete(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.sessions, id)
+	return nil
+}
+
+func (b *MemorySessionBackend) DeleteByUser(userID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, sess := range b.sessions {
+		if sess.userID == userID {
+			delete(b.sessions, id)
+		}
+	}
+	return nil
+}
+
+// saveLoginSession はログインしたユーザをセッションに保存する
+// セッション固定攻撃を防ぐため、ログイン前のセッションIDは破棄して新しいIDを発行する
+func (h *handlers) saveLoginSession(c echo.Context, sess *sessions.Session, user User) error {
+	if err := h.SessionStore.Regenerate(sess); err != nil {
+		return err
+	}
+	sess.Values["userID"] = user.ID
+	sess.Values["userName"] = user.Name
+	sess.Values["isAdmin"] = isStaff(user.Type)
+	sess.Options = &sessions.Options{
+		Path:   "/",
+		MaxAge: 3600,
+	}
+	return sess.Save(c.Request(), c.Response())
+}
+
+// DeleteMySessions DELETE /api/users/me/sessions 全端末からログアウト
+func (h *handlers) DeleteMySessions(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := h.SessionStore.Backend.DeleteByUser(userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	sess.Options = &sessions.Options{
+		Path:   "/",
+		MaxAge: -1,
+	}
+
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemorySessionBackendSweepsExpiredSessions(t *testing.T) {
+	b := NewMemorySessionBackend()
+	now := time.Now()
+	if err := b.Save("expired", "user-1", []byte("data"), now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Save("active", "user-2", []byte("data"), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.sessions["expired"]; !ok {
+		t.Fatal("expired session was swept before the sweep interval elapsed")
+	}
+
+	// 前回の削除から間隔が経過していれば、次の Save で期限切れのセッションを削除する
+	b.lastSweep = now.Add(-memorySessionSweepInterval)
+	if err := b.Save("new", "user-3", []byte("data"), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.sessions["expired"]; ok {
+		t.Error("expired session was not swept")
+	}
+	for _, id := range []string{"active", "new"} {
+		if _, ok, err := b.Load(id); err != nil || !ok {
+			t.Errorf("Load(%q) = (%v, %v), want active session", id, ok, err)
+		}
+	}
+}
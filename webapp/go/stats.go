@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// HistogramBucket は度数分布の区間 [lower, upper) と度数。最後の区間は upper を含む
+type HistogramBucket struct {
+	Lower int `json:"lower"`
+	Upper int `json:"upper"`
+	Count int `json:"count"`
+}
+
+const defaultHistogramBuckets = 10
+
+func newHistogram(arr []int, width int, upper int) []HistogramBucket {
+	counts := histogramInt(arr, width, upper)
+	buckets := make([]HistogramBucket, 0, len(counts))
+	for i, count := range counts {
+		buckets = append(buckets, HistogramBucket{
+			Lower: i * width,
+			Upper: (i + 1) * width,
+			Count: count,
+		})
+	}
+	return buckets
+}
+
+// histogramBucketWidth は度数分布の区間の幅を返す
+// bucket_width クエリパラメータで指定されていない場合は満点を defaultHistogramBuckets 等分する
+func histogramBucketWidth(width int, maxScore int) int {
+	if width > 0 {
+		return width
+	}
+	width = (maxScore + defaultHistogramBuckets - 1) / defaultHistogramBuckets
+	if width == 0 {
+		return 1
+	}
+	return width
+}
+
+// parseBucketWidth は bucket_width クエリパラメータを読む。指定されていない場合は0
+func parseBucketWidth(c echo.Context) (int, error) {
+	v := c.QueryParam("bucket_width")
+	if v == "" {
+		return 0, nil
+	}
+	width, err := strconv.Atoi(v)
+	if err != nil || width <= 0 {
+		return 0, errors.New("invalid bucket width")
+	}
+	return width, nil
+}
+
+// ScoreStats は点数の統計値
+type ScoreStats struct {
+	Count     int               `json:"count"`
+	Avg       float64           `json:"avg"`
+	Max       int               `json:"max"`
+	Min       int               `json:"min"`
+	Q1        float64           `json:"q1"`
+	Median    float64           `json:"median"`
+	Q3        float64           `json:"q3"`
+	Histogram []HistogramBucket `json:"histogram"`
+}
+
+func newScoreStats(arr []int, bucketWidth int, maxScore int) ScoreStats {
+	return ScoreStats{
+		Count:     len(arr),
+		Avg:       averageInt(arr, 0),
+		Max:       maxInt(arr, 0),
+		Min:       minInt(arr, 0),
+		Q1:        percentileInt(arr, 25, 0),
+		Median:    medianInt(arr, 0),
+		Q3:        percentileInt(arr, 75, 0),
+		Histogram: newHistogram(arr, histogramBucketWidth(bucketWidth, maxScore), maxScore),
+	}
+}
+
+type ClassStats struct {
+	ClassID         string     `json:"class_id"`
+	Part            uint8      `json:"part"`
+	Title           string     `json:"title"`
+	ScoresPublished bool       `json:"scores_published"`
+	Submitters      int        `json:"submitters"`
+	Scores          ScoreStats `json:"scores"` // 採点済みの提出の点数 (未公開のものを含む)
+}
+
+type GetCourseStatsResponse struct {
+	CourseID      string      `json:"course_id"`
+	GradingType   GradingType `json:"grading_type"`
+	Registrations int         `json:"registrations"`
+	MaxScore      int         `json:"max_score"` // 合計点の満点 (点数を公開した講義と出席点)
+	TotalScores   ScoreStats  `json:"total_scores"`
+	// GradeCounts は評語毎の学生数。成績評価の方式が score の科目では空
+	GradeCounts map[LetterGrade]int `json:"grade_counts"`
+	Classes     []ClassStats        `json:"classes"`
+}
+
+// GetCourseStats GET /api/courses/:courseID/stats 科目の成績の分布
+func (h *handlers) GetCourseStats(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	bucketWidth, err := parseBucketWidth(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid bucket_width.")
+	}
+
+	var count int
+	if err := h.DB.Get(&count, "SELECT COUNT(*) FROM `courses` WHERE `id` = ?", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+
+	policy, err := loadGradingPolicy(h.DB, courseID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var classes []struct {
+		Class
+		Submitters int `db:"submitters"`
+	}
+	query := "SELECT `classes`.*, IFNULL(`class_aggregates`.`submitters`, 0) AS `submitters`" +
+		" FROM `classes`" +
+		" LEFT JOIN `class_aggregates` ON `class_aggregates`.`class_id` = `classes`.`id`" +
+		" WHERE `classes`.`course_id` = ?" +
+		" ORDER BY `classes`.`part`"
+	if err := h.DB.Select(&classes, query, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var submissionScores []struct {
+		ClassID string `db:"class_id"`
+		Score   int    `db:"score"`
+	}
+	query = "SELECT `submissions`.`class_id`, `submissions`.`score`" +
+		" FROM `submissions`" +
+		" JOIN `classes` ON `classes`.`id` = `submissions`.`class_id`" +
+		" WHERE `classes`.`course_id` = ? AND `submissions`.`score` IS NOT NULL"
+	if err := h.DB.Select(&submissionScores, query, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	classScoreLists := make(map[string][]int, len(classes))
+	for _, s := range submissionScores {
+		classScoreLists[s.ClassID] = append(classScoreLists[s.ClassID], s.Score)
+	}
+
+	var totals []int
+	query = "SELECT IFNULL(`course_score_totals`.`total_score`, 0)" +
+		" FROM `registrations`" +
+		" LEFT JOIN `course_score_totals` ON `course_score_totals`.`course_id` = `registrations`.`course_id` AND `course_score_totals`.`user_id` = `registrations`.`user_id`" +
+		" WHERE `registrations`.`course_id` = ?"
+	if err := h.DB.Select(&totals, query, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	maxScore, err := loadMaxScore(h.DB, courseID, policy)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := GetCourseStatsResponse{
+		CourseID:      courseID,
+		GradingType:   policy.Type,
+		Registrations: len(totals),
+		MaxScore:      maxScore.Weighted,
+		GradeCounts:   make(map[LetterGrade]int),
+		Classes:       make([]ClassStats, 0, len(classes)),
+	}
+	for _, class := range classes {
+		res.Classes = append(res.Classes, ClassStats{
+			ClassID:         class.ID,
+			Part:            class.Part,
+			Title:           class.Title,
+			ScoresPublished: class.ScoresPublished,
+			Submitters:      class.Submitters,
+			Scores:          newScoreStats(classScoreLists[class.ID], bucketWidth, 100),
+		})
+	}
+	res.TotalScores = newScoreStats(totals, bucketWidth, res.MaxScore)
+	if policy.Type != GradingScore {
+		for _, total := range totals {
+			grade, _, _ := policy.Grade(total, maxScore)
+			res.GradeCounts[grade]++
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// defaultPeriodTimes は時限と授業時間の対応のデフォルト値
+// PERIOD_TIMES 環境変数に "1=09:00-10:30,2=10:40-12:10" の形式で指定すると上書きできる
+const defaultPeriodTimes = "1=09:00-10:30,2=10:40-12:10,3=13:00-14:30,4=14:40-16:10,5=16:20-17:50,6=18:00-19:30"
+
+// PeriodTime は時限の開始・終了時刻(0時からの経過時間)
+type PeriodTime struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// Timetable は時間割をカレンダー上の日時に変換するための設定
+type Timetable struct {
+	Location *time.Location
+	Periods  map[uint8]PeriodTime
+	// TermStart, TermEnd は学期の初日と最終日。指定されていない場合はゼロ値
+	TermStart time.Time
+	TermEnd   time.Time
+}
+
+// NewTimetable は環境変数から時間割の設定を読み込む
+func NewTimetable() (*Timetable, error) {
+	loc, err := time.LoadLocation(GetEnv("TIMEZONE", "Asia/Tokyo"))
+	if err != nil {
+		return nil, err
+	}
+	periods, err := parsePeriodTimes(GetEnv("PERIOD_TIMES", defaultPeriodTimes))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Timetable{
+		Location: loc,
+		Periods:  periods,
+	}
+	if v := GetEnv("TERM_START", ""); v != "" {
+		if t.TermStart, err = time.ParseInLocation("2006-01-02", v, loc); err != nil {
+			return nil, err
+		}
+	}
+	if v := GetEnv("TERM_END", ""); v != "" {
+		if t.TermEnd, err = time.ParseInLocation("2006-01-02", v, loc); err != nil {
+			return nil, err
+		}
+	}
+	if t.TermStart.IsZero() != t.TermEnd.IsZero() {
+		return nil, errors.New("both TERM_START and TERM_END must be set")
+	}
+	if t.TermEnd.Before(t.TermStart) {
+		return nil, fmt.Errorf("term ends (%s) before it starts (%s)", t.TermEnd.Format("2006-01-02"), t.TermStart.Format("2006-01-02"))
+	}
+	return t, nil
+}
+
+// HasPeriod は時限が時間割に存在するかどうかを返す
+func (t *Timetable) HasPeriod(period int) bool {
+	if period < 0 || period > math.MaxUint8 {
+		return false
+	}
+	_, ok := t.Periods[uint8(period)]
+	return ok
+}
+
+// Term は now が属する学期の初日と最終日を返す
+// 学期が指定されていない場合は、4月から9月を前期、10月から3月を後期とする
+func (t *Timetable) Term(now time.Time) (start time.Time, end time.Time) {
+	if !t.TermStart.IsZero() {
+		return t.TermStart, t.TermEnd
+	}
+	now = now.In(t.Location)
+	switch {
+	case now.Month() >= time.April && now.Month() <= time.September:
+		return time.Date(now.Year(), time.April, 1, 0, 0, 0, 0, t.Location), time.Date(now.Year(), time.September, 30, 0, 0, 0, 0, t.Location)
+	case now.Month() >= time.October:
+		return time.Date(now.Year(), time.October, 1, 0, 0, 0, 0, t.Location), time.Date(now.Year()+1, time.March, 31, 0, 0, 0, 0, t.Location)
+	default:
+		return time.Date(now.Year()-1, time.October, 1, 0, 0, 0, 0, t.Location), time.Date(now.Year(), time.March, 31, 0, 0, 0, 0, t.Location)
+	}
+}
+
+func parsePeriodTimes(s string) (map[uint8]PeriodTime, error) {
+	periods := make(map[uint8]PeriodTime)
+	for _, entry := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid period time: %q", entry)
+		}
+		period, err := strconv.ParseUint(kv[0], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid period: %q", kv[0])
+		}
+		times := strings.SplitN(kv[1], "-", 2)
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid period time: %q", entry)
+		}
+		start, err := parseClockTime(times[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClockTime(times[1])
+		if err != nil {
+			return nil, err
+		}
+		if end <= start {
+			return nil, fmt.Errorf("period %d ends before it starts", period)
+		}
+		periods[uint8(period)] = PeriodTime{Start: start, End: end}
+	}
+	return periods, nil
+}
+
+// parseClockTime は "15:04" 形式の時刻を0時からの経過時間に変換する
+func parseClockTime(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+var weekdays = map[DayOfWeek]time.Weekday{
+	Monday:    time.Monday,
+	Tuesday:   time.Tuesday,
+	Wednesday: time.Wednesday,
+	Thursday:  time.Thursday,
+	Friday:    time.Friday,
+}
+
+// FirstClass は学期中で最初の授業の開始・終了日時を返す
+func (t *Timetable) FirstClass(termStart, termEnd time.Time, dayOfWeek DayOfWeek, period uint8) (start time.Time, end time.Time, ok bool) {
+	periodTime, ok := t.Periods[period]
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	weekday, ok := weekdays[dayOfWeek]
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	day := termStart.AddDate(0, 0, (int(weekday)-int(termStart.Weekday())+7)%7)
+	if day.After(termEnd) {
+		return time.Time{}, time.Time{}, false
+	}
+	return day.Add(periodTime.Start), day.Add(periodTime.End), true
+}
+
+// ----- iCalendar (RFC 5545) -----
+
+type CalendarEvent struct {
+	UID         string
+	Summary     string
+	Description string
+	Start       time.Time
+	End         time.Time
+	// Until は毎週の繰り返しの終了日時
+	Until time.Time
+}
+
+// writeICalendar は毎週繰り返す予定を iCalendar 形式で書き出す
+func (t *Timetable) writeICalendar(w io.Writer, name string, events []CalendarEvent, now time.Time) error {
+	termStart, _ := t.Term(now)
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//isucholar//timetable//JA",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:" + escapeICalText(name),
+		"X-WR-TIMEZONE:" + t.Location.String(),
+	}
+	// 授業の日時はローカル時刻で指定するため、学期開始時点のUTCオフセットでタイムゾーンを定義する
+	_, offset := termStart.Zone()
+	lines = append(lines,
+		"BEGIN:VTIMEZONE",
+		"TZID:"+t.Location.String(),
+		"BEGIN:STANDARD",
+		"DTSTART:19700101T000000",
+		"TZOFFSETFROM:"+formatICalUTCOffset(offset),
+		"TZOFFSETTO:"+formatICalUTCOffset(offset),
+		"END:STANDARD",
+		"END:VTIMEZONE",
+	)
+	for _, e := range events {
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+e.UID,
+			"DTSTAMP:"+now.UTC().Format("20060102T150405Z"),
+			"DTSTART;TZID="+t.Location.String()+":"+e.Start.In(t.Location).Format("20060102T150405"),
+			"DTEND;TZID="+t.Location.String()+":"+e.End.In(t.Location).Format("20060102T150405"),
+			"RRULE:FREQ=WEEKLY;UNTIL="+e.Until.UTC().Format("20060102T150405Z"),
+			"SUMMARY:"+escapeICalText(e.Summary),
+			"DESCRIPTION:"+escapeICalText(e.Description),
+			"END:VEVENT",
+		)
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, line := range lines {
+		if _, err := io.WriteString(w, foldICalLine(line)+"\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatICalUTCOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset%3600/60)
+}
+
+var icalTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func escapeICalText(s string) string {
+	return icalTextEscaper.Replace(s)
+}
+
+// foldICalLine は1行が75オクテットを超えないように折り返す
+// マルチバイト文字の途中では折り返さない
+func foldICalLine(line string) string {
+	const limit = 75
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > limit {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += size
+	}
+	return b.String()
+}
+
+// GetRegisteredCoursesICS GET /api/users/me/courses.ics 履修中の科目をiCalendar形式で取得
+// 各科目を学期中毎週繰り返す予定として出力する
+func (h *handlers) GetRegisteredCoursesICS(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var courses []struct {
+		Course
+		TeacherName string `db:"teacher_name"`
+	}
+	query := "SELECT `courses`.*, `users`.`name` AS `teacher_name`" +
+		" FROM `courses`" +
+		" JOIN `registrations` ON `courses`.`id` = `registrations`.`course_id`" +
+		" JOIN `users` ON `courses`.`teacher_id` = `users`.`id`" +
+		" WHERE `courses`.`status` != ? AND `registrations`.`user_id` = ?" +
+		" ORDER BY `courses`.`code`"
+	if err := h.DB.Select(&courses, query, StatusClosed, userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	now := time.Now()
+	termStart, termEnd := h.Timetable.Term(now)
+	// 学期の最終日の授業まで含める
+	until := termEnd.AddDate(0, 0, 1).Add(-time.Second)
+	events := make([]CalendarEvent, 0, len(courses))
+	for _, course := range courses {
+		start, end, ok := h.Timetable.FirstClass(termStart, termEnd, course.DayOfWeek, course.Period)
+		if !ok {
+			continue
+		}
+		events = append(events, CalendarEvent{
+			UID:         course.ID + "@isucholar",
+			Summary:     course.Name,
+			Description: fmt.Sprintf("%s (%s)\n%s", course.Code, course.TeacherName, course.Description),
+			Start:       start,
+			End:         end,
+			Until:       until,
+		})
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/calendar; charset=utf-8")
+	c.Response().Header().Set(echo.HeaderContentDisposition, `inline; filename="courses.ics"`)
+	c.Response().WriteHeader(http.StatusOK)
+	return h.Timetable.writeICalendar(c.Response(), "履修科目", events, now)
+}
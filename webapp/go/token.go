@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	apiTokenPrefix = "isucholar_"
+	// apiTokenDefaultTTL は有効期限を指定しなかった場合のトークンの有効期間
+	apiTokenDefaultTTL = 30 * 24 * time.Hour
+	apiTokenMaxTTL     = 365 * 24 * time.Hour
+	// tokenUserContextKey はBearerトークンで認証したユーザをecho.Contextに保持するキー
+	tokenUserContextKey = "tokenUser"
+)
+
+// TokenScope はAPIトークンで利用できる操作の範囲
+type TokenScope string
+
+const (
+	// ScopeAny はトークンであればスコープを問わず利用できるAPIを表す
+	ScopeAny               TokenScope = ""
+	ScopeCoursesRead       TokenScope = "courses:read"
+	ScopeCoursesWrite      TokenScope = "courses:write"
+	ScopeGradesRead        TokenScope = "grades:read"
+	ScopeGradesWrite       TokenScope = "grades:write"
+	ScopeSubmissionsRead   TokenScope = "submissions:read"
+	ScopeSubmissionsWrite  TokenScope = "submissions:write"
+	ScopeAnnouncementsRead TokenScope = "announcements:read"
+)
+
+var tokenScopes = []TokenScope{
+	ScopeCoursesRead,
+	ScopeCoursesWrite,
+	ScopeGradesRead,
+	ScopeGradesWrite,
+	ScopeSubmissionsRead,
+	ScopeSubmissionsWrite,
+	ScopeAnnouncementsRead,
+}
+
+func isValidTokenScope(scope TokenScope) bool {
+	for _, s := range tokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// routeTokenScopes はトークンで利用できるAPIとそれに必要なスコープ
+// ここにないAPI(トークン・パスワード・セッションの管理など)はセッションでのみ利用できる
+var routeTokenScopes = map[string]TokenScope{
+	"GET /api/users/me":                                                      ScopeAny,
+	"GET /api/users/me/courses":                                              ScopeCoursesRead,
+	"PUT /api/users/me/courses":                                              ScopeCoursesWrite,
+	"GET /api/users/me/courses.ics":                                          ScopeCoursesRead,
+	"GET /api/users/me/grades":                                               ScopeGradesRead,
+	"GET /api/users/me/transcript.json":                                      ScopeGradesRead,
+	"GET /api/users/me/transcript.pdf":                                       ScopeGradesRead,
+	"GET /api/courses":                                                       ScopeCoursesRead,
+	"POST /api/courses":                                                      ScopeCoursesWrite,
+	"GET /api/courses/:courseID":                                             ScopeCoursesRead,
+	"PUT /api/courses/:courseID":                                             ScopeCoursesWrite,
+	"POST /api/courses/:courseID/copy":                                       ScopeCoursesWrite,
+	"PUT /api/courses/:courseID/status":                                      ScopeCoursesWrite,
+	"GET /api/courses/:courseID/grading-policy":                              ScopeCoursesRead,
+	"PUT /api/courses/:courseID/grading-policy":                              ScopeCoursesWrite,
+	"GET /api/courses/:courseID/stats":                                       ScopeGradesRead,
+	"GET /api/courses/:courseID/syllabus":                                    ScopeCoursesRead,
+	"PUT /api/courses/:courseID/syllabus":                                    ScopeCoursesWrite,
+	"DELETE /api/courses/:courseID/syllabus":                                 ScopeCoursesWrite,
+	"GET /api/courses/:courseID/classes":                                     ScopeCoursesRead,
+	"POST /api/courses/:courseID/classes":                                    ScopeCoursesWrite,
+	"PUT /api/courses/:courseID/classes/:classID":                            ScopeCoursesWrite,
+	"DELETE /api/courses/:courseID/classes/:classID":                         ScopeCoursesWrite,
+	"POST /api/courses/:courseID/classes/:classID/assignments":               ScopeSubmissionsWrite,
+	"PUT /api/courses/:courseID/classes/:classID/assignments/scores":         ScopeGradesWrite,
+	"PUT /api/courses/:courseID/classes/:classID/assignments/scores/publish": ScopeGradesWrite,
+	"GET /api/courses/:courseID/classes/:classID/materials":                  ScopeCoursesRead,
+	"POST /api/courses/:courseID/classes/:classID/materials":                 ScopeCoursesWrite,
+	"GET /api/courses/:courseID/classes/:classID/materials/:materialID":      ScopeCoursesRead,
+	"DELETE /api/courses/:courseID/classes/:classID/materials/:materialID":   ScopeCoursesWrite,
+	"POST /api/courses/:courseID/classes/:classID/attendance/session":        ScopeCoursesWrite,
+	"POST /api/courses/:courseID/classes/:classID/attendance":                ScopeCoursesWrite,
+	"GET /api/courses/:courseID/attendance":                                  ScopeCoursesRead,
+	"POST /api/courses/:courseID/classes/:classID/appeals":                   ScopeGradesWrite,
+	"GET /api/courses/:courseID/appeals":                                     ScopeGradesRead,
+	"PUT /api/courses/:courseID/appeals/:appealID":                           ScopeGradesWrite,
+	"GET /api/courses/:courseID/classes/:classID/assignments/export":         ScopeSubmissionsRead,
+	"GET /api/announcements":                                                 ScopeAnnouncementsRead,
+	"GET /api/announcements/:announcementID":                                 ScopeAnnouncementsRead,
+	"GET /api/announcements/:announcementID/attachments/:attachmentID":       ScopeAnnouncementsRead,
+}
+
+// queryTokenRoutes はAuthorizationヘッダを設定できないクライアント(カレンダーアプリなど)のために
+// ?access_token= でのトークンの指定を許可するAPI
+var queryTokenRoutes = map[string]bool{
+	"GET /api/users/me/courses.ics": true,
+}
+
+type APIToken struct {
+	ID        string    `db:"id"`
+	UserID    string    `db:"user_id"`
+	Name      string    `db:"name"`
+	TokenHash string    `db:"token_hash"`
+	Scopes    string    `db:"scopes"`
+	ExpiresAt time.Time `db:"expires_at"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func (t *APIToken) ScopeList() []TokenScope {
+	scopes := make([]TokenScope, 0)
+	for _, s := range strings.Fields(t.Scopes) {
+		scopes = append(scopes, TokenScope(s))
+	}
+	return scopes
+}
+
+func (t *APIToken) HasScope(scope TokenScope) bool {
+	if scope == ScopeAny {
+		return true
+	}
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenUser はBearerトークンで認証したユーザ
+type tokenUser struct {
+	ID      string
+	Name    string
+	IsAdmin bool
+}
+
+// authenticateBearer はBearerトークンを検証し、トークンのユーザをecho.Contextに保持する
+func (h *handlers) authenticateBearer(c echo.Context, token string, next echo.HandlerFunc) error {
+	var apiToken APIToken
+	if err := h.DB.Get(&apiToken, "SELECT * FROM `api_tokens` WHERE `token_hash` = ? AND `expires_at` > NOW(6)", hashSecretToken(token)); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+		return c.String(http.StatusUnauthorized, "Invalid or expired token.")
+	}
+
+	scope, ok := routeTokenScopes[c.Request().Method+" "+c.Path()]
+	if !ok {
+		return c.String(http.StatusForbidden, "This API is not available with a token.")
+	}
+	if !apiToken.HasScope(scope) {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="insufficient_scope", scope="`+string(scope)+`"`)
+		return c.String(http.StatusForbidden, "The token does not have the required scope.")
+	}
+
+	var user User
+	if err := h.DB.Get(&user, "SELECT * FROM `users` WHERE `id` = ?", apiToken.UserID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if user.Deactivated {
+		return c.String(http.StatusUnauthorized, "This account is deactivated.")
+	}
+	c.Set(tokenUserContextKey, &tokenUser{
+		ID:      user.ID,
+		Name:    user.Name,
+		IsAdmin: isStaff(user.Type),
+	})
+
+	return next(c)
+}
+
+type CreateTokenRequest struct {
+	Name          string       `json:"name"`
+	Scopes        []TokenScope `json:"scopes"`
+	ExpiresInDays int          `json:"expires_in_days"`
+}
+
+type APITokenResponse struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Scopes    []TokenScope `json:"scopes"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+type CreateTokenResponse struct {
+	APITokenResponse
+	Token string `json:"token"`
+}
+
+func newAPITokenResponse(t APIToken) APITokenResponse {
+	return APITokenResponse{
+		ID:        t.ID,
+		Name:      t.Name,
+		Scopes:    t.ScopeList(),
+		ExpiresAt: t.ExpiresAt,
+		CreatedAt: t.CreatedAt,
+	}
+}
+
+// GetMyTokens GET /api/users/me/tokens 自身のAPIトークン一覧取得
+func (h *handlers) GetMyTokens(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	tokens := make([]APIToken, 0)
+	if err := h.DB.Select(&tokens, "SELECT * FROM `api_tokens` WHERE `user_id` = ? AND `expires_at` > NOW(6) ORDER BY `id`", userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := make([]APITokenResponse, 0, len(tokens))
+	for _, t := range tokens {
+		res = append(res, newAPITokenResponse(t))
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// CreateMyToken POST /api/users/me/tokens APIトークンの発行
+// トークンはこのレスポンスでのみ返し、DBにはハッシュ値のみを保存する
+func (h *handlers) CreateMyToken(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var req CreateTokenRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if req.Name == "" || len(req.Name) > 255 {
+		return c.String(http.StatusBadRequest, "Invalid token name.")
+	}
+	if len(req.Scopes) == 0 {
+		return c.String(http.StatusBadRequest, "At least one scope is required.")
+	}
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		if !isValidTokenScope(scope) {
+			return c.String(http.StatusBadRequest, "Unknown scope: "+string(scope))
+		}
+		scopes = append(scopes, string(scope))
+	}
+	ttl := apiTokenDefaultTTL
+	if req.ExpiresInDays != 0 {
+		ttl = time.Duration(req.ExpiresInDays) * 24 * time.Hour
+		if ttl <= 0 || ttl > apiTokenMaxTTL {
+			return c.String(http.StatusBadRequest, "Invalid expires_in_days.")
+		}
+	}
+
+	token, tokenHash, err := newSecretToken(apiTokenPrefix)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	now := time.Now()
+	apiToken := APIToken{
+		ID:        newULID(),
+		UserID:    userID,
+		Name:      req.Name,
+		TokenHash: tokenHash,
+		Scopes:    strings.Join(scopes, " "),
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+	if _, err := h.DB.Exec("INSERT INTO `api_tokens` (`id`, `user_id`, `name`, `token_hash`, `scopes`, `expires_at`, `created_at`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		apiToken.ID, apiToken.UserID, apiToken.Name, apiToken.TokenHash, apiToken.Scopes, apiToken.ExpiresAt, apiToken.CreatedAt); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, CreateTokenResponse{
+		APITokenResponse: newAPITokenResponse(apiToken),
+		Token:            token,
+	})
+}
+
+// DeleteMyToken DELETE /api/users/me/tokens/:tokenID APIトークンの失効
+func (h *handlers) DeleteMyToken(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	result, err := h.DB.Exec("DELETE FROM `api_tokens` WHERE `id` = ? AND `user_id` = ?", c.Param("tokenID"), userID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if n == 0 {
+		return c.String(http.StatusNotFound, "No such token.")
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// TranscriptCourse は成績証明書に記載する修了済みの科目
+type TranscriptCourse struct {
+	Code        string      `json:"code"`
+	Name        string      `json:"name"`
+	Credit      uint8       `json:"credit"`
+	GradingType GradingType `json:"grading_type"`
+	// Grade は評語。成績評価の方式が score の科目は空文字列
+	Grade      LetterGrade `json:"grade"`
+	TotalScore int         `json:"total_score"`
+}
+
+// TranscriptContent は成績証明書の内容。検証用ハッシュはこのJSON表現から計算する
+type TranscriptContent struct {
+	UserCode string             `json:"user_code"`
+	UserName string             `json:"user_name"`
+	Courses  []TranscriptCourse `json:"courses"`
+	Credits  int                `json:"credits"`
+	GPA      float64            `json:"gpa"`
+}
+
+type Transcript struct {
+	TranscriptContent
+	Hash      string    `json:"hash"`
+	IssuedAt  time.Time `json:"issued_at"`
+	VerifyURL string    `json:"verify_url"`
+}
+
+// transcriptVerifyPath は検証用ハッシュから成績証明書を照会するパス
+func transcriptVerifyPath(hash string) string {
+	return "/transcripts/verify/" + hash
+}
+
+// buildTranscriptContent は学生の修了済みの科目から成績証明書の内容を作る
+func buildTranscriptContent(q sqlx.Queryer, userID string) (*TranscriptContent, error) {
+	var user User
+	if err := sqlx.Get(q, &user, "SELECT * FROM `users` WHERE `id` = ?", userID); err != nil {
+		return nil, err
+	}
+
+	var courses []struct {
+		Course
+		TotalScore int `db:"total_score"`
+	}
+	query := "SELECT `courses`.*, IFNULL(`course_score_totals`.`total_score`, 0) AS `total_score`" +
+		" FROM `registrations`" +
+		" JOIN `courses` ON `registrations`.`course_id` = `courses`.`id`" +
+		" LEFT JOIN `course_score_totals` ON `course_score_totals`.`course_id` = `registrations`.`course_id` AND `course_score_totals`.`user_id` = `registrations`.`user_id`" +
+		" WHERE `registrations`.`user_id` = ? AND `courses`.`status` = ?" +
+		" ORDER BY `courses`.`code`"
+	if err := sqlx.Select(q, &courses, query, userID, StatusClosed); err != nil {
+		return nil, err
+	}
+	courseIDs := make([]string, 0, len(courses))
+	for _, course := range courses {
+		courseIDs = append(courseIDs, course.ID)
+	}
+	policies, err := loadGradingPolicies(q, courseIDs)
+	if err != nil {
+		return nil, err
+	}
+	maxScores, err := loadMaxScores(q, policies)
+	if err != nil {
+		return nil, err
+	}
+
+	content := &TranscriptContent{
+		UserCode: user.Code,
+		UserName: user.Name,
+		Courses:  make([]TranscriptCourse, 0, len(courses)),
+	}
+	gradePointsSum := 0
+	gpaCredits := 0
+	for _, course := range courses {
+		policy := policies[course.ID]
+		grade, gradePoints, countsForGPA := policy.Grade(course.TotalScore, maxScores[course.ID])
+		content.Courses = append(content.Courses, TranscriptCourse{
+			Code:        course.Code,
+			Name:        course.Name,
+			Credit:      course.Credit,
+			GradingType: policy.Type,
+			Grade:       grade,
+			TotalScore:  course.TotalScore,
+		})
+		content.Credits += int(course.Credit)
+		if countsForGPA {
+			gradePointsSum += gradePoints * int(course.Credit)
+			gpaCredits += int(course.Credit)
+		}
+	}
+	if gpaCredits > 0 {
+		content.GPA = float64(gradePointsSum) / 100 / float64(gpaCredits)
+	}
+	return content, nil
+}
+
+// issueTranscript は成績証明書を発行する
+// 内容が同じ成績証明書は同じハッシュになり、最初に発行した日時が発行日時になる
+func issueTranscript(db *sqlx.DB, userID string) (*Transcript, error) {
+	content, err := buildTranscriptContent(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	if _, err := db.Exec("INSERT IGNORE INTO `transcripts` (`hash`, `user_id`, `content`, `issued_at`) VALUES (?, ?, ?, NOW(6))", hash, userID, string(data)); err != nil {
+		return nil, err
+	}
+	var issuedAt time.Time
+	if err := db.Get(&issuedAt, "SELECT `issued_at` FROM `transcripts` WHERE `hash` = ?", hash); err != nil {
+		return nil, err
+	}
+
+	return &Transcript{
+		TranscriptContent: *content,
+		Hash:              hash,
+		IssuedAt:          issuedAt,
+		VerifyURL:         transcriptVerifyPath(hash),
+	}, nil
+}
+
+// findTranscript は検証用ハッシュから発行済みの成績証明書を取得する
+func findTranscript(db sqlx.Queryer, hash string) (*Transcript, error) {
+	var row struct {
+		Content  []byte    `db:"content"`
+		IssuedAt time.Time `db:"issued_at"`
+	}
+	if err := sqlx.Get(db, &row, "SELECT `content`, `issued_at` FROM `transcripts` WHERE `hash` = ?", hash); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var content TranscriptContent
+	if err := json.Unmarshal(row.Content, &content); err != nil {
+		return nil, err
+	}
+	return &Transcript{
+		TranscriptContent: content,
+		Hash:              hash,
+		IssuedAt:          row.IssuedAt,
+		VerifyURL:         transcriptVerifyPath(hash),
+	}, nil
+}
+
+// transcriptPDF は成績証明書をPDFにする
+func transcriptPDF(t *Transcript, loc *time.Location) ([]byte, error) {
+	const (
+		left        = 56.0
+		top         = 780.0
+		bottom      = 90.0
+		rowHeight   = 18.0
+		rowsPerPage = 29
+	)
+
+	doc := NewPDFDocument()
+	courses := t.Courses
+
+	pageCount := (len(courses) + rowsPerPage - 1) / rowsPerPage
+	if pageCount == 0 {
+		pageCount = 1
+	}
+	for page := 0; page < pageCount; page++ {
+		doc.AddPage()
+		doc.Text(left, top, 20, "成績証明書")
+		doc.Text(left, top-30, 11, fmt.Sprintf("学籍番号: %s    氏名: %s", t.UserCode, t.UserName))
+		doc.Text(left, top-48, 11, "発行日: "+t.IssuedAt.In(loc).Format("2006-01-02"))
+		doc.Text(doc.Width-left-60, top, 9, fmt.Sprintf("%d / %d", page+1, pageCount))
+
+		y := top - 90
+		doc.Text(left, y, 10, "科目コード")
+		doc.Text(left+80, y, 10, "科目名")
+		doc.Text(left+360, y, 10, "単位")
+		doc.Text(left+410, y, 10, "評価")
+		doc.Line(left, y-6, doc.Width-left, y-6)
+		y -= rowHeight + 4
+
+		end := (page + 1) * rowsPerPage
+		if end > len(courses) {
+			end = len(courses)
+		}
+		for _, course := range courses[page*rowsPerPage : end] {
+			doc.Text(left, y, 10, course.Code)
+			doc.Text(left+80, y, 10, truncateRunes(course.Name, 26))
+			doc.Text(left+360, y, 10, fmt.Sprintf("%d", course.Credit))
+			doc.Text(left+410, y, 10, transcriptGradeLabel(course))
+			y -= rowHeight
+		}
+	}
+
+	doc.Line(left, bottom+40, doc.Width-left, bottom+40)
+	doc.Text(left, bottom+22, 11, fmt.Sprintf("修得単位数: %d    GPA: %.2f", t.Credits, t.GPA))
+	doc.Text(left, bottom+4, 8, "検証用ハッシュ: "+t.Hash)
+	doc.Text(left, bottom-10, 8, "照会先: "+t.VerifyURL)
+
+	var buf bytes.Buffer
+	if _, err := doc.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func transcriptGradeLabel(course TranscriptCourse) string {
+	if course.Grade != "" {
+		return string(course.Grade)
+	}
+	return fmt.Sprintf("%d点", course.TotalScore)
+}
+
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// GetMyTranscript GET /api/users/me/transcript.json 成績証明書の発行
+func (h *handlers) GetMyTranscript(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	transcript, err := issueTranscript(h.DB, userID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, transcript)
+}
+
+// GetMyTranscriptPDF GET /api/users/me/transcript.pdf 成績証明書をPDFで発行
+func (h *handlers) GetMyTranscriptPDF(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	transcript, err := issueTranscript(h.DB, userID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	data, err := transcriptPDF(transcript, h.Timetable.Location)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="transcript-`+transcript.UserCode+`.pdf"`)
+	return c.Blob(http.StatusOK, "application/pdf", data)
+}
+
+type VerifyTranscriptResponse struct {
+	Valid      bool        `json:"valid"`
+	Transcript *Transcript `json:"transcript"`
+}
+
+// VerifyTranscript GET /transcripts/verify/:hash 検証用ハッシュによる成績証明書の照会
+func (h *handlers) VerifyTranscript(c echo.Context) error {
+	transcript, err := findTranscript(h.DB, c.Param("hash"))
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if transcript == nil {
+		return c.JSON(http.StatusNotFound, VerifyTranscriptResponse{Valid: false})
+	}
+
+	return c.JSON(http.StatusOK, VerifyTranscriptResponse{
+		Valid:      true,
+		Transcript: transcript,
+	})
+}
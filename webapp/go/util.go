@@ -1,12 +1,26 @@
 package main
 
 import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"math"
 	"math/rand"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/labstack/echo/v4"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -18,6 +32,18 @@ func GetEnv(key, val string) string {
 	}
 }
 
+// placeholders は n 個のプレースホルダをカンマ区切りで返す
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// escapeLike は LIKE のパターン中で特別な意味を持つ文字をエスケープする
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
 func contains(arr []DayOfWeek, day DayOfWeek) bool {
 	for _, v := range arr {
 		if v == day {
@@ -32,12 +58,202 @@ var (
 	entropyLock sync.Mutex
 )
 
+// newSecretToken はランダムなトークンと、DBに保存するそのハッシュ値を生成する
+func newSecretToken(prefix string) (token string, tokenHash string, err error) {
+	b := make([]byte, 32)
+	if _, err := crand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = prefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, hashSecretToken(token), nil
+}
+
+func hashSecretToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func newULID() string {
 	entropyLock.Lock()
 	defer entropyLock.Unlock()
 	return ulid.MustNew(ulid.Now(), entropy).String()
 }
 
+// ulidLowerBound は時刻 t 以降に生成された ULID の下限値を返す
+// ULID で表せない時刻(1970年より前や、48bitのミリ秒を超える時刻)の場合はエラーを返す
+func ulidLowerBound(t time.Time) (string, error) {
+	var id ulid.ULID
+	if err := id.SetTime(ulid.Timestamp(t)); err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// parseDateParam は RFC3339 もしくは YYYY-MM-DD 形式の日時を解釈する
+// YYYY-MM-DD 形式の場合は dateOnly が true になり、loc におけるその日の0時とする
+func parseDateParam(s string, loc *time.Location) (t time.Time, dateOnly bool, err error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, false, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02", s, loc)
+	return t, true, err
+}
+
+// ----- files -----
+
+// stagedFiles はトランザクション中に書き込むファイルを一時ファイルとして保持する
+// コミット後に commit で本来のパスに移動し、それ以外の場合は discard で一時ファイルを削除する
+type stagedFiles struct {
+	tmpPaths []string
+	dstPaths []string
+}
+
+// stage は dst と同じディレクトリに一時ファイルを作成して data を書き込む
+func (s *stagedFiles) stage(dst string, data []byte) error {
+	return s.stageFrom(dst, bytes.NewReader(data))
+}
+
+// stageCopy は dst と同じディレクトリに一時ファイルを作成して src の内容をコピーする
+func (s *stagedFiles) stageCopy(dst string, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return s.stageFrom(dst, in)
+}
+
+func (s *stagedFiles) stageFrom(dst string, r io.Reader) error {
+	f, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	s.tmpPaths = append(s.tmpPaths, f.Name())
+	s.dstPaths = append(s.dstPaths, dst)
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// commit は一時ファイルを本来のパスに移動する
+func (s *stagedFiles) commit() error {
+	for i, tmp := range s.tmpPaths {
+		if err := os.Rename(tmp, s.dstPaths[i]); err != nil {
+			return err
+		}
+	}
+	s.tmpPaths = nil
+	s.dstPaths = nil
+	return nil
+}
+
+// discard は移動していない一時ファイルを削除する
+func (s *stagedFiles) discard() {
+	_ = removeFiles(s.tmpPaths)
+	s.tmpPaths = nil
+	s.dstPaths = nil
+}
+
+// ----- pagination -----
+
+type CursorDirection string
+
+const (
+	CursorNext CursorDirection = "next"
+	CursorPrev CursorDirection = "prev"
+)
+
+// Pagination はページング指定
+// Page は page= による指定(非推奨)の場合のみ 1 以上になる
+type Pagination struct {
+	Page      int
+	Direction CursorDirection
+	Key       string
+}
+
+func encodeCursor(direction CursorDirection, key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(string(direction) + ":" + key))
+}
+
+func decodeCursor(cursor string) (CursorDirection, string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", err
+	}
+	arr := strings.SplitN(string(data), ":", 2)
+	if len(arr) != 2 || arr[1] == "" {
+		return "", "", errors.New("invalid cursor")
+	}
+	direction := CursorDirection(arr[0])
+	if direction != CursorNext && direction != CursorPrev {
+		return "", "", errors.New("invalid cursor")
+	}
+	return direction, arr[1], nil
+}
+
+// parsePagination は cursor= もしくは page= からページング指定を取得する
+// 両方指定された場合は cursor= を優先する
+func parsePagination(c echo.Context) (Pagination, error) {
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		direction, key, err := decodeCursor(cursor)
+		if err != nil {
+			return Pagination{}, err
+		}
+		return Pagination{Direction: direction, Key: key}, nil
+	}
+	if c.QueryParam("page") != "" {
+		page, err := strconv.Atoi(c.QueryParam("page"))
+		if err != nil || page <= 0 {
+			return Pagination{}, errors.New("invalid page")
+		}
+		return Pagination{Page: page}, nil
+	}
+	return Pagination{}, nil
+}
+
+// pagingLinkHeader は Link ヘッダの値を組み立てる
+// hasMore は取得方向にまだ続きが存在するかどうか、firstKey, lastKey は取得したページの先頭と末尾のキー
+func pagingLinkHeader(c echo.Context, p Pagination, hasMore bool, firstKey, lastKey string) (string, error) {
+	linkURL, err := url.Parse(c.Request().URL.Path + "?" + c.Request().URL.RawQuery)
+	if err != nil {
+		return "", err
+	}
+	q := linkURL.Query()
+
+	var links []string
+	if p.Page > 0 {
+		if p.Page > 1 {
+			q.Set("page", strconv.Itoa(p.Page-1))
+			linkURL.RawQuery = q.Encode()
+			links = append(links, fmt.Sprintf("<%v>; rel=\"prev\"", linkURL))
+		}
+		if hasMore {
+			q.Set("page", strconv.Itoa(p.Page+1))
+			linkURL.RawQuery = q.Encode()
+			links = append(links, fmt.Sprintf("<%v>; rel=\"next\"", linkURL))
+		}
+		return strings.Join(links, ","), nil
+	}
+
+	if firstKey == "" || lastKey == "" {
+		return "", nil
+	}
+	q.Del("page")
+	if p.Direction == CursorNext || (p.Direction == CursorPrev && hasMore) {
+		q.Set("cursor", encodeCursor(CursorPrev, firstKey))
+		linkURL.RawQuery = q.Encode()
+		links = append(links, fmt.Sprintf("<%v>; rel=\"prev\"", linkURL))
+	}
+	if p.Direction == CursorPrev || (p.Direction != CursorPrev && hasMore) {
+		q.Set("cursor", encodeCursor(CursorNext, lastKey))
+		linkURL.RawQuery = q.Encode()
+		links = append(links, fmt.Sprintf("<%v>; rel=\"next\"", linkURL))
+	}
+	return strings.Join(links, ","), nil
+}
+
 // ----- int -----
 
 func averageInt(arr []int, or float64) float64 {
@@ -98,6 +314,52 @@ func tScoreInt(v int, arr []int) float64 {
 	}
 }
 
+// percentileInt は p パーセンタイル(0~100)を線形補間で求める (Excel の PERCENTILE.INC と同じ)
+func percentileInt(arr []int, p float64, or float64) float64 {
+	if len(arr) == 0 {
+		return or
+	}
+	sorted := make([]int, len(arr))
+	copy(sorted, arr)
+	sort.Ints(sorted)
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return float64(sorted[lower]) + (rank-float64(lower))*float64(sorted[upper]-sorted[lower])
+}
+
+func medianInt(arr []int, or float64) float64 {
+	return percentileInt(arr, 50, or)
+}
+
+// histogramInt は [0, upper] を幅 width の区間に分けて、区間毎の値の数を返す
+// i 番目の区間は [i*width, (i+1)*width) で、upper は最後の区間に含める。範囲外の値は端の区間に数える
+func histogramInt(arr []int, width int, upper int) []int {
+	if width <= 0 {
+		width = 1
+	}
+	if upper < 0 {
+		upper = 0
+	}
+	buckets := upper/width + 1
+	if upper > 0 && upper%width == 0 {
+		buckets--
+	}
+	counts := make([]int, buckets)
+	for _, v := range arr {
+		i := v / width
+		if v < 0 {
+			i = 0
+		}
+		if i >= buckets {
+			i = buckets - 1
+		}
+		counts[i]++
+	}
+	return counts
+}
+
 // ----- float64 -----
 
 func isAllEqualFloat64(arr []float64) bool {
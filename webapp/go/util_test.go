@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// benchmarker/util/util_test.go と同じ入力でベンチマーカーの実装と結果が一致することを確認する
+var percentileTests = []struct {
+	name string
+	arr  []int
+	p    float64
+	want float64
+}{
+	{name: "empty returns default", arr: []int{}, p: 50, want: -1},
+	{name: "single value", arr: []int{42}, p: 25, want: 42},
+	{name: "q1 interpolated", arr: []int{1, 2, 3, 4}, p: 25, want: 1.75},
+	{name: "median of even length", arr: []int{1, 2, 3, 4}, p: 50, want: 2.5},
+	{name: "q3 interpolated", arr: []int{1, 2, 3, 4}, p: 75, want: 3.25},
+	{name: "unsorted q1", arr: []int{40, 15, 50, 20, 35}, p: 25, want: 20},
+	{name: "unsorted median", arr: []int{40, 15, 50, 20, 35}, p: 50, want: 35},
+	{name: "unsorted q3", arr: []int{40, 15, 50, 20, 35}, p: 75, want: 40},
+	{name: "two values", arr: []int{0, 100}, p: 25, want: 25},
+	{name: "same values", arr: []int{7, 7, 7}, p: 75, want: 7},
+	{name: "minimum", arr: []int{3, 1, 2}, p: 0, want: 1},
+	{name: "maximum", arr: []int{3, 1, 2}, p: 100, want: 3},
+}
+
+func TestPercentileInt(t *testing.T) {
+	for _, tt := range percentileTests {
+		t.Run(tt.name, func(t *testing.T) {
+			arr := make([]int, len(tt.arr))
+			copy(arr, tt.arr)
+			if got := percentileInt(arr, tt.p, -1); got != tt.want {
+				t.Errorf("percentileInt(%v, %v) = %v, want %v", tt.arr, tt.p, got, tt.want)
+			}
+			if !reflect.DeepEqual(arr, tt.arr) {
+				t.Errorf("percentileInt modified the input: %v", arr)
+			}
+		})
+	}
+}
+
+func TestMedianInt(t *testing.T) {
+	if got := medianInt([]int{5, 1, 4, 2, 3}, 0); got != 3 {
+		t.Errorf("medianInt = %v, want 3", got)
+	}
+	if got := medianInt(nil, -1); got != -1 {
+		t.Errorf("medianInt(nil) = %v, want -1", got)
+	}
+}
+
+var histogramTests = []struct {
+	name  string
+	arr   []int
+	width int
+	upper int
+	want  []int
+}{
+	{name: "upper is in the last bucket", arr: []int{0, 5, 10, 99, 100}, width: 10, upper: 100, want: []int{2, 1, 0, 0, 0, 0, 0, 0, 0, 2}},
+	{name: "out of range values", arr: []int{-1, 150}, width: 10, upper: 100, want: []int{1, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+	{name: "upper not divisible by width", arr: []int{9, 10, 25}, width: 10, upper: 25, want: []int{1, 1, 1}},
+	{name: "no values", arr: nil, width: 50, upper: 100, want: []int{0, 0}},
+	{name: "invalid width", arr: []int{0, 0}, width: 0, upper: 0, want: []int{2}},
+}
+
+func TestHistogramInt(t *testing.T) {
+	for _, tt := range histogramTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := histogramInt(tt.arr, tt.width, tt.upper); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("histogramInt(%v, %d, %d) = %v, want %v", tt.arr, tt.width, tt.upper, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDateParam(t *testing.T) {
+	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
+	tests := []struct {
+		in           string
+		want         time.Time
+		wantDateOnly bool
+		wantErr      bool
+	}{
+		{in: "2021-09-18", want: time.Date(2021, 9, 17, 15, 0, 0, 0, time.UTC), wantDateOnly: true},
+		{in: "2021-09-18T10:00:00Z", want: time.Date(2021, 9, 18, 10, 0, 0, 0, time.UTC)},
+		{in: "2021-09-18T10:00:00+09:00", want: time.Date(2021, 9, 18, 1, 0, 0, 0, time.UTC)},
+		{in: "2021/09/18", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, dateOnly, err := parseDateParam(tt.in, jst)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseDateParam(%q) = nil error, want error", tt.in)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDateParam(%q) = %v", tt.in, err)
+			}
+			if !got.Equal(tt.want) || dateOnly != tt.wantDateOnly {
+				t.Errorf("parseDateParam(%q) = (%v, %v), want (%v, %v)", tt.in, got, dateOnly, tt.want, tt.wantDateOnly)
+			}
+		})
+	}
+}
+
+func TestULIDLowerBound(t *testing.T) {
+	if _, err := ulidLowerBound(time.Date(1969, 12, 31, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Errorf("ulidLowerBound before the unix epoch = nil error, want error")
+	}
+	if _, err := ulidLowerBound(time.Date(12000, 1, 1, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Errorf("ulidLowerBound after the max ULID time = nil error, want error")
+	}
+
+	at := time.Date(2021, 9, 18, 1, 0, 0, 0, time.UTC)
+	bound, err := ulidLowerBound(at)
+	if err != nil {
+		t.Fatalf("ulidLowerBound(%v) = %v", at, err)
+	}
+	before, err := ulidLowerBound(at.Add(-time.Millisecond))
+	if err != nil {
+		t.Fatalf("ulidLowerBound(%v) = %v", at.Add(-time.Millisecond), err)
+	}
+	if !(before < bound) {
+		t.Errorf("ulidLowerBound is not ordered by time: %s >= %s", before, bound)
+	}
+}
+
+func TestStagedFiles(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "attachment")
+
+	var discarded stagedFiles
+	if err := discarded.stage(dst, []byte("discarded")); err != nil {
+		t.Fatal(err)
+	}
+	discarded.discard()
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("discard left files: %v (err: %v)", entries, err)
+	}
+
+	var committed stagedFiles
+	if err := committed.stage(dst, []byte("committed")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("staged file is visible before commit: %v", err)
+	}
+	if err := committed.commit(); err != nil {
+		t.Fatal(err)
+	}
+	committed.discard()
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "committed" {
+		t.Errorf("committed file = %q, want %q", data, "committed")
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("commit left temporary files: %v (err: %v)", entries, err)
+	}
+}
+
+func TestStagedFilesStageCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "source")
+	dst := filepath.Join(dir, "copy")
+	if err := os.WriteFile(src, []byte("material"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var staged stagedFiles
+	if err := staged.stageCopy(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("staged copy is visible before commit: %v", err)
+	}
+	if err := staged.commit(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "material" {
+		t.Errorf("copied file = %q, want %q", data, "material")
+	}
+
+	var missing stagedFiles
+	if err := missing.stageCopy(filepath.Join(dir, "missing-copy"), filepath.Join(dir, "missing")); err == nil {
+		t.Error("stageCopy of a missing source = nil, want error")
+	}
+	missing.discard()
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Errorf("unexpected files left: %v (err: %v)", entries, err)
+	}
+}
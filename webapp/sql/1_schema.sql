@@ -1,4 +1,24 @@
 -- CREATEと逆順
+DROP TABLE IF EXISTS `course_syllabi`;
+DROP TABLE IF EXISTS `class_materials`;
+DROP TABLE IF EXISTS `attendances`;
+DROP TABLE IF EXISTS `attendance_sessions`;
+DROP TABLE IF EXISTS `appeal_events`;
+DROP TABLE IF EXISTS `appeals`;
+DROP TABLE IF EXISTS `transcripts`;
+DROP TABLE IF EXISTS `letter_grades`;
+DROP TABLE IF EXISTS `grading_weights`;
+DROP TABLE IF EXISTS `grading_policies`;
+DROP TABLE IF EXISTS `user_gpa_aggregates`;
+DROP TABLE IF EXISTS `course_score_totals`;
+DROP TABLE IF EXISTS `class_aggregates`;
+DROP TABLE IF EXISTS `api_tokens`;
+DROP TABLE IF EXISTS `course_staff`;
+DROP TABLE IF EXISTS `password_reset_tokens`;
+DROP TABLE IF EXISTS `login_events`;
+DROP TABLE IF EXISTS `login_attempts`;
+DROP TABLE IF EXISTS `sessions`;
+DROP TABLE IF EXISTS `announcement_attachments`;
 DROP TABLE IF EXISTS `unread_announcements`;
 DROP TABLE IF EXISTS `announcements`;
 DROP TABLE IF EXISTS `submissions`;
@@ -11,10 +31,15 @@ DROP TABLE IF EXISTS `users`;
 CREATE TABLE `users`
 (
     `id`              CHAR(26) PRIMARY KEY,
-    `code`            CHAR(6) UNIQUE              NOT NULL,
-    `name`            VARCHAR(255)                NOT NULL,
-    `hashed_password` BINARY(60)                  NOT NULL,
-    `type`            ENUM ('student', 'teacher') NOT NULL
+    `code`            CHAR(6) UNIQUE                                 NOT NULL,
+    `name`            VARCHAR(255)                                   NOT NULL,
+    `hashed_password` BINARY(60)                                     NOT NULL,
+    `type`            ENUM ('student', 'teacher', 'ta', 'registrar') NOT NULL,
+    `deactivated`     TINYINT(1)                                     NOT NULL DEFAULT false,
+    `email`           VARCHAR(255)                                   NOT NULL DEFAULT '',
+    `department`      VARCHAR(255)                                   NOT NULL DEFAULT '',
+    `enrollment_year` SMALLINT UNSIGNED,
+    `avatar_url`      VARCHAR(255)                                   NOT NULL DEFAULT ''
 );
 
 CREATE TABLE `courses`
@@ -30,6 +55,7 @@ CREATE TABLE `courses`
     `teacher_id`  CHAR(26)                                                      NOT NULL,
     `keywords`    TEXT                                                          NOT NULL,
     `status`      ENUM ('registration', 'in-progress', 'closed')                NOT NULL DEFAULT 'registration',
+    FULLTEXT KEY `idx_courses_name_keywords` (`name`, `keywords`) WITH PARSER ngram,
     CONSTRAINT FK_courses_teacher_id FOREIGN KEY (`teacher_id`) REFERENCES `users` (`id`)
 );
 
@@ -50,6 +76,7 @@ CREATE TABLE `classes`
     `title`             VARCHAR(255)     NOT NULL,
     `description`       TEXT             NOT NULL,
     `submission_closed` TINYINT(1)       NOT NULL DEFAULT false,
+    `scores_published`  TINYINT(1)       NOT NULL DEFAULT false,
     UNIQUE KEY `idx_classes_course_id_part` (`course_id`, `part`),
     CONSTRAINT FK_classes_course_id FOREIGN KEY (`course_id`) REFERENCES `courses` (`id`)
 );
@@ -71,6 +98,7 @@ CREATE TABLE `announcements`
     `course_id`  CHAR(26)     NOT NULL,
     `title`      VARCHAR(255) NOT NULL,
     `message`    TEXT         NOT NULL,
+    FULLTEXT KEY `idx_announcements_title_message` (`title`, `message`) WITH PARSER ngram,
     CONSTRAINT FK_announcements_course_id FOREIGN KEY (`course_id`) REFERENCES `courses` (`id`)
 );
 
@@ -83,3 +111,219 @@ CREATE TABLE `unread_announcements`
     CONSTRAINT FK_unread_announcements_announcement_id FOREIGN KEY (`announcement_id`) REFERENCES `announcements` (`id`),
     CONSTRAINT FK_unread_announcements_user_id FOREIGN KEY (`user_id`) REFERENCES `users` (`id`)
 );
+
+CREATE TABLE `announcement_attachments`
+(
+    `id`              CHAR(26) PRIMARY KEY,
+    `announcement_id` CHAR(26)     NOT NULL,
+    `file_name`       VARCHAR(255) NOT NULL,
+    CONSTRAINT FK_announcement_attachments_announcement_id FOREIGN KEY (`announcement_id`) REFERENCES `announcements` (`id`)
+);
+
+CREATE TABLE `sessions`
+(
+    `id`         VARCHAR(64) PRIMARY KEY,
+    `user_id`    CHAR(26)    NOT NULL,
+    `data`       BLOB        NOT NULL,
+    `expires_at` DATETIME(6) NOT NULL,
+    INDEX `idx_sessions_user_id` (`user_id`)
+);
+
+CREATE TABLE `login_attempts`
+(
+    `scope`          ENUM ('account', 'ip') NOT NULL,
+    `key`            VARCHAR(255)           NOT NULL,
+    `failure_count`  INT UNSIGNED           NOT NULL,
+    `last_failed_at` DATETIME(6)            NOT NULL,
+    `locked_until`   DATETIME(6),
+    PRIMARY KEY (`scope`, `key`)
+);
+
+CREATE TABLE `login_events`
+(
+    `id`         CHAR(26) PRIMARY KEY,
+    `user_code`  TEXT                                  NOT NULL,
+    `user_id`    CHAR(26),
+    `result`     ENUM ('success', 'failure', 'locked', 'deactivated') NOT NULL,
+    `ip`         VARCHAR(45)                           NOT NULL,
+    `user_agent` TEXT                                  NOT NULL,
+    `created_at` DATETIME(6)                           NOT NULL
+);
+
+CREATE TABLE `password_reset_tokens`
+(
+    `token_hash` CHAR(64) PRIMARY KEY,
+    `user_id`    CHAR(26)    NOT NULL,
+    `expires_at` DATETIME(6) NOT NULL,
+    `used_at`    DATETIME(6),
+    `created_at` DATETIME(6) NOT NULL,
+    CONSTRAINT FK_password_reset_tokens_user_id FOREIGN KEY (`user_id`) REFERENCES `users` (`id`)
+);
+
+CREATE TABLE `course_staff`
+(
+    `course_id` CHAR(26),
+    `user_id`   CHAR(26),
+    `role`      ENUM ('ta') NOT NULL,
+    PRIMARY KEY (`course_id`, `user_id`),
+    CONSTRAINT FK_course_staff_course_id FOREIGN KEY (`course_id`) REFERENCES `courses` (`id`),
+    CONSTRAINT FK_course_staff_user_id FOREIGN KEY (`user_id`) REFERENCES `users` (`id`)
+);
+
+CREATE TABLE `api_tokens`
+(
+    `id`         CHAR(26) PRIMARY KEY,
+    `user_id`    CHAR(26)     NOT NULL,
+    `name`       VARCHAR(255) NOT NULL,
+    `token_hash` CHAR(64)     NOT NULL,
+    `scopes`     VARCHAR(255) NOT NULL,
+    `expires_at` DATETIME(6)  NOT NULL,
+    `created_at` DATETIME(6)  NOT NULL,
+    UNIQUE KEY `idx_api_tokens_token_hash` (`token_hash`),
+    CONSTRAINT FK_api_tokens_user_id FOREIGN KEY (`user_id`) REFERENCES `users` (`id`)
+);
+
+-- 科目の成績評価の方針。行がない科目はデフォルトの方針(grading.go)で評価する
+CREATE TABLE `grading_policies`
+(
+    `course_id`         CHAR(26) PRIMARY KEY,
+    `type`              ENUM ('score', 'letter', 'pass_fail') NOT NULL DEFAULT 'score',
+    `pass_score`        TINYINT UNSIGNED                      NOT NULL DEFAULT 60,
+    `attendance_weight` TINYINT UNSIGNED                      NOT NULL DEFAULT 0 COMMENT '出席1回あたりの点数',
+    CONSTRAINT FK_grading_policies_course_id FOREIGN KEY (`course_id`) REFERENCES `courses` (`id`)
+);
+
+CREATE TABLE `grading_weights`
+(
+    `course_id` CHAR(26),
+    `part`      TINYINT UNSIGNED NOT NULL,
+    `weight`    TINYINT UNSIGNED NOT NULL,
+    PRIMARY KEY (`course_id`, `part`),
+    CONSTRAINT FK_grading_weights_course_id FOREIGN KEY (`course_id`) REFERENCES `courses` (`id`)
+);
+
+CREATE TABLE `letter_grades`
+(
+    `course_id`   CHAR(26),
+    `grade`       ENUM ('S', 'A', 'B', 'C', 'F') NOT NULL,
+    `min_score`   TINYINT UNSIGNED               NOT NULL,
+    `grade_point` SMALLINT UNSIGNED              NOT NULL COMMENT '1/100単位',
+    PRIMARY KEY (`course_id`, `grade`),
+    CONSTRAINT FK_letter_grades_course_id FOREIGN KEY (`course_id`) REFERENCES `courses` (`id`)
+);
+
+-- 成績の集計値
+-- submissions, registrations, courses から導出できる値を更新時に差分で保持する
+CREATE TABLE `class_aggregates`
+(
+    `class_id`   CHAR(26) PRIMARY KEY,
+    `submitters` INT UNSIGNED NOT NULL DEFAULT 0,
+    CONSTRAINT FK_class_aggregates_class_id FOREIGN KEY (`class_id`) REFERENCES `classes` (`id`)
+);
+
+CREATE TABLE `course_score_totals`
+(
+    `course_id`   CHAR(26),
+    `user_id`     CHAR(26),
+    `total_score` INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (`course_id`, `user_id`),
+    CONSTRAINT FK_course_score_totals_course_id FOREIGN KEY (`course_id`) REFERENCES `courses` (`id`),
+    CONSTRAINT FK_course_score_totals_user_id FOREIGN KEY (`user_id`) REFERENCES `users` (`id`)
+);
+
+CREATE TABLE `user_gpa_aggregates`
+(
+    `user_id`        CHAR(26) PRIMARY KEY,
+    `credits`        INT    NOT NULL DEFAULT 0,
+    `gpa_credits`    INT    NOT NULL DEFAULT 0,
+    `weighted_score` BIGINT NOT NULL DEFAULT 0,
+    CONSTRAINT FK_user_gpa_aggregates_user_id FOREIGN KEY (`user_id`) REFERENCES `users` (`id`)
+);
+
+-- 発行済みの成績証明書。hash は content(JSON)のSHA-256
+CREATE TABLE `transcripts`
+(
+    `hash`      CHAR(64) PRIMARY KEY,
+    `user_id`   CHAR(26)    NOT NULL,
+    `content`   JSON        NOT NULL,
+    `issued_at` DATETIME(6) NOT NULL,
+    CONSTRAINT FK_transcripts_user_id FOREIGN KEY (`user_id`) REFERENCES `users` (`id`)
+);
+
+-- 成績の再評価の申請
+CREATE TABLE `appeals`
+(
+    `id`         CHAR(26) PRIMARY KEY,
+    `course_id`  CHAR(26)                                 NOT NULL,
+    `class_id`   CHAR(26)                                 NOT NULL,
+    `user_id`    CHAR(26)                                 NOT NULL,
+    `reason`     TEXT                                     NOT NULL,
+    `status`     ENUM ('pending', 'accepted', 'rejected') NOT NULL DEFAULT 'pending',
+    `created_at` DATETIME(6)                              NOT NULL,
+    INDEX `idx_appeals_course_id_status` (`course_id`, `status`),
+    INDEX `idx_appeals_class_id_user_id` (`class_id`, `user_id`),
+    CONSTRAINT FK_appeals_course_id FOREIGN KEY (`course_id`) REFERENCES `courses` (`id`),
+    CONSTRAINT FK_appeals_class_id FOREIGN KEY (`class_id`) REFERENCES `classes` (`id`),
+    CONSTRAINT FK_appeals_user_id FOREIGN KEY (`user_id`) REFERENCES `users` (`id`)
+);
+
+-- 申請の履歴。申請・受理・却下の操作毎に1行
+CREATE TABLE `appeal_events`
+(
+    `id`         CHAR(26) PRIMARY KEY,
+    `appeal_id`  CHAR(26)                            NOT NULL,
+    `actor_id`   CHAR(26)                            NOT NULL,
+    `action`     ENUM ('submit', 'accept', 'reject') NOT NULL,
+    `old_score`  INT,
+    `new_score`  INT,
+    `comment`    TEXT                                NOT NULL,
+    `created_at` DATETIME(6)                         NOT NULL,
+    INDEX `idx_appeal_events_appeal_id` (`appeal_id`),
+    CONSTRAINT FK_appeal_events_appeal_id FOREIGN KEY (`appeal_id`) REFERENCES `appeals` (`id`),
+    CONSTRAINT FK_appeal_events_actor_id FOREIGN KEY (`actor_id`) REFERENCES `users` (`id`)
+);
+
+-- 講義の出席確認。講義毎に最後に発行したチェックインコードのみを保持する
+CREATE TABLE `attendance_sessions`
+(
+    `class_id`   CHAR(26) PRIMARY KEY,
+    `code`       CHAR(6)     NOT NULL,
+    `opened_by`  CHAR(26)    NOT NULL,
+    `opened_at`  DATETIME(6) NOT NULL,
+    `expires_at` DATETIME(6) NOT NULL,
+    CONSTRAINT FK_attendance_sessions_class_id FOREIGN KEY (`class_id`) REFERENCES `classes` (`id`),
+    CONSTRAINT FK_attendance_sessions_opened_by FOREIGN KEY (`opened_by`) REFERENCES `users` (`id`)
+);
+
+CREATE TABLE `attendances`
+(
+    `class_id`      CHAR(26),
+    `user_id`       CHAR(26),
+    `checked_in_at` DATETIME(6) NOT NULL,
+    PRIMARY KEY (`class_id`, `user_id`),
+    INDEX `idx_attendances_user_id` (`user_id`),
+    CONSTRAINT FK_attendances_class_id FOREIGN KEY (`class_id`) REFERENCES `classes` (`id`),
+    CONSTRAINT FK_attendances_user_id FOREIGN KEY (`user_id`) REFERENCES `users` (`id`)
+);
+
+-- 講義資料。kind が file の場合はファイル名、link の場合はURLを持つ
+CREATE TABLE `class_materials`
+(
+    `id`         CHAR(26) PRIMARY KEY,
+    `class_id`   CHAR(26)              NOT NULL,
+    `kind`       ENUM ('file', 'link') NOT NULL,
+    `title`      VARCHAR(255)          NOT NULL,
+    `file_name`  VARCHAR(255)          NOT NULL DEFAULT '',
+    `url`        VARCHAR(2048)         NOT NULL DEFAULT '',
+    `created_at` DATETIME(6)           NOT NULL,
+    INDEX `idx_class_materials_class_id` (`class_id`),
+    CONSTRAINT FK_class_materials_class_id FOREIGN KEY (`class_id`) REFERENCES `classes` (`id`)
+);
+
+CREATE TABLE `course_syllabi`
+(
+    `course_id`  CHAR(26) PRIMARY KEY,
+    `file_name`  VARCHAR(255) NOT NULL,
+    `updated_at` DATETIME(6)  NOT NULL,
+    CONSTRAINT FK_course_syllabi_course_id FOREIGN KEY (`course_id`) REFERENCES `courses` (`id`)
+);